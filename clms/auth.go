@@ -1,18 +1,23 @@
 package clms
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
-	"quantify.earth/reclaimer/internal/utils"
 )
 
 // This is the structure you download from the CLMS website
@@ -46,49 +51,189 @@ func LoadAPIKey(path string) (CLMSAuthenticationDetails, error) {
 	if nil != err {
 		return CLMSAuthenticationDetails{}, err
 	}
+	return ParseAPIKey(contents)
+}
+
+var pemArmour = regexp.MustCompile(`(?s)-----BEGIN ([A-Z ]+)-----(.*?)-----END ([A-Z ]+)-----`)
+
+// privateKeyDER gets the raw key bytes out of however the key has been
+// written down. We've seen keys as standard PEM, as PEM with the line breaks
+// stripped or escaped (which pem.Decode won't accept), and as bare base64.
+func privateKeyDER(raw string) ([]byte, error) {
+	raw = strings.TrimSpace(strings.ReplaceAll(raw, `\n`, "\n"))
+	if "" == raw {
+		return nil, fmt.Errorf("private key is empty")
+	}
+
+	if strings.Contains(raw, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(raw))
+		if nil != block {
+			return block.Bytes, nil
+		}
+		match := pemArmour.FindStringSubmatch(raw)
+		if nil == match {
+			return nil, fmt.Errorf("private key has a PEM header but is malformed")
+		}
+		if match[1] != match[3] {
+			return nil, fmt.Errorf("private key PEM header %q does not match footer %q", match[1], match[3])
+		}
+		raw = match[2]
+	}
+
+	body := strings.Join(strings.Fields(raw), "")
+	der, err := base64.StdEncoding.DecodeString(body)
+	if nil != err {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+	return der, nil
+}
 
-	var token CLMSAuthenticationDetails
-	err = json.Unmarshal(contents, &token)
+// The keys CLMS issues are PKCS#1, but keys that have been through other
+// tools often come back as PKCS#8, so accept either.
+func parsePrivateKey(raw string) (*rsa.PrivateKey, error) {
+	der, err := privateKeyDER(raw)
 	if nil != err {
-		return CLMSAuthenticationDetails{}, fmt.Errorf("failed to parse: %w", err)
+		return nil, err
 	}
 
-	return token, nil
+	key, pkcs1Err := x509.ParsePKCS1PrivateKey(der)
+	if nil == pkcs1Err {
+		return key, nil
+	}
+	parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(der)
+	if nil != pkcs8Err {
+		return nil, fmt.Errorf("failed to parse private key as PKCS#1 (%v) or PKCS#8 (%v)", pkcs1Err, pkcs8Err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key must be RSA, got %T", parsed)
+	}
+	return rsaKey, nil
 }
 
 func (c CLMSAuthenticationDetails) key() (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(c.PrivateKey))
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	return parsePrivateKey(c.PrivateKey)
+}
+
+// Validate checks the key details before we go near the network. Things
+// that will certainly stop the key working are returned as an error, and
+// things that might are returned as warnings.
+func (c CLMSAuthenticationDetails) Validate() ([]string, error) {
+	warnings := make([]string, 0)
+	problems := make([]error, 0)
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"client_id", c.ClientID},
+		{"user_id", c.UserID},
+		{"key_id", c.KeyID},
+		{"token_uri", c.TokenURI},
+	} {
+		if "" == strings.TrimSpace(field.value) {
+			problems = append(problems, fmt.Errorf("%s is missing", field.name))
+		}
+	}
+
+	if "" != c.TokenURI {
+		tokenURI, err := url.Parse(c.TokenURI)
+		if (nil != err) || !tokenURI.IsAbs() || ("" == tokenURI.Host) {
+			problems = append(problems, fmt.Errorf("token_uri is not a valid URL: %s", c.TokenURI))
+		} else if "https" != tokenURI.Scheme {
+			warnings = append(warnings, fmt.Sprintf("token_uri does not use HTTPS: %s", c.TokenURI))
+		}
+	}
+
+	if "" == c.Issued {
+		warnings = append(warnings, "issued date is missing")
+	} else {
+		issued, ok := parseCLMSTime(c.Issued)
+		if !ok {
+			problems = append(problems, fmt.Errorf("issued date is not a valid date: %s", c.Issued))
+		} else if issued.After(time.Now()) {
+			warnings = append(warnings, fmt.Sprintf("issued date is in the future: %s", c.Issued))
+		}
+	}
+
+	if (nil != c.IPRange) && ("" != strings.TrimSpace(*c.IPRange)) {
+		warnings = append(warnings, fmt.Sprintf("key can only be used from IP range %s", *c.IPRange))
+	}
+
+	_, err := c.key()
+	if nil != err {
+		problems = append(problems, err)
+	}
+
+	return warnings, errors.Join(problems...)
 }
 
 func (c CLMSAuthenticationDetails) GetSessionToken() (string, error) {
+	token, err := c.RequestSessionToken()
+	if nil != err {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// RequestSessionToken always goes to the token endpoint. Most callers will
+// want to use a SessionTokenSource instead, which will reuse tokens across
+// invocations.
+func (c CLMSAuthenticationDetails) RequestSessionToken() (CLMSSessionToken, error) {
+	return c.RequestSessionTokenWithContext(context.Background(), nil, "")
+}
 
+// tokenEndpoint picks the token URI to use: one given explicitly, then the
+// package's TokenURI, and finally the one in the key.
+func (c CLMSAuthenticationDetails) tokenEndpoint(tokenURI string) string {
+	if "" != tokenURI {
+		return tokenURI
+	}
+	if "" != TokenURI {
+		return TokenURI
+	}
+	return c.TokenURI
+}
+
+// RequestSessionTokenWithContext is RequestSessionToken using the given
+// HTTP client, which defaults to http.DefaultClient, and sending the
+// request to tokenURI if that is set.
+func (c CLMSAuthenticationDetails) RequestSessionTokenWithContext(ctx context.Context, client *http.Client, tokenURI string) (CLMSSessionToken, error) {
+	if nil == client {
+		client = http.DefaultClient
+	}
+
+	requested := time.Now()
+	tokenURI = c.tokenEndpoint(tokenURI)
 	claims := jwt.StandardClaims{
 		Issuer:    c.ClientID,
 		Subject:   c.UserID,
-		Audience:  c.TokenURI,
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Unix() + (60 * 60),
+		Audience:  tokenURI,
+		IssuedAt:  requested.Unix(),
+		ExpiresAt: requested.Unix() + (60 * 60),
 	}
 
 	claim := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	key, err := c.key()
 	if nil != err {
-		return "", err
+		return CLMSSessionToken{}, err
 	}
 	assertion, err := claim.SignedString(key)
 	if nil != err {
-		return "", err
+		return CLMSSessionToken{}, err
 	}
 
-	headers := map[string]string{
-		"Accept":       "application/json",
-		"Content-Type": "application/x-www-form-urlencoded",
-	}
 	body := "grant_type=urn:ietf:params:oauth:grant-type:jwt-bearer&assertion=" + assertion
-	resp, err := utils.HTTPPost(c.TokenURI, headers, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(body))
 	if nil != err {
-		return "", err
+		return CLMSSessionToken{}, err
+	}
+	req.Header.Set("User-Agent", "Reclaimer/0.1")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if nil != err {
+		return CLMSSessionToken{}, err
 	}
 	defer resp.Body.Close()
 
@@ -98,14 +243,24 @@ func (c CLMSAuthenticationDetails) GetSessionToken() (string, error) {
 		if nil == err {
 			body = string(r)
 		}
-		return "", fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, body)
+		return CLMSSessionToken{}, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, body)
 	}
 
 	var res CLMSAuthResponse
 	err = json.NewDecoder(resp.Body).Decode(&res)
 	if nil != err {
-		return "", fmt.Errorf("failed to decode response for: %w", err)
+		return CLMSSessionToken{}, fmt.Errorf("failed to decode response for: %w", err)
 	}
 
-	return res.AccessToken, nil
+	lifetime := time.Duration(res.ExpiresInSeconds) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return CLMSSessionToken{
+		AccessToken: res.AccessToken,
+		Expires:     requested.Add(lifetime),
+		ClientID:    c.ClientID,
+		KeyID:       c.KeyID,
+		TokenURI:    tokenURI,
+	}, nil
 }
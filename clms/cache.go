@@ -0,0 +1,275 @@
+package clms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// How long a Client trusts a cached copy of the CLMS index before checking
+// with the server whether it has changed, unless told otherwise.
+const DefaultIndexCacheTTL = 24 * time.Hour
+
+const generatedIndexCacheName = "clms-index-generated.json"
+const prepackagedIndexCacheName = "clms-index-prepackaged.json"
+
+// The HTTP validators returned with the first page of the index, which
+// let us ask the server cheaply whether our cached copy is out of date.
+type indexValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func validatorsFromHeader(header http.Header) indexValidators {
+	return indexValidators{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+}
+
+type indexCache[T any] struct {
+	Source     string          `json:"source"`
+	Fetched    time.Time       `json:"fetched"`
+	Validators indexValidators `json:"validators"`
+	Items      []T             `json:"items"`
+}
+
+// The cache is only any use if it came from the server we're talking to now.
+func (c indexCache[T]) from(firstURL string) bool {
+	return c.Source == firstURL
+}
+
+func (c indexCache[T]) fresh(now time.Time, ttl time.Duration) bool {
+	return now.Sub(c.Fetched) < ttl
+}
+
+func cacheFilePath(name string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if nil != err {
+		return "", fmt.Errorf("failed to find user cache dir: %w", err)
+	}
+	return path.Join(cacheDir, "reclaimer", name), nil
+}
+
+// Cache files are written atomically so that concurrent invocations never
+// see a partial file, and are only readable by the user as some of them
+// contain credentials.
+func writeCacheFile(cachePath string, contents []byte) error {
+	cacheDir := path.Dir(cachePath)
+	err := os.MkdirAll(cacheDir, 0o700)
+	if nil != err {
+		return fmt.Errorf("failed to make cache dir: %w", err)
+	}
+	// CreateTemp makes files with mode 0600, which is what we want
+	return writeFileAtomically(cachePath, contents, 0)
+}
+
+// writeFileAtomically writes to a temporary file next to filePath and then
+// moves it into place, giving it mode perm unless that is zero.
+func writeFileAtomically(filePath string, contents []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(path.Dir(filePath), path.Base(filePath)+".*.tmp")
+	if nil != err {
+		return fmt.Errorf("failed to create %s: %w", filePath, err)
+	}
+	_, err = tmp.Write(contents)
+	if (nil == err) && (0 != perm) {
+		err = tmp.Chmod(perm)
+	}
+	closeErr := tmp.Close()
+	if nil == err {
+		err = closeErr
+	}
+	if nil != err {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", filePath, err)
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if nil != err {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to move %s into place: %w", filePath, err)
+	}
+	return nil
+}
+
+func readIndexCache[T any](name string) (indexCache[T], error) {
+	cachePath, err := cacheFilePath(name)
+	if nil != err {
+		return indexCache[T]{}, err
+	}
+	contents, err := os.ReadFile(cachePath)
+	if nil != err {
+		return indexCache[T]{}, err
+	}
+
+	var cache indexCache[T]
+	err = json.Unmarshal(contents, &cache)
+	if nil != err {
+		return indexCache[T]{}, fmt.Errorf("failed to parse index cache %s: %w", cachePath, err)
+	}
+	return cache, nil
+}
+
+func writeIndexCache[T any](name string, cache indexCache[T]) error {
+	cachePath, err := cacheFilePath(name)
+	if nil != err {
+		return err
+	}
+	contents, err := json.Marshal(cache)
+	if nil != err {
+		return fmt.Errorf("failed to encode index cache: %w", err)
+	}
+	return writeCacheFile(cachePath, contents)
+}
+
+// Ask the server whether the first page of the index has changed since
+// we cached it. If the server didn't give us any validators then we have
+// to assume it has.
+func revalidateIndex(ctx context.Context, c *Client, firstURL string, validators indexValidators) (bool, error) {
+	if ("" == validators.ETag) && ("" == validators.LastModified) {
+		return false, nil
+	}
+
+	headers := make(map[string]string)
+	if "" != validators.ETag {
+		headers["If-None-Match"] = validators.ETag
+	}
+	if "" != validators.LastModified {
+		headers["If-Modified-Since"] = validators.LastModified
+	}
+	resp, err := c.call(ctx, apiCall{
+		method:   http.MethodGet,
+		url:      firstURL,
+		headers:  headers,
+		expected: []int{http.StatusOK, http.StatusNotModified},
+	})
+	if nil != err {
+		return false, err
+	}
+	return http.StatusNotModified == resp.StatusCode, nil
+}
+
+func loadIndex[T any](
+	ctx context.Context,
+	c *Client,
+	name string,
+	firstURL string,
+	refresh bool,
+	fetch func(context.Context) ([]T, indexValidators, error),
+) ([]T, error) {
+	now := time.Now()
+	if !refresh {
+		cache, err := readIndexCache[T](name)
+		if (nil == err) && cache.from(firstURL) {
+			if cache.fresh(now, c.indexCacheTTL()) {
+				return cache.Items, nil
+			}
+			notModified, err := revalidateIndex(ctx, c, firstURL, cache.Validators)
+			if (nil == err) && notModified {
+				cache.Fetched = now
+				err = writeIndexCache(name, cache)
+				if nil != err {
+					c.logger().Warn("failed to update index cache", "error", err)
+				}
+				return cache.Items, nil
+			}
+		}
+	}
+
+	items, validators, err := fetch(ctx)
+	if nil != err {
+		return nil, err
+	}
+	err = writeIndexCache(name, indexCache[T]{
+		Source:     firstURL,
+		Fetched:    now,
+		Validators: validators,
+		Items:      items,
+	})
+	if nil != err {
+		c.logger().Warn("failed to write index cache", "error", err)
+	}
+	return items, nil
+}
+
+// LoadIndexGeneratedData returns the index of generated datasets, using
+// the local cache where it is still valid. Set refresh to ignore the
+// cache and fetch the whole index again.
+func (c *Client) LoadIndexGeneratedData(ctx context.Context, refresh bool) ([]CLMSDataset, error) {
+	return loadIndex(ctx, c, generatedIndexCacheName, c.generatedIndexURL(), refresh, c.fetchIndexGeneratedData)
+}
+
+// LoadIndexPrepackagedData returns the index of prepackaged datasets, using
+// the local cache where it is still valid. Set refresh to ignore the
+// cache and fetch the whole index again.
+func (c *Client) LoadIndexPrepackagedData(ctx context.Context, refresh bool) ([]CLMSPrepackagedDataset, error) {
+	return loadIndex(ctx, c, prepackagedIndexCacheName, c.prepackagedIndexURL(), refresh, c.fetchIndexPrepackagedData)
+}
+
+// Looking up a single dataset doesn't warrant paging through the entire
+// catalogue, so if we don't have it in a fresh cache we ask the API for
+// just that one.
+func findDataset[T any, B any](
+	ctx context.Context,
+	c *Client,
+	name string,
+	uid string,
+	refresh bool,
+	uidOf func(T) string,
+	searchURL string,
+	itemsOf func(B) []T,
+) (T, bool, error) {
+	var empty T
+	if !refresh {
+		cache, err := readIndexCache[T](name)
+		if (nil == err) && cache.from(searchURL) && cache.fresh(time.Now(), c.indexCacheTTL()) {
+			for _, item := range cache.Items {
+				if uidOf(item) == uid {
+					return item, true, nil
+				}
+			}
+		}
+	}
+
+	var batch B
+	_, err := c.fetchIndexBatch(ctx, searchURL+"&UID="+url.QueryEscape(uid), &batch)
+	if nil != err {
+		return empty, false, err
+	}
+	for _, item := range itemsOf(batch) {
+		if uidOf(item) == uid {
+			return item, true, nil
+		}
+	}
+	return empty, false, nil
+}
+
+func (c *Client) FindGeneratedDataset(ctx context.Context, uid string, refresh bool) (CLMSDataset, bool, error) {
+	return findDataset(
+		ctx,
+		c,
+		generatedIndexCacheName,
+		uid,
+		refresh,
+		func(item CLMSDataset) string { return item.UID },
+		c.generatedIndexURL(),
+		func(batch CLMSSearch) []CLMSDataset { return batch.Items },
+	)
+}
+
+func (c *Client) FindPrepackagedDataset(ctx context.Context, uid string, refresh bool) (CLMSPrepackagedDataset, bool, error) {
+	return findDataset(
+		ctx,
+		c,
+		prepackagedIndexCacheName,
+		uid,
+		refresh,
+		func(item CLMSPrepackagedDataset) string { return item.UID },
+		c.prepackagedIndexURL(),
+		func(batch CLMSSearchPrepared) []CLMSPrepackagedDataset { return batch.Items },
+	)
+}
@@ -0,0 +1,156 @@
+package clms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIndexCacheUsedWhenFresh(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	fetches := 0
+	fetch := func(context.Context) ([]CLMSDataset, indexValidators, error) {
+		fetches += 1
+		return []CLMSDataset{{UID: "abc"}}, indexValidators{}, nil
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		items, err := loadIndex(context.Background(), &Client{}, "test-index.json", "http://invalid.example/", false, fetch)
+		if nil != err {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if (1 != len(items)) || ("abc" != items[0].UID) {
+			t.Errorf("Got unexpected items %v", items)
+		}
+	}
+	if 1 != fetches {
+		t.Errorf("Expected one fetch, got %d", fetches)
+	}
+
+	_, err := loadIndex(context.Background(), &Client{}, "test-index.json", "http://invalid.example/", true, fetch)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if 2 != fetches {
+		t.Errorf("Expected refresh to fetch, got %d fetches", fetches)
+	}
+}
+
+func TestIndexCacheRevalidation(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	fetches := 0
+	fetch := func(context.Context) ([]CLMSDataset, indexValidators, error) {
+		fetches += 1
+		return []CLMSDataset{{UID: "abc"}}, indexValidators{ETag: etag}, nil
+	}
+
+	stale := indexCache[CLMSDataset]{
+		Source:     server.URL,
+		Fetched:    time.Now().Add(-2 * DefaultIndexCacheTTL),
+		Validators: indexValidators{ETag: etag},
+		Items:      []CLMSDataset{{UID: "cached"}},
+	}
+	err := writeIndexCache("test-index.json", stale)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	items, err := loadIndex(context.Background(), &Client{}, "test-index.json", server.URL, false, fetch)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if 0 != fetches {
+		t.Errorf("Expected not modified response to avoid fetch, got %d fetches", fetches)
+	}
+	if (1 != len(items)) || ("cached" != items[0].UID) {
+		t.Errorf("Expected cached items, got %v", items)
+	}
+
+	cache, err := readIndexCache[CLMSDataset]("test-index.json")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !cache.fresh(time.Now(), DefaultIndexCacheTTL) {
+		t.Errorf("Expected revalidated cache to be fresh again")
+	}
+
+	etag = `"v2"`
+	cache.Fetched = time.Now().Add(-2 * DefaultIndexCacheTTL)
+	err = writeIndexCache("test-index.json", cache)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	items, err = loadIndex(context.Background(), &Client{}, "test-index.json", server.URL, false, fetch)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if 1 != fetches {
+		t.Errorf("Expected modified index to be fetched, got %d fetches", fetches)
+	}
+	if (1 != len(items)) || ("abc" != items[0].UID) {
+		t.Errorf("Expected fetched items, got %v", items)
+	}
+}
+
+func TestIndexCacheIgnoredForOtherServer(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	fetches := 0
+	fetch := func(context.Context) ([]CLMSDataset, indexValidators, error) {
+		fetches += 1
+		return []CLMSDataset{{UID: "abc"}}, indexValidators{}, nil
+	}
+
+	for _, source := range []string{"http://one.example/", "http://two.example/", "http://two.example/"} {
+		_, err := loadIndex(context.Background(), &Client{}, "test-index.json", source, false, fetch)
+		if nil != err {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if 2 != fetches {
+		t.Errorf("Expected a fetch per server, got %d fetches", fetches)
+	}
+}
+
+func TestIndexCacheTTLIsPerClient(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	fetches := 0
+	fetch := func(context.Context) ([]CLMSDataset, indexValidators, error) {
+		fetches += 1
+		return []CLMSDataset{{UID: "abc"}}, indexValidators{}, nil
+	}
+
+	cases := []struct {
+		client  *Client
+		fetches int
+	}{
+		{&Client{}, 1},
+		{&Client{IndexCacheTTL: time.Hour}, 1},
+		{&Client{IndexCacheTTL: -1}, 2},
+		{&Client{}, 2},
+	}
+	for idx, tc := range cases {
+		_, err := loadIndex(context.Background(), tc.client, "test-index.json", "http://invalid.example/", false, fetch)
+		if nil != err {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if tc.fetches != fetches {
+			t.Errorf("%d: Expected %d fetches, got %d", idx, tc.fetches, fetches)
+		}
+	}
+}
@@ -1,145 +1,266 @@
 package clms
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/cheynewallace/tabby"
 
 	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
 )
 
-func inspectAllGeneratedData() error {
-	index, err := FetchIndexGeneratedData()
+func printJSON(value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if nil != err {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	fmt.Printf("%s\n", string(encoded))
+	return nil
+}
+
+// setFlags returns which flags were given explicitly, as opposed to having
+// their default values.
+func setFlags(flagset *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flagset.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+func inspectAllGeneratedData(ctx context.Context, client *Client, filter SearchFilter, refresh bool, asJSON bool) error {
+	index, err := client.LoadIndexGeneratedData(ctx, refresh)
 	if nil != err {
 		return err
 	}
+	results := filter.FilterGeneratedDatasets(index)
 
-	for _, item := range index {
-		fmt.Printf("%s: %s", item.UID, item.Title)
-		if items, ok := item.Downloads["items"]; ok {
-			fmt.Printf(" (%d items)", len(items))
-		}
-		fmt.Printf("\n")
+	if asJSON {
+		return printJSON(results)
 	}
 
+	t := tabby.New()
+	t.AddHeader("UID", "Title", "Items")
+	for _, item := range results {
+		t.AddLine(item.UID, item.Title, len(item.Downloads["items"]))
+	}
+	t.Print()
+
 	return nil
 }
 
-func inspectGeneratadData(UID string) error {
-	index, err := FetchIndexGeneratedData()
+func inspectGeneratadData(ctx context.Context, client *Client, UID string, filter SearchFilter, refresh bool, asJSON bool) error {
+	item, found, err := client.FindGeneratedDataset(ctx, UID, refresh)
 	if nil != err {
 		return err
 	}
+	if !found {
+		return fmt.Errorf("no generated dataset found with UID %s", UID)
+	}
+	if filter.hasItemFilters() {
+		item = filter.withMatchingDownloads(item)
+	}
 
-	for _, item := range index {
-		if item.UID == UID {
-			fmt.Printf("title: %s\n", item.Title)
-			fmt.Printf("description: %s\n", item.Description)
+	if asJSON {
+		return printJSON(item)
+	}
 
-			if items, ok := item.Downloads["items"]; ok {
-				for _, item := range items {
-					fmt.Printf("\t%s: %s\n", item.ID, item.FullPath)
-				}
-			}
+	fmt.Printf("title: %s\n", item.Title)
+	fmt.Printf("description: %s\n", item.Description)
 
-			break
+	if 0 != len(item.CoordinateSystems) {
+		fmt.Printf("coordinate systems: %s\n", strings.Join(item.CoordinateSystems, ", "))
+	}
+
+	table, err := client.FormatConversionTable(ctx)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Warning: only showing source formats: %v\n", err)
+	}
+	for _, item := range item.Downloads["items"] {
+		fmt.Printf("\t%s: %s\n", item.ID, item.FullPath)
+		if 0 != len(item.FullFormat) {
+			fmt.Printf("\t\tformats: %s\n", strings.Join(table.OutputFormats(item).Tokens(), ", "))
 		}
 	}
 
 	return nil
 }
 
-func inspectAllPrepackagedData() error {
-	index, err := FetchIndexPrepackagedData()
+func inspectAllPrepackagedData(ctx context.Context, client *Client, filter SearchFilter, refresh bool, asJSON bool) error {
+	index, err := client.LoadIndexPrepackagedData(ctx, refresh)
 	if nil != err {
 		return err
 	}
+	results := filter.FilterPrepackagedDatasets(index)
 
-	for _, item := range index {
-		fmt.Printf("%s: %s", item.UID, item.Title)
-		fmt.Printf(" (%d items)", len(item.Files.Items))
-		fmt.Printf("\n")
+	if asJSON {
+		return printJSON(results)
 	}
 
+	t := tabby.New()
+	t.AddHeader("UID", "Title", "Items")
+	for _, item := range results {
+		t.AddLine(item.UID, item.Title, len(item.Files.Items))
+	}
+	t.Print()
+
 	return nil
 }
 
-func inspectPrepackagedData(UID string) error {
-	index, err := FetchIndexPrepackagedData()
+func inspectPrepackagedData(ctx context.Context, client *Client, UID string, filter SearchFilter, refresh bool, asJSON bool) error {
+	item, found, err := client.FindPrepackagedDataset(ctx, UID, refresh)
 	if nil != err {
 		return err
 	}
+	if !found {
+		return fmt.Errorf("no prepackaged dataset found with UID %s", UID)
+	}
+	if filter.hasItemFilters() {
+		item.Files.Items = filter.FilterFiles(item)
+	}
 
-	for _, item := range index {
-		if item.UID == UID {
-			fmt.Printf("title: %s\n", item.Title)
-			fmt.Printf("description: %s\n", item.Description)
+	if asJSON {
+		return printJSON(item)
+	}
 
-			for _, item := range item.Files.Items {
-				fmt.Printf("\t%s: %s (%s)\n", item.ID, item.File, item.Size)
-			}
+	fmt.Printf("title: %s\n", item.Title)
+	fmt.Printf("description: %s\n", item.Description)
 
-			break
-		}
+	for _, item := range item.Files.Items {
+		fmt.Printf("\t%s: %s (%s)\n", item.ID, item.File, item.Size)
 	}
 
 	return nil
 }
 
-func completeDownload(sessionToken string, taskID string, extract bool, outputPath string) error {
-	var status CLMSTaskStatus
-	var err error
-	for {
-		status, err = GetTaskStatus(taskID, sessionToken)
+func emitRequestSpec(ctx context.Context, client *Client, UID string, filter SearchFilter, prepackaged bool, refresh bool) error {
+	var spec RequestSpec
+	if prepackaged {
+		item, found, err := client.FindPrepackagedDataset(ctx, UID, refresh)
 		if nil != err {
-			return fmt.Errorf("error checking task status: %w", err)
+			return err
 		}
-
-		if status.Status == TaskInProgress {
-			fmt.Printf("In progress...")
-			time.Sleep(time.Second * 5)
-			continue
+		if !found {
+			return fmt.Errorf("no prepackaged dataset found with UID %s", UID)
 		}
-		if status.Status != TaskFinished {
-			return fmt.Errorf("received unexpected status: %s", status.Status)
+		spec = PrepackagedRequestSpec(item, filter)
+	} else {
+		item, found, err := client.FindGeneratedDataset(ctx, UID, refresh)
+		if nil != err {
+			return err
 		}
-		break
+		if !found {
+			return fmt.Errorf("no generated dataset found with UID %s", UID)
+		}
+		spec = GeneratedRequestSpec(item, filter)
 	}
-
-	if "" == status.DownloadURL {
-		return fmt.Errorf("got an empty download URL for task")
+	if "" == spec.DownloadID {
+		if 0 == len(spec.Options) {
+			return fmt.Errorf("no items in %s match", UID)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %d items match, set download_id in the spec to one of the options or narrow the search.\n", len(spec.Options))
 	}
-	downloadURL, err := url.Parse(status.DownloadURL)
+	return printJSON(spec)
+}
+
+// The CLI reports warnings from the library on stderr, without the
+// timestamps that would be useful in a service's logs.
+func newCLILogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if (0 == len(groups)) && (slog.TimeKey == attr.Key) {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+}
+
+func newSession(credentials credentialFlags) (*SessionTokenSource, error) {
+	apiKey, _, err := LoadCredentials(credentials)
 	if nil != err {
-		return fmt.Errorf("failed to parse download url: %w", err)
+		return nil, err
 	}
-	targetFilename := path.Base(downloadURL.Path)
+	session := NewSessionTokenSource(apiKey)
+	session.Logger = newCLILogger()
+	return session, nil
+}
 
-	fmt.Printf("Downloading data...")
-	return utils.DownloadFile(status.DownloadURL, targetFilename, extract, outputPath)
+// newClient makes a client for verbs that need an API key.
+func newClient(credentials credentialFlags) (*Client, error) {
+	session, err := newSession(credentials)
+	if nil != err {
+		return nil, err
+	}
+	return &Client{
+		Tokens: session,
+		Logger: session.Logger,
+	}, nil
 }
 
-func fetchGeneratedData(
-	uid string,
-	downloadID string,
-	extract bool,
-	outputFormat string,
-	coordinateSystem string,
-	sessionToken string,
-	outputPath string,
-) error {
+func completeDownload(ctx context.Context, client *Client, taskID string, extract bool, metadata bool, outputPath string, poll PollOptions) error {
+	progress := newProgressLine()
+	status, err := client.WaitForTask(ctx, taskID, poll, func(elapsed time.Duration, status CLMSTaskStatus) {
+		progress.update(elapsed, status.Status)
+	})
+	progress.done()
+	if nil != err {
+		return err
+	}
 
-	task, err := RequestGeneratedData(uid, downloadID, outputFormat, coordinateSystem, sessionToken, outputPath)
+	return downloadFinishedTask(ctx, client, taskID, status, extract, metadata, outputPath)
+}
+
+func downloadFinishedTask(ctx context.Context, client *Client, taskID string, status CLMSTaskStatus, extract bool, metadata bool, outputPath string) error {
+	fmt.Printf("Downloading data for %s...\n", taskID)
+	err := client.DownloadTask(ctx, status, extract, outputPath)
 	if nil != err {
 		return err
 	}
 
+	err = UpdateTaskRecord(taskID, func(record *TaskRecord) {
+		record.Downloaded = time.Now()
+		record.DownloadedTo = outputPath
+	})
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record download: %v\n", err)
+	}
+
+	if metadata {
+		err = client.saveTaskMetadata(ctx, status, outputPath)
+		if nil != err {
+			return fmt.Errorf("failed to save metadata: %w", err)
+		}
+	}
+	return nil
+}
+
+// Having made a request, make a note of it so it can be picked up later,
+// and then either wait for it or leave it for the user to resume.
+func awaitRequest(
+	ctx context.Context,
+	client *Client,
+	uid string,
+	task CLMSTaskResponse,
+	extract bool,
+	metadata bool,
+	outputPath string,
+	poll PollOptions,
+	noWait bool,
+) error {
 	// we only asked for one thing, so if there's an error task, it's game over
 	if len(task.ErrorTaskIDs) > 0 {
 		return fmt.Errorf("only got error for tasks.")
@@ -147,46 +268,136 @@ func fetchGeneratedData(
 	if len(task.TaskIDs) != 1 {
 		return fmt.Errorf("expected one task, got %d", len(task.TaskIDs))
 	}
-	fmt.Printf("Data requested...")
-
 	taskID := task.TaskIDs[0].ID
-	return completeDownload(sessionToken, taskID, extract, outputPath)
+	fmt.Printf("Data requested, request ID %s\n", taskID)
+
+	err := UpdateTaskRecord(taskID, func(record *TaskRecord) {
+		record.DatasetID = uid
+		record.Requested = time.Now()
+		record.Output = outputPath
+		record.Extract = extract
+	})
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record request: %v\n", err)
+	}
+
+	if noWait {
+		fmt.Printf("Not waiting for the request to complete, use the resume verb with -request %s to download it later.\n", taskID)
+		return nil
+	}
+
+	return completeDownload(ctx, client, taskID, extract, metadata, outputPath, poll)
+}
+
+// Users can either give us the download ID directly, or describe the item
+// they want and we'll find its ID.
+func resolveDownloadID(ctx context.Context, client *Client, uid string, downloadID string, selector ItemSelector, prepackaged bool) (string, error) {
+	if "" == uid {
+		return "", fmt.Errorf("Datset ID required")
+	}
+	if !selector.Empty() {
+		if "" != downloadID {
+			return "", fmt.Errorf("Specify either a download ID or selection flags, not both")
+		}
+		if prepackaged {
+			dataset, found, err := client.FindPrepackagedDataset(ctx, uid, false)
+			if nil != err {
+				return "", fmt.Errorf("failed to look up dataset: %w", err)
+			}
+			if !found {
+				return "", fmt.Errorf("no prepackaged dataset found with UID %s", uid)
+			}
+			file, err := SelectFile(dataset, selector)
+			if nil != err {
+				return "", err
+			}
+			fmt.Printf("Selected %s (%s)\n", file.File, file.ID)
+			return file.ID, nil
+		}
+		dataset, found, err := client.FindGeneratedDataset(ctx, uid, false)
+		if nil != err {
+			return "", fmt.Errorf("failed to look up dataset: %w", err)
+		}
+		if !found {
+			return "", fmt.Errorf("no generated dataset found with UID %s", uid)
+		}
+		info, err := SelectDownload(dataset, selector)
+		if nil != err {
+			return "", err
+		}
+		fmt.Printf("Selected %s (%s)\n", info.Name, info.ID)
+		return info.ID, nil
+	}
+	if "" == downloadID {
+		return "", fmt.Errorf("Either a download ID or selection flags are required")
+	}
+	return downloadID, nil
+}
+
+func checkGeneratedRequest(ctx context.Context, client *Client, uid string, downloadID string, outputFormat string, coordinateSystem string) (string, error) {
+	dataset, found, err := client.FindGeneratedDataset(ctx, uid, false)
+	if nil != err {
+		return "", fmt.Errorf("failed to look up dataset: %w", err)
+	}
+	if !found {
+		return "", fmt.Errorf("no generated dataset found with UID %s", uid)
+	}
+	table, err := client.FormatConversionTable(ctx)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Warning: not checking requested format: %v\n", err)
+	}
+	return ValidateGeneratedRequest(dataset, downloadID, outputFormat, coordinateSystem, table)
+}
+
+func fetchGeneratedData(
+	ctx context.Context,
+	client *Client,
+	spec RequestSpec,
+	extract bool,
+	metadata bool,
+	outputPath string,
+	poll PollOptions,
+	noWait bool,
+) error {
+	task, err := client.RequestGeneratedData(ctx, spec)
+	if nil != err {
+		return err
+	}
+
+	return awaitRequest(ctx, client, spec.UID, task, extract, metadata, outputPath, poll, noWait)
 }
 
 func fetchPrepackagedData(
+	ctx context.Context,
+	client *Client,
 	uid string,
 	downloadID string,
 	extract bool,
-	sessionToken string,
+	metadata bool,
 	outputPath string,
+	poll PollOptions,
+	noWait bool,
 ) error {
-	task, err := RequestPrepackagedData(uid, downloadID, sessionToken, outputPath)
+	task, err := client.RequestPrepackagedData(ctx, uid, downloadID)
 	if nil != err {
 		return err
 	}
 
-	// we only asked for one thing, so if there's an error task, it's game over
-	if len(task.ErrorTaskIDs) > 0 {
-		return fmt.Errorf("only got error for tasks.")
-	}
-	if len(task.TaskIDs) != 1 {
-		return fmt.Errorf("expected one task, got %d", len(task.TaskIDs))
-	}
-	fmt.Printf("Data requested...")
-
-	taskID := task.TaskIDs[0].ID
-	return completeDownload(sessionToken, taskID, extract, outputPath)
+	return awaitRequest(ctx, client, uid, task, extract, metadata, outputPath, poll, noWait)
 }
 
 func directDownload(
+	ctx context.Context,
+	client *Client,
 	uid string,
 	downloadID string,
 	extract bool,
-	sessionToken string,
+	metadata bool,
 	outputPath string,
+	force bool,
+	retryFailed bool,
 ) error {
-
-	directLinks, err := RequestDirectData(uid, downloadID, sessionToken, outputPath)
+	directLinks, err := client.RequestDirectData(ctx, uid, downloadID)
 	if nil != err {
 		return err
 	}
@@ -199,16 +410,89 @@ func directDownload(
 			return fmt.Errorf("failed to create output dir: %w", err)
 		}
 	}
+	outputDir := outputPath
+	if "" == outputDir {
+		outputDir, err = os.Getwd()
+		if nil != err {
+			return fmt.Errorf("failed to look up cwd: %w", err)
+		}
+	}
+
+	record, err := loadDirectRecord(outputDir)
+	if nil != err {
+		return err
+	}
+	if retryFailed && (0 == len(record.Failed)) {
+		return fmt.Errorf("no record of failed downloads in %s", outputDir)
+	}
 
+	failures := 0
 	for _, urlstr := range directLinks {
-		fmt.Printf("Downloading %s...\n", urlstr)
 		url, err := url.Parse(urlstr)
 		if nil != err {
 			return fmt.Errorf("failed to parse url: %w", err)
 		}
-		err = utils.DownloadFile(urlstr, path.Base(url.Path), extract, outputPath)
+		key := directRecordKey(url)
+		filename := path.Base(url.Path)
+		localPath := path.Join(outputDir, filename)
+
+		if retryFailed {
+			if _, ok := record.Failed[key]; !ok {
+				continue
+			}
+		}
+		if !force && client.alreadyDownloaded(ctx, record, url, localPath, extract) {
+			fmt.Printf("Skipping %s, already downloaded.\n", filename)
+			continue
+		}
+
+		fmt.Printf("Downloading %s...\n", urlstr)
+		err = utils.Download{
+			URL:         urlstr,
+			Filename:    filename,
+			Extract:     extract,
+			Destination: outputPath,
+			HTTPClient:  client.HTTPClient,
+		}.Fetch(ctx)
 		if nil != err {
-			return fmt.Errorf("failed to download: %w", err)
+			fmt.Fprintf(os.Stderr, "Failed to download %s: %v\n", filename, err)
+			record.Failed[key] = err.Error()
+			failures += 1
+		} else {
+			var size int64
+			if info, err := os.Stat(localPath); (nil == err) && !extract {
+				size = info.Size()
+			}
+			record.Completed[key] = directFile{
+				Filename:  filename,
+				Size:      size,
+				Completed: time.Now(),
+			}
+			delete(record.Failed, key)
+		}
+
+		// Save as we go so that if we're interrupted we don't lose track
+		err = saveDirectRecord(outputDir, record)
+		if nil != err {
+			return fmt.Errorf("failed to save download record: %w", err)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d downloads failed, rerun with -retry-failed to try just those again", failures)
+	}
+
+	if metadata {
+		dataset, found, err := client.FindGeneratedDataset(ctx, uid, false)
+		if nil != err {
+			return fmt.Errorf("failed to look up dataset for metadata: %w", err)
+		}
+		if !found {
+			return fmt.Errorf("no generated dataset found with UID %s", uid)
+		}
+		err = client.SaveDatasetMetadata(ctx, uid, dataset, dataset.GeonetworkIdentifiers, nil, outputDir)
+		if nil != err {
+			return fmt.Errorf("failed to save metadata: %w", err)
 		}
 	}
 	return nil
@@ -216,226 +500,579 @@ func directDownload(
 
 //----- VERBS
 
-type verb func([]string) error
+type verb func(context.Context, []string) error
 
-func searchVerb(args []string) error {
+func searchVerb(ctx context.Context, args []string) error {
 	flag := flag.NewFlagSet("clms", flag.ExitOnError)
 	var (
 		prepackaged = flag.Bool("prepackaged", false, "Search prepackaged data")
 		UID         = flag.String("uid", "", "UID of resource.")
+		refresh     = flag.Bool("refresh", false, "Ignore the local index cache and fetch from the server.")
+		cacheTTL    = flag.Duration("cache-ttl", DefaultIndexCacheTTL, "How long to use the local index cache before checking for updates.")
+		query       = flag.String("q", "", "Free text search over dataset title and description.")
+		collection  = flag.String("collection", "", "Only show items in this collection (generated data only).")
+		resolution  = flag.String("resolution", "", "Only show items with this resolution, e.g. 100m.")
+		year        = flag.String("year", "", "Only show items for this year.")
+		format      = flag.String("format", "", "Only show items available in this format.")
+		asJSON      = flag.Bool("json", false, "Output results as JSON rather than a table.")
+		emitSpec    = flag.Bool("emit-spec", false, "With -uid, output a request spec for the matching item that can be passed to download -spec.")
 	)
 	flag.Parse(args)
 
-	if (nil == UID) || (nil == prepackaged) {
+	if (nil == UID) || (nil == prepackaged) || (nil == refresh) || (nil == cacheTTL) || (nil == query) ||
+		(nil == collection) || (nil == resolution) || (nil == year) || (nil == format) || (nil == asJSON) || (nil == emitSpec) {
 		// stop the static analyser being upset
 		panic("Flags didn't work")
 	}
 
+	if *prepackaged && ("" != *collection) {
+		return fmt.Errorf("Collection filtering is only supported for generated data.")
+	}
+
+	filter := SearchFilter{
+		Query:      *query,
+		Collection: *collection,
+		Resolution: *resolution,
+		Year:       *year,
+		Format:     *format,
+	}
+
+	client := &Client{Logger: newCLILogger(), IndexCacheTTL: *cacheTTL}
+	if 0 == client.IndexCacheTTL {
+		// to the Client zero means the default, but here it means don't trust the cache
+		client.IndexCacheTTL = -1
+	}
+
+	if *emitSpec {
+		if "" == *UID {
+			return fmt.Errorf("-emit-spec requires a dataset -uid")
+		}
+		return emitRequestSpec(ctx, client, *UID, filter, *prepackaged, *refresh)
+	}
+
 	var err error
 	if "" == *UID {
 		if *prepackaged {
-			err = inspectAllPrepackagedData()
+			err = inspectAllPrepackagedData(ctx, client, filter, *refresh, *asJSON)
 		} else {
-			err = inspectAllGeneratedData()
+			err = inspectAllGeneratedData(ctx, client, filter, *refresh, *asJSON)
 		}
 	} else {
 		if *prepackaged {
-			err = inspectPrepackagedData(*UID)
+			err = inspectPrepackagedData(ctx, client, *UID, filter, *refresh, *asJSON)
 		} else {
-			err = inspectGeneratadData(*UID)
+			err = inspectGeneratadData(ctx, client, *UID, filter, *refresh, *asJSON)
 		}
 	}
 	return err
 }
 
-func downloadVerb(args []string) error {
+func downloadVerb(ctx context.Context, args []string) error {
 	flag := flag.NewFlagSet("clms", flag.ExitOnError)
 	var (
 		prepackaged = flag.Bool("prepackaged", false, "Search prepackaged data")
 		UID         = flag.String("uid", "", "UID of resource.")
 		downloadID  = flag.String("download_id", "", "The ID of the actual item within the resource to fetch.")
-		apiKeyPath  = flag.String("apikeyfile", "", "Path of JSON API key downloaded from CLMS account page.")
+		credentials = addCredentialFlags(flag)
 		extract     = flag.Bool("extract", false, "If item is compressed extract automatically")
 		output      = flag.String("output", "", "Destination name (filename for single item, directory name if multiple).")
 		format      = flag.String("format", "Geotiff", "Requested download format. Defaults to GeoTIFF.")
 		coordSystem = flag.String("cgs", "EPSG:4326", "Global coordinate System to use. Defaults to EPSG:4326.")
+		nuts        = flag.String("nuts", "", "Only request the area of this NUTS region, e.g. ITC11.")
+		bbox        = flag.String("bbox", "", "Only request this area, as west,south,east,north in degrees.")
+		specPath    = flag.String("spec", "", "Make the request described in this spec file, as made by search -emit-spec. Other flags override it.")
+		noWait      = flag.Bool("no-wait", false, "Make the request and exit without waiting for it to complete.")
+		metadata    = flag.Bool("metadata", false, "Also save the dataset's catalogue record and INSPIRE/ISO metadata.")
+		poll        = addPollFlags(flag)
+		selector    = addSelectorFlags(flag)
 	)
 	flag.Parse(args)
 
-	if (nil == UID) || (nil == apiKeyPath) || (nil == output) || (nil == extract) || (nil == downloadID) || (nil == format) || (nil == coordSystem) {
+	if (nil == UID) || (nil == credentials) || (nil == output) || (nil == extract) || (nil == downloadID) || (nil == format) ||
+		(nil == coordSystem) || (nil == nuts) || (nil == bbox) || (nil == specPath) || (nil == noWait) || (nil == poll) ||
+		(nil == metadata) || (nil == selector) {
 		// stop the static analyser being upset
 		panic("Flags didn't work")
 	}
 
-	if "" == *apiKeyPath {
-		return fmt.Errorf("No API key provided, required for downloads.")
-	}
-	apiKey, err := LoadAPIKey(*apiKeyPath)
-	if nil != err {
-		return fmt.Errorf("failed to load api key: %w", err)
-	}
-	sessionToken, err := apiKey.GetSessionToken()
+	client, err := newClient(*credentials)
 	if nil != err {
-		return fmt.Errorf("failed to get session token: %w", err)
+		return err
 	}
 
-	if *prepackaged {
-		if ("Geotiff" != *format) || ("EPSG:4326" != *coordSystem) {
+	set := setFlags(flag)
+	spec := RequestSpec{
+		Version:     requestSpecVersion,
+		UID:         *UID,
+		Prepackaged: *prepackaged,
+		DownloadID:  *downloadID,
+		NUTS:        *nuts,
+	}
+	if "" != *specPath {
+		if !selector.Empty() {
+			return fmt.Errorf("Specify either a spec or selection flags, not both")
+		}
+		spec, err = LoadRequestSpec(*specPath)
+		if nil != err {
+			return err
+		}
+		if set["uid"] {
+			spec.UID = *UID
+		}
+		if set["prepackaged"] {
+			spec.Prepackaged = *prepackaged
+		}
+		if set["download_id"] {
+			spec.DownloadID = *downloadID
+		}
+		if set["nuts"] {
+			spec.NUTS = *nuts
+			spec.BoundingBox = nil
+		}
+		if set["bbox"] {
+			spec.NUTS = ""
+		}
+	}
+	if set["bbox"] {
+		boundingBox, err := ParseBoundingBox(*bbox)
+		if nil != err {
+			return fmt.Errorf("invalid -bbox: %w", err)
+		}
+		spec.BoundingBox = boundingBox
+	}
+	if spec.Prepackaged {
+		if set["format"] || set["cgs"] {
 			return fmt.Errorf("Can not specify format or coordinate system for prepackaged CLMS data.")
 		}
-		err = fetchPrepackagedData(*UID, *downloadID, *extract, sessionToken, *output)
 	} else {
-		err = fetchGeneratedData(*UID, *downloadID, *extract, *format, *coordSystem, sessionToken, *output)
+		if set["format"] || ("" == spec.Format) {
+			spec.Format = *format
+		}
+		if set["cgs"] || ("" == spec.CoordinateSystem) {
+			spec.CoordinateSystem = *coordSystem
+		}
+	}
+	if "" == *specPath {
+		itemID, err := resolveDownloadID(ctx, client, spec.UID, spec.DownloadID, *selector, spec.Prepackaged)
+		if nil != err {
+			return err
+		}
+		spec.DownloadID = itemID
+	}
+	err = spec.Validate()
+	if nil != err {
+		return err
+	}
+
+	if spec.Prepackaged {
+		err = fetchPrepackagedData(ctx, client, spec.UID, spec.DownloadID, *extract, *metadata, *output, *poll, *noWait)
+	} else {
+		var outputFormat string
+		outputFormat, err = checkGeneratedRequest(ctx, client, spec.UID, spec.DownloadID, spec.Format, spec.CoordinateSystem)
+		if nil != err {
+			return err
+		}
+		spec.Format = outputFormat
+		err = fetchGeneratedData(ctx, client, spec, *extract, *metadata, *output, *poll, *noWait)
 	}
 	return err
 }
 
-func requestsVerb(args []string) error {
+func requestsVerb(ctx context.Context, args []string) error {
 	flag := flag.NewFlagSet("clms", flag.ExitOnError)
 	var (
-		apiKeyPath = flag.String("apikeyfile", "", "Path of JSON API key downloaded from CLMS account page.")
+		credentials = addCredentialFlags(flag)
+		statuses    = flag.String("status", "", "Only show requests with these statuses, comma separated, e.g. In_progress,Finished_ok.")
+		dataset     = flag.String("dataset", "", "Only show requests for this dataset ID, or with this in the dataset title.")
+		since       = flag.String("since", "", "Only show requests made since this date (YYYY-MM-DD) or duration ago (e.g. 48h).")
+		sortBy      = flag.String("sort", "registered", "Column to sort by.")
+		reverse     = flag.Bool("reverse", false, "Reverse the sort order.")
+		columns     = flag.String("columns", DefaultRequestColumns, fmt.Sprintf("Comma separated columns to show, from: %s.", strings.Join(RequestColumnNames(), ", ")))
+		asJSON      = flag.Bool("json", false, "Output the matching requests as JSON rather than a table.")
 	)
 	flag.Parse(args)
 
-	if nil == apiKeyPath {
+	if (nil == credentials) || (nil == statuses) || (nil == dataset) || (nil == since) || (nil == sortBy) ||
+		(nil == reverse) || (nil == columns) || (nil == asJSON) {
 		// stop the static analyser being upset
 		panic("Flags didn't work")
 	}
 
-	if "" == *apiKeyPath {
-		return fmt.Errorf("No API key provided, required for downloads.")
+	filter := RequestFilter{
+		Dataset: *dataset,
+	}
+	for _, status := range strings.Split(*statuses, ",") {
+		status = strings.TrimSpace(status)
+		if "" != status {
+			filter.Statuses = append(filter.Statuses, status)
+		}
 	}
-	apiKey, err := LoadAPIKey(*apiKeyPath)
+	sinceTime, err := ParseSince(*since, time.Now())
 	if nil != err {
-		return fmt.Errorf("failed to load api key: %w", err)
+		return fmt.Errorf("invalid -since: %w", err)
 	}
-	sessionToken, err := apiKey.GetSessionToken()
+	filter.Since = sinceTime
+	tableColumns, err := parseRequestColumns(*columns)
 	if nil != err {
-		return fmt.Errorf("failed to get session token: %w", err)
+		return err
+	}
+
+	client, err := newClient(*credentials)
+	if nil != err {
+		return err
 	}
 
-	statuses, err := GetRequests(sessionToken)
+	requests, err := client.Requests(ctx)
 	if nil != err {
 		return fmt.Errorf("failed to get requests: %w", err)
 	}
-	{
-		s, _ := json.Marshal(statuses)
-		fmt.Printf("%v\n", string(s))
+
+	rows := FilterRequests(requests, filter)
+	err = SortRequests(rows, *sortBy, *reverse)
+	if nil != err {
+		return err
 	}
 
-	t := tabby.New()
-	t.AddHeader("Request ID", "Dataset ID", "Status")
+	if *asJSON {
+		return printJSON(rows)
+	}
 
-	for taskID, status := range statuses {
-		for _, dataset := range status.Datasets {
-			t.AddLine(taskID, dataset.DatasetID, status.Status)
+	t := tabby.New()
+	headers := make([]interface{}, len(tableColumns))
+	for idx, column := range tableColumns {
+		headers[idx] = column.header
+	}
+	t.AddHeader(headers...)
+	for _, row := range rows {
+		values := make([]interface{}, len(tableColumns))
+		for idx, column := range tableColumns {
+			values[idx] = column.value(row)
 		}
+		t.AddLine(values...)
 	}
 	t.Print()
 
 	return nil
 }
 
-func resumeVerb(args []string) error {
+func resumeVerb(ctx context.Context, args []string) error {
 	flag := flag.NewFlagSet("clms", flag.ExitOnError)
 	var (
-		apiKeyPath = flag.String("apikeyfile", "", "Path of JSON API key downloaded from CLMS account page.")
-		requestID  = flag.String("request", "", "Request made via API earlier.")
-		extract    = flag.Bool("extract", false, "If item is compressed extract automatically")
-		output     = flag.String("output", "", "Destination name (filename for single item, directory name if multiple).")
+		credentials = addCredentialFlags(flag)
+		requestID   = flag.String("request", "", "Request made via API earlier.")
+		extract     = flag.Bool("extract", false, "If item is compressed extract automatically")
+		output      = flag.String("output", "", "Destination name (filename for single item, directory name if multiple).")
+		poll        = addPollFlags(flag)
+		all         = flag.Bool("all", false, "Download all finished requests not already downloaded, into a directory per dataset.")
+		dataset     = flag.String("dataset", "", "With -all, only download requests for this dataset ID, or with this in the dataset title.")
+		since       = flag.String("since", "", "With -all, only download requests made since this date (YYYY-MM-DD) or duration ago (e.g. 48h).")
+		parallel    = flag.Int("parallel", 4, "With -all, how many requests to download at once.")
+		force       = flag.Bool("force", false, "With -all, download requests even if they have been downloaded before.")
+		metadata    = flag.Bool("metadata", false, "Also save the dataset's catalogue record and INSPIRE/ISO metadata.")
 	)
 	flag.Parse(args)
 
-	if (nil == apiKeyPath) || (nil == requestID) || (nil == extract) || (nil == output) {
+	if (nil == credentials) || (nil == requestID) || (nil == extract) || (nil == output) || (nil == poll) ||
+		(nil == all) || (nil == dataset) || (nil == since) || (nil == parallel) || (nil == force) || (nil == metadata) {
 		// stop the static analyser being upset
 		panic("Flags didn't work")
 	}
 
-	if "" == *requestID {
-		return fmt.Errorf("Request ID required")
+	if ("" == *requestID) == !*all {
+		return fmt.Errorf("Either a request ID or -all is required")
 	}
 
-	if "" == *apiKeyPath {
-		return fmt.Errorf("No API key provided, required for downloads.")
+	client, err := newClient(*credentials)
+	if nil != err {
+		return err
+	}
+
+	if !*all {
+		return completeDownload(ctx, client, *requestID, *extract, *metadata, *output, *poll)
 	}
-	apiKey, err := LoadAPIKey(*apiKeyPath)
+
+	sinceTime, err := ParseSince(*since, time.Now())
 	if nil != err {
-		return fmt.Errorf("failed to load api key: %w", err)
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	filter := RequestFilter{
+		Statuses: []string{TaskFinished},
+		Dataset:  *dataset,
+		Since:    sinceTime,
 	}
-	sessionToken, err := apiKey.GetSessionToken()
+
+	requests, err := client.Requests(ctx)
 	if nil != err {
-		return fmt.Errorf("failed to get session token: %w", err)
+		return fmt.Errorf("failed to get requests: %w", err)
 	}
+	records, err := LoadTaskRecords()
+	if nil != err {
+		return err
+	}
+
+	rows := FilterRequests(requests, filter)
+	err = SortRequests(rows, "registered", false)
+	if nil != err {
+		return err
+	}
+	pending := pendingDownloads(rows, records, *force)
+	if 0 == len(pending) {
+		fmt.Printf("Nothing new to download.\n")
+		return nil
+	}
+	fmt.Printf("Downloading %d requests...\n", len(pending))
 
-	return completeDownload(sessionToken, *requestID, *extract, *output)
+	return downloadAllFinished(ctx, client, pending, *extract, *metadata, *output, *parallel)
 }
 
-func directVerb(args []string) error {
+func directVerb(ctx context.Context, args []string) error {
 	flag := flag.NewFlagSet("clms", flag.ExitOnError)
 	var (
-		apiKeyPath = flag.String("apikeyfile", "", "Path of JSON API key downloaded from CLMS account page.")
-		UID        = flag.String("uid", "", "UID of resource.")
-		downloadID = flag.String("download_id", "", "The ID of the actual item within the resource to fetch.")
-		extract    = flag.Bool("extract", false, "If item is compressed extract automatically")
-		output     = flag.String("output", "", "Destination name (filename for single item, directory name if multiple).")
+		credentials = addCredentialFlags(flag)
+		UID         = flag.String("uid", "", "UID of resource.")
+		downloadID  = flag.String("download_id", "", "The ID of the actual item within the resource to fetch.")
+		extract     = flag.Bool("extract", false, "If item is compressed extract automatically")
+		output      = flag.String("output", "", "Destination name (filename for single item, directory name if multiple).")
+		metadata    = flag.Bool("metadata", false, "Also save the dataset's catalogue record and INSPIRE/ISO metadata.")
+		selector    = addSelectorFlags(flag)
+		force       = flag.Bool("force", false, "Download files even if they have been downloaded before.")
+		retry       = flag.Bool("retry-failed", false, "Only download the files that failed last time.")
 	)
 	flag.Parse(args)
 
-	if (nil == apiKeyPath) || (nil == UID) || (nil == extract) || (nil == output) || (nil == downloadID) {
+	if (nil == credentials) || (nil == UID) || (nil == extract) || (nil == output) || (nil == downloadID) || (nil == metadata) ||
+		(nil == selector) || (nil == force) || (nil == retry) {
 		// stop the static analyser being upset
 		panic("Flags didn't work")
 	}
 
-	if "" == *UID {
-		return fmt.Errorf("Datset ID required")
-	}
-
-	if "" == *apiKeyPath {
-		return fmt.Errorf("No API key provided, required for downloads.")
-	}
-	apiKey, err := LoadAPIKey(*apiKeyPath)
+	client, err := newClient(*credentials)
 	if nil != err {
-		return fmt.Errorf("failed to load api key: %w", err)
+		return err
 	}
-	sessionToken, err := apiKey.GetSessionToken()
+
+	itemID, err := resolveDownloadID(ctx, client, *UID, *downloadID, *selector, false)
 	if nil != err {
-		return fmt.Errorf("failed to get session token: %w", err)
+		return err
 	}
 
-	return directDownload(*UID, *downloadID, *extract, sessionToken, *output)
+	return directDownload(ctx, client, *UID, itemID, *extract, *metadata, *output, *force, *retry)
 }
 
-func CLMSMain(args []string) {
+func confirm(prompt string) (bool, error) {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if (nil != err) && (io.EOF != err) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return ("y" == answer) || ("yes" == answer), nil
+}
+
+func cancelVerb(ctx context.Context, args []string) error {
+	flag := flag.NewFlagSet("clms", flag.ExitOnError)
+	var (
+		credentials   = addCredentialFlags(flag)
+		requestID     = flag.String("request", "", "Request made via API earlier.")
+		allInProgress = flag.Bool("all-in-progress", false, "Cancel all requests that are still queued or in progress.")
+		yes           = flag.Bool("yes", false, "Do not ask for confirmation.")
+	)
+	flag.Parse(args)
+
+	if (nil == credentials) || (nil == requestID) || (nil == allInProgress) || (nil == yes) {
+		// stop the static analyser being upset
+		panic("Flags didn't work")
+	}
 
-	var subcommands = map[string]verb{
-		"search":   searchVerb,
-		"download": downloadVerb,
-		"requests": requestsVerb,
-		"resume":   resumeVerb,
-		"direct":   directVerb,
+	if ("" == *requestID) == !*allInProgress {
+		return fmt.Errorf("Either a request ID or -all-in-progress is required")
 	}
 
-	if len(args) == 0 {
-		fmt.Printf("Supported verbs are:\n")
-		for cmd := range subcommands {
-			fmt.Fprintf(os.Stderr, "\t%s\n", cmd)
+	client, err := newClient(*credentials)
+	if nil != err {
+		return err
+	}
+
+	taskIDs := []string{*requestID}
+	if *allInProgress {
+		statuses, err := client.Requests(ctx)
+		if nil != err {
+			return fmt.Errorf("failed to get requests: %w", err)
+		}
+		taskIDs = make([]string, 0)
+		for taskID, status := range statuses {
+			if TaskPending(status.Status) {
+				taskIDs = append(taskIDs, taskID)
+			}
+		}
+		if 0 == len(taskIDs) {
+			fmt.Printf("No requests in progress.\n")
+			return nil
 		}
-		return
 	}
 
-	cmd, args := args[0], args[1:]
+	if !*yes {
+		for _, taskID := range taskIDs {
+			fmt.Printf("\t%s\n", taskID)
+		}
+		ok, err := confirm(fmt.Sprintf("Cancel %d request(s)?", len(taskIDs)))
+		if nil != err {
+			return fmt.Errorf("failed to read confirmation: %w", err)
+		}
+		if !ok {
+			fmt.Printf("Nothing cancelled.\n")
+			return nil
+		}
+	}
 
-	if subcmd, ok := subcommands[cmd]; ok {
-		err := subcmd(args)
+	for _, taskID := range taskIDs {
+		err = client.CancelRequest(ctx, taskID)
 		if nil != err {
-			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("failed to cancel %s: %w", taskID, err)
 		}
+		fmt.Printf("%s: %s\n", taskID, TaskCancelled)
+	}
+
+	return nil
+}
+
+func checkKeyVerb(ctx context.Context, args []string) error {
+	flag := flag.NewFlagSet("clms", flag.ExitOnError)
+	var (
+		credentials = addCredentialFlags(flag)
+		offline     = flag.Bool("offline", false, "Only check the key locally, don't try to get a session token.")
+	)
+	flag.Parse(args)
+
+	if (nil == credentials) || (nil == offline) {
+		// stop the static analyser being upset
+		panic("Flags didn't work")
+	}
+
+	apiKey, source, err := LoadCredentials(*credentials)
+	if nil != err {
+		return err
+	}
+
+	fmt.Printf("source: %s\n", source)
+	fmt.Printf("title: %s\n", apiKey.Title)
+	fmt.Printf("client ID: %s\n", apiKey.ClientID)
+	fmt.Printf("key ID: %s\n", apiKey.KeyID)
+	fmt.Printf("issued: %s\n", apiKey.Issued)
+
+	warnings, err := apiKey.Validate()
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	if nil != err {
+		return fmt.Errorf("key is not valid:\n%w", err)
+	}
+	fmt.Printf("Key is well formed.\n")
+
+	if *offline {
+		return nil
+	}
+
+	token, err := NewSessionTokenSource(apiKey).Refresh(ctx)
+	if nil != err {
+		return fmt.Errorf("failed to get session token: %w", err)
+	}
+	fmt.Printf("Obtained session token, valid until %s.\n", token.Expires.Format(time.RFC3339))
+
+	return nil
+}
+
+func tokenVerb(ctx context.Context, args []string) error {
+	flag := flag.NewFlagSet("clms", flag.ExitOnError)
+	var (
+		credentials = addCredentialFlags(flag)
+		refresh     = flag.Bool("refresh", false, "Ignore any cached token and request a new one.")
+		show        = flag.Bool("show", false, "Print the session token itself.")
+	)
+	flag.Parse(args)
+
+	if (nil == credentials) || (nil == refresh) || (nil == show) {
+		// stop the static analyser being upset
+		panic("Flags didn't work")
+	}
+
+	session, err := newSession(*credentials)
+	if nil != err {
+		return err
+	}
+
+	var token CLMSSessionToken
+	if *refresh {
+		token, err = session.Refresh(ctx)
 	} else {
-		fmt.Fprintf(os.Stderr, "Unrecognised verb. Options are:\n")
-		for cmd := range subcommands {
-			fmt.Fprintf(os.Stderr, "\t%s\n", cmd)
-		}
+		token, err = session.Session(ctx)
+	}
+	if nil != err {
+		return fmt.Errorf("failed to get session token: %w", err)
+	}
+
+	source := "token endpoint"
+	if session.FromCache {
+		source = "cache"
+	}
+	cachePath, err := session.CachePath()
+	if nil != err {
+		cachePath = fmt.Sprintf("unavailable (%v)", err)
+	}
+
+	fmt.Printf("client ID: %s\n", token.ClientID)
+	fmt.Printf("key ID: %s\n", token.KeyID)
+	fmt.Printf("token URI: %s\n", token.TokenURI)
+	fmt.Printf("source: %s\n", source)
+	fmt.Printf("cache: %s\n", cachePath)
+	fmt.Printf("expires: %s (in %v)\n", token.Expires.Format(time.RFC3339), time.Until(token.Expires).Round(time.Second))
+	if *show {
+		fmt.Printf("token: %s\n", token.AccessToken)
+	}
+
+	return nil
+}
+
+// fetchVerb gets CLMS items the way other sources get files, so several
+// can be picked by name and are requested and downloaded in parallel.
+// Each item is requested in its first format, so download is still the
+// verb for anything more particular.
+func fetchVerb(ctx context.Context, args []string) error {
+	return provider.Run(ctx, &Provider{}, args)
+}
+
+var verbs = map[string]verb{
+	"search":    searchVerb,
+	"download":  downloadVerb,
+	"fetch":     fetchVerb,
+	"requests":  requestsVerb,
+	"resume":    resumeVerb,
+	"direct":    directVerb,
+	"token":     tokenVerb,
+	"cancel":    cancelVerb,
+	"check-key": checkKeyVerb,
+}
+
+func verbNames() string {
+	names := make([]string, 0, len(verbs))
+	for name := range verbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// CLMSMain runs the clms subcommand.
+//
+// Deprecated: reclaimer now finds the subcommand through the provider
+// registry, and this is kept for anything still calling it directly.
+func CLMSMain(args []string) {
+	// Let an interrupt stop a long wait cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := (&Provider{}).Command(ctx, args)
+	stop()
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,475 @@
+package clms
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/clms/clmstest"
+)
+
+// newTestServer starts a fake CLMS, points the package at it, and provides
+// an API key for it via the environment, with caches kept out of the way.
+func newTestServer(t *testing.T) *clmstest.Server {
+	server := clmstest.NewServer()
+	t.Cleanup(server.Close)
+
+	savedBaseURL, savedTokenURI := BaseURL, TokenURI
+	BaseURL = server.BaseURL()
+	TokenURI = ""
+	t.Cleanup(func() {
+		BaseURL = savedBaseURL
+		TokenURI = savedTokenURI
+	})
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	isolateCredentials(t)
+
+	key := testRSAKey(t)
+	apiKey, err := json.Marshal(CLMSAuthenticationDetails{
+		ClientID:   "test-client",
+		Issued:     "2024-01-01T00:00:00",
+		KeyID:      "test-key",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		Title:      "test",
+		TokenURI:   server.TokenURI(),
+		UserID:     "test-user",
+	})
+	if nil != err {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	t.Setenv(APIKeyEnv, string(apiKey))
+
+	server.AddDataset(clmstest.Dataset{
+		UID:               "uid-corine",
+		Title:             "CORINE Land Cover 2018",
+		CoordinateSystems: []string{"EPSG:3035", "EPSG:4326"},
+		Downloads: []clmstest.DownloadInfo{
+			{ID: "dl-raster", Name: "CLC 2018 raster 100m", Collection: "raster", FullFormat: "GeoTIFF"},
+			{ID: "dl-tiles", Name: "CLC 2018 tiles", Collection: "tiles", FullFormat: "GeoTIFF"},
+		},
+		DirectFiles: map[string][]string{
+			"dl-tiles": {"tile-a.tif", "tile-b.tif"},
+		},
+	})
+	server.AddDataset(clmstest.Dataset{
+		UID:   "uid-imperviousness",
+		Title: "Imperviousness Density 2018",
+		Files: []clmstest.File{
+			{ID: "file-eu", File: "IMD_2018_100m_eu.zip", Area: "Europe", Year: "2018", Resolution: "100 m"},
+		},
+	})
+	server.AddDataset(clmstest.Dataset{
+		UID:   "uid-grassland",
+		Title: "Grassland 2018",
+	})
+	return server
+}
+
+// runVerb runs a CLI verb and returns what it printed.
+func runVerb(t *testing.T, verb verb, args ...string) (string, error) {
+	reader, writer, err := os.Pipe()
+	if nil != err {
+		t.Fatalf("Failed to make pipe: %v", err)
+	}
+	saved := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = saved }()
+
+	output := make(chan string)
+	go func() {
+		contents, _ := io.ReadAll(reader)
+		output <- string(contents)
+	}()
+
+	err = verb(context.Background(), args)
+	writer.Close()
+	return <-output, err
+}
+
+func TestSearchVerbPagesThroughIndex(t *testing.T) {
+	newTestServer(t)
+
+	output, err := runVerb(t, searchVerb, "-json")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var datasets []CLMSDataset
+	err = json.Unmarshal([]byte(output), &datasets)
+	if nil != err {
+		t.Fatalf("Failed to parse output %q: %v", output, err)
+	}
+	if 3 != len(datasets) {
+		t.Errorf("Expected all three datasets across pages, got %d", len(datasets))
+	}
+
+	output, err = runVerb(t, searchVerb, "-uid", "uid-corine")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "dl-raster") || !strings.Contains(output, "EPSG:3035") {
+		t.Errorf("Expected dataset details, got %q", output)
+	}
+
+	_, err = runVerb(t, searchVerb, "-uid", "uid-missing")
+	if nil == err {
+		t.Errorf("Expected error for unknown dataset")
+	}
+}
+
+func TestDownloadVerbWaitsForRequest(t *testing.T) {
+	server := newTestServer(t)
+	server.PollsUntilFinished = 2
+	outputDir := t.TempDir()
+
+	_, err := runVerb(t, downloadVerb, "-uid", "uid-corine", "-name", "*raster*", "-format", "geotiff",
+		"-extract", "-output", outputDir, "-poll", "1ms")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	contents, err := os.ReadFile(path.Join(outputDir, "task0001.txt"))
+	if (nil != err) || ("data for task0001" != string(contents)) {
+		t.Errorf("Expected extracted download, got %q: %v", contents, err)
+	}
+	task, _ := server.Task("task0001")
+	if (1 != len(task.Datasets)) || ("GeoTIFF" != task.Datasets[0].OutputFormat) {
+		t.Errorf("Expected request for canonical format, got %v", task.Datasets)
+	}
+
+	records, err := LoadTaskRecords()
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if record := records["task0001"]; ("uid-corine" != record.DatasetID) || record.Downloaded.IsZero() {
+		t.Errorf("Expected download to be recorded, got %v", record)
+	}
+
+	_, err = runVerb(t, downloadVerb, "-uid", "uid-corine", "-download_id", "dl-raster", "-format", "shapefile")
+	if (nil == err) || !strings.Contains(err.Error(), "format") {
+		t.Errorf("Expected bad format to be rejected, got %v", err)
+	}
+}
+
+func TestDownloadVerbNoWaitThenResume(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+
+	_, err := runVerb(t, downloadVerb, "-prepackaged", "-uid", "uid-imperviousness", "-area", "europe", "-no-wait")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	task, ok := server.Task("task0001")
+	if !ok || ("In_progress" != task.Status) {
+		t.Fatalf("Expected request to be in progress, got %v", task)
+	}
+
+	_, err = runVerb(t, resumeVerb, "-request", "task0001", "-output", outputDir, "-poll", "1ms")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = os.Stat(path.Join(outputDir, "task0001.zip"))
+	if nil != err {
+		t.Errorf("Expected download: %v", err)
+	}
+}
+
+func TestResumeVerbAll(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+
+	server.AddTask(clmstest.Task{Status: "Finished_ok", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-corine", DatasetTitle: "CORINE Land Cover 2018"}}})
+	server.AddTask(clmstest.Task{Status: "Finished_ok", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-grassland", DatasetTitle: "Grassland 2018"}}})
+	server.AddTask(clmstest.Task{Status: "In_progress", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-grassland", DatasetTitle: "Grassland 2018"}}})
+
+	_, err := runVerb(t, resumeVerb, "-all", "-output", outputDir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, expected := range []string{"CORINE_Land_Cover_2018/task0001.zip", "Grassland_2018/task0002.zip"} {
+		_, err = os.Stat(path.Join(outputDir, expected))
+		if nil != err {
+			t.Errorf("Expected %s: %v", expected, err)
+		}
+	}
+
+	output, err := runVerb(t, resumeVerb, "-all", "-output", outputDir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Nothing new") {
+		t.Errorf("Expected nothing to download second time, got %q", output)
+	}
+}
+
+func TestFetchVerb(t *testing.T) {
+	server := newTestServer(t)
+	output := t.TempDir()
+
+	_, err := runVerb(t, fetchVerb, "-all", "-parallel", "2", "-extract", "-output", output, "-poll-interval", "1ms", "uid-corine")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	records, err := LoadTaskRecords()
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, taskID := range []string{"task0001", "task0002"} {
+		if task, _ := server.Task(taskID); TaskFinished != task.Status {
+			t.Errorf("Expected %s to have been requested and finished, got %q", taskID, task.Status)
+		}
+		if _, ok := records[taskID]; !ok {
+			t.Errorf("Expected %s to be recorded so it can be resumed", taskID)
+		}
+		if _, err := os.Stat(path.Join(output, taskID+".txt")); nil != err {
+			t.Errorf("Expected extracted file: %v", err)
+		}
+	}
+}
+
+func TestRequestsVerb(t *testing.T) {
+	server := newTestServer(t)
+	server.AddTask(clmstest.Task{Status: "Finished_ok", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-corine", DatasetTitle: "CORINE Land Cover 2018"}}})
+	server.AddTask(clmstest.Task{Status: "In_progress", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-grassland", DatasetTitle: "Grassland 2018"}}})
+
+	server.AddTask(clmstest.Task{Status: "In_progress", RegistrationDateTime: "2024-01-01T00:00:00", Datasets: []clmstest.TaskDataset{{DatasetID: "uid-corine", DatasetTitle: "CORINE Land Cover 2018"}}})
+
+	// The JSON is in the same order as the table would be
+	for _, reverse := range []bool{false, true} {
+		args := []string{"-status", "In_progress", "-json"}
+		expected := "[task0003 task0002]"
+		if reverse {
+			args = append(args, "-reverse")
+			expected = "[task0002 task0003]"
+		}
+		output, err := runVerb(t, requestsVerb, args...)
+		if nil != err {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var requests []RequestRow
+		err = json.Unmarshal([]byte(output), &requests)
+		if nil != err {
+			t.Fatalf("Failed to parse output %q: %v", output, err)
+		}
+		taskIDs := make([]string, len(requests))
+		for idx, request := range requests {
+			taskIDs[idx] = request.TaskID
+		}
+		if expected != fmt.Sprint(taskIDs) {
+			t.Errorf("Expected in progress requests %s, got %v", expected, taskIDs)
+		}
+	}
+
+	output, err := runVerb(t, requestsVerb, "-columns", "id,title")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "task0001") || !strings.Contains(output, "Grassland 2018") {
+		t.Errorf("Expected table of requests, got %q", output)
+	}
+}
+
+func TestCancelVerb(t *testing.T) {
+	server := newTestServer(t)
+	server.AddTask(clmstest.Task{Status: "Finished_ok"})
+	server.AddTask(clmstest.Task{Status: "In_progress"})
+	server.AddTask(clmstest.Task{Status: "Queued"})
+
+	_, err := runVerb(t, cancelVerb, "-all-in-progress", "-yes")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for taskID, expected := range map[string]string{"task0001": TaskFinished, "task0002": TaskCancelled, "task0003": TaskCancelled} {
+		task, _ := server.Task(taskID)
+		if expected != task.Status {
+			t.Errorf("Expected %s to be %s, got %s", taskID, expected, task.Status)
+		}
+	}
+}
+
+// withStdin feeds input to anything reading os.Stdin, such as confirm.
+func withStdin(t *testing.T, input string) {
+	stdinPath := path.Join(t.TempDir(), "stdin")
+	err := os.WriteFile(stdinPath, []byte(input), 0o600)
+	if nil != err {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+	stdin, err := os.Open(stdinPath)
+	if nil != err {
+		t.Fatalf("Failed to open input: %v", err)
+	}
+	saved := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = saved
+		stdin.Close()
+	})
+}
+
+func TestCancelVerbConfirmation(t *testing.T) {
+	server := newTestServer(t)
+	server.AddTask(clmstest.Task{Status: "In_progress"})
+	server.AddTask(clmstest.Task{Status: "Queued"})
+
+	withStdin(t, "n\n")
+	output, err := runVerb(t, cancelVerb, "-all-in-progress")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "task0001") || !strings.Contains(output, "task0002") || !strings.Contains(output, "Cancel 2 request(s)? [y/N]") {
+		t.Errorf("Expected to be asked about both requests, got %q", output)
+	}
+	if !strings.Contains(output, "Nothing cancelled") {
+		t.Errorf("Expected nothing to be cancelled, got %q", output)
+	}
+	for _, taskID := range []string{"task0001", "task0002"} {
+		if task, _ := server.Task(taskID); TaskCancelled == task.Status {
+			t.Errorf("Expected %s to be left alone", taskID)
+		}
+	}
+
+	withStdin(t, "yes\n")
+	output, err = runVerb(t, cancelVerb, "-request", "task0001")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Cancel 1 request(s)?") || !strings.Contains(output, "task0001: "+TaskCancelled) {
+		t.Errorf("Expected task0001 to be cancelled once confirmed, got %q", output)
+	}
+	if task, _ := server.Task("task0001"); TaskCancelled != task.Status {
+		t.Errorf("Expected task0001 to be cancelled, got %s", task.Status)
+	}
+	if task, _ := server.Task("task0002"); "Queued" != task.Status {
+		t.Errorf("Expected task0002 to be left alone, got %s", task.Status)
+	}
+
+	_, err = runVerb(t, cancelVerb, "-request", "task9999", "-yes")
+	if (nil == err) || !strings.Contains(err.Error(), "task9999") {
+		t.Errorf("Expected error cancelling unknown request, got %v", err)
+	}
+}
+
+func TestDirectVerbSkipsCompleted(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+
+	_, err := runVerb(t, directVerb, "-uid", "uid-corine", "-download_id", "dl-tiles", "-output", outputDir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, name := range []string{"tile-a.tif", "tile-b.tif"} {
+		contents, err := os.ReadFile(path.Join(outputDir, name))
+		if (nil != err) || ("direct download "+name != string(contents)) {
+			t.Errorf("Expected %s to be downloaded, got %q: %v", name, contents, err)
+		}
+	}
+
+	output, err := runVerb(t, directVerb, "-uid", "uid-corine", "-download_id", "dl-tiles", "-output", outputDir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if 2 != strings.Count(output, "Skipping") {
+		t.Errorf("Expected both files to be skipped, got %q", output)
+	}
+	if 1 != server.TokenRequests() {
+		t.Errorf("Expected session token to be reused, got %d token requests", server.TokenRequests())
+	}
+}
+
+func TestTokenAndCheckKeyVerbs(t *testing.T) {
+	server := newTestServer(t)
+
+	output, err := runVerb(t, checkKeyVerb)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Obtained session token") {
+		t.Errorf("Expected token to be obtained, got %q", output)
+	}
+
+	output, err = runVerb(t, tokenVerb, "-show")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, clmstest.AccessToken) {
+		t.Errorf("Expected token to be shown, got %q", output)
+	}
+	if 1 != server.TokenRequests() {
+		t.Errorf("Expected cached token to be used, got %d token requests", server.TokenRequests())
+	}
+
+	t.Setenv(APIKeyEnv, `{"client_id": "broken", "token_uri": "`+server.TokenURI()+`"}`)
+	_, err = runVerb(t, checkKeyVerb)
+	if nil == err {
+		t.Errorf("Expected broken key to fail")
+	}
+}
+
+func TestDownloadVerbFromSpec(t *testing.T) {
+	server := newTestServer(t)
+	specPath := path.Join(t.TempDir(), "spec.json")
+
+	output, err := runVerb(t, searchVerb, "-uid", "uid-corine", "-collection", "raster", "-emit-spec")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = os.WriteFile(specPath, []byte(output), 0o644)
+	if nil != err {
+		t.Fatalf("Failed to write spec: %v", err)
+	}
+	spec, err := LoadRequestSpec(specPath)
+	if (nil != err) || ("dl-raster" != spec.DownloadID) || ("GeoTIFF" != spec.Format) {
+		t.Fatalf("Expected spec for raster item, got %v: %v", spec, err)
+	}
+
+	_, err = runVerb(t, downloadVerb, "-spec", specPath, "-cgs", "EPSG:3035", "-bbox", "10,40,12,42", "-no-wait")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	task, _ := server.Task("task0001")
+	if 1 != len(task.Datasets) {
+		t.Fatalf("Expected one dataset in request, got %v", task)
+	}
+	requested := task.Datasets[0]
+	if ("uid-corine" != requested.DatasetID) || ("EPSG:3035" != requested.OutputGCS) || ("GeoTIFF" != requested.OutputFormat) {
+		t.Errorf("Expected request made from spec with overridden CRS, got %v", requested)
+	}
+	expectedBox := []float64{10, 42, 12, 40}
+	if 4 != len(requested.BoundingBox) {
+		t.Fatalf("Expected bounding box, got %v", requested.BoundingBox)
+	}
+	for idx, value := range expectedBox {
+		if requested.BoundingBox[idx] != value {
+			t.Errorf("Expected CLMS ordered bounding box %v, got %v", expectedBox, requested.BoundingBox)
+			break
+		}
+	}
+
+	_, err = runVerb(t, downloadVerb, "-spec", specPath, "-nuts", "ITC11", "-no-wait")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	task, _ = server.Task("task0002")
+	if (1 != len(task.Datasets)) || ("ITC11" != task.Datasets[0].NUTSID) || (0 != len(task.Datasets[0].BoundingBox)) {
+		t.Errorf("Expected NUTS request, got %v", task.Datasets)
+	}
+
+	output, err = runVerb(t, searchVerb, "-uid", "uid-corine", "-emit-spec")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = os.WriteFile(specPath, []byte(output), 0o644)
+	if nil != err {
+		t.Fatalf("Failed to write spec: %v", err)
+	}
+	_, err = runVerb(t, downloadVerb, "-spec", specPath, "-no-wait")
+	if (nil == err) || !strings.Contains(err.Error(), "dl-tiles") {
+		t.Errorf("Expected ambiguous spec to list options, got %v", err)
+	}
+}
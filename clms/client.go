@@ -0,0 +1,439 @@
+package clms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"quantify.earth/reclaimer/internal/utils"
+)
+
+// Client talks to the CLMS API on behalf of one user. It is what the CLI is
+// built on, but it never prints anything itself: results are returned, and
+// warnings go to Logger, so it can be embedded in other programs. All the
+// fields are optional, and a zero Client can search the catalogue.
+type Client struct {
+	// The root of the API, defaulting to the package's BaseURL.
+	BaseURL string
+	// Where session tokens are requested, overriding the token source's.
+	TokenURI string
+	// Used for all requests, including getting session tokens and
+	// downloading results. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Where session tokens come from. Only searching works without this.
+	Tokens *SessionTokenSource
+	// Defaults to discarding everything.
+	Logger *slog.Logger
+	// How long to use the local index cache before checking with the
+	// server, defaulting to DefaultIndexCacheTTL. If negative, always check.
+	IndexCacheTTL time.Duration
+
+	// For the older functions that are handed a session token directly.
+	accessToken string
+}
+
+func NewClient(details CLMSAuthenticationDetails) *Client {
+	return &Client{
+		Tokens: NewSessionTokenSource(details),
+	}
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func (c *Client) logger() *slog.Logger {
+	if nil == c.Logger {
+		return discardLogger
+	}
+	return c.Logger
+}
+
+func (c *Client) httpClient() *http.Client {
+	if nil == c.HTTPClient {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) indexCacheTTL() time.Duration {
+	if 0 == c.IndexCacheTTL {
+		return DefaultIndexCacheTTL
+	}
+	return c.IndexCacheTTL
+}
+
+func (c *Client) endpoint(path string) string {
+	base := c.BaseURL
+	if "" == base {
+		base = BaseURL
+	}
+	return base + path
+}
+
+func (c *Client) token(ctx context.Context) (string, error) {
+	if "" != c.accessToken {
+		return c.accessToken, nil
+	}
+	if nil == c.Tokens {
+		return "", fmt.Errorf("no API key provided, required for this request")
+	}
+	client := c.HTTPClient
+	if nil == client {
+		client = c.Tokens.HTTPClient
+	}
+	tokenURI := c.TokenURI
+	if "" == tokenURI {
+		tokenURI = c.Tokens.TokenURI
+	}
+	token, err := c.Tokens.session(ctx, client, tokenURI)
+	if nil != err {
+		return "", fmt.Errorf("failed to get session token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// A request to the API, which is sent as JSON if there's a body, and whose
+// response is decoded into result if one is given.
+type apiCall struct {
+	method     string
+	url        string
+	authorised bool
+	headers    map[string]string
+	body       interface{}
+	expected   []int
+	result     interface{}
+}
+
+func (c *Client) call(ctx context.Context, call apiCall) (*http.Response, error) {
+	var body io.Reader
+	if nil != call.body {
+		encoded, err := json.Marshal(call.body)
+		if nil != err {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		c.logger().Debug("request body", "url", call.url, "body", string(encoded))
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, call.method, call.url, body)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Reclaimer/0.1")
+	req.Header.Set("Accept", "application/json")
+	if nil != call.body {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if call.authorised {
+		token, err := c.token(ctx)
+		if nil != err {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	for key, value := range call.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if nil != err {
+		return nil, fmt.Errorf("failed request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	expected := call.expected
+	if 0 == len(expected) {
+		expected = []int{http.StatusOK}
+	}
+	ok := false
+	for _, status := range expected {
+		ok = ok || (status == resp.StatusCode)
+	}
+	if !ok {
+		r, err := io.ReadAll(resp.Body)
+		body := resp.Status
+		if nil == err {
+			body = string(r)
+		}
+		return resp, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, body)
+	}
+
+	if nil != call.result {
+		err = json.NewDecoder(resp.Body).Decode(call.result)
+		if nil != err {
+			return resp, fmt.Errorf("failed to decode response for %s: %w", call.url, err)
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) fetchIndexBatch(ctx context.Context, url string, batch interface{}) (indexValidators, error) {
+	resp, err := c.call(ctx, apiCall{method: http.MethodGet, url: url, result: batch})
+	if nil != err {
+		return indexValidators{}, err
+	}
+	return validatorsFromHeader(resp.Header), nil
+}
+
+// Both halves of the index are paged the same way, differing only in what
+// they contain.
+func fetchIndex[T any, B any](
+	ctx context.Context,
+	c *Client,
+	firstURL string,
+	batchOf func(B) ([]T, CLMSSearchBatch),
+) ([]T, indexValidators, error) {
+	items := make([]T, 0)
+
+	var validators indexValidators
+	url := firstURL
+	for {
+		var batch B
+		batchValidators, err := c.fetchIndexBatch(ctx, url, &batch)
+		if nil != err {
+			return nil, indexValidators{}, err
+		}
+		if 0 == len(items) {
+			validators = batchValidators
+		}
+		batchItems, batching := batchOf(batch)
+		if len(batchItems) == 0 {
+			break
+		}
+
+		items = append(items, batchItems...)
+		if batching.Last == url {
+			break
+		}
+		if batching.Next == url {
+			break
+		}
+		url = batching.Next
+		if "" == url {
+			return nil, indexValidators{}, fmt.Errorf("got invald response: no next URL")
+		}
+	}
+	return items, validators, nil
+}
+
+func (c *Client) generatedIndexURL() string {
+	return c.endpoint(fmt.Sprintf(searchPathTemplate, "", 0))
+}
+
+func (c *Client) prepackagedIndexURL() string {
+	return c.endpoint(fmt.Sprintf(preparedSearchPathTemplate, "", 0))
+}
+
+func (c *Client) fetchIndexGeneratedData(ctx context.Context) ([]CLMSDataset, indexValidators, error) {
+	return fetchIndex(ctx, c, c.generatedIndexURL(), func(batch CLMSSearch) ([]CLMSDataset, CLMSSearchBatch) {
+		return batch.Items, batch.Batch
+	})
+}
+
+func (c *Client) fetchIndexPrepackagedData(ctx context.Context) ([]CLMSPrepackagedDataset, indexValidators, error) {
+	return fetchIndex(ctx, c, c.prepackagedIndexURL(), func(batch CLMSSearchPrepared) ([]CLMSPrepackagedDataset, CLMSSearchBatch) {
+		return batch.Items, batch.Batch
+	})
+}
+
+// FetchIndexGeneratedData pages through the entire index of generated
+// datasets on the server. LoadIndexGeneratedData will use a local cache.
+func (c *Client) FetchIndexGeneratedData(ctx context.Context) ([]CLMSDataset, error) {
+	items, _, err := c.fetchIndexGeneratedData(ctx)
+	return items, err
+}
+
+// FetchIndexPrepackagedData pages through the entire index of prepackaged
+// datasets on the server. LoadIndexPrepackagedData will use a local cache.
+func (c *Client) FetchIndexPrepackagedData(ctx context.Context) ([]CLMSPrepackagedDataset, error) {
+	items, _, err := c.fetchIndexPrepackagedData(ctx)
+	return items, err
+}
+
+func (c *Client) FormatConversionTable(ctx context.Context) (CLMSFormatConversionTable, error) {
+	var table CLMSFormatConversionTable
+	_, err := c.fetchIndexBatch(ctx, c.endpoint("@format_conversion_table"), &table)
+	if nil != err {
+		return nil, fmt.Errorf("failed to fetch format conversion table: %w", err)
+	}
+	return table, nil
+}
+
+func (c *Client) requestData(ctx context.Context, payload interface{}) (CLMSTaskResponse, error) {
+	var taskResp CLMSTaskResponse
+	_, err := c.call(ctx, apiCall{
+		method:     http.MethodPost,
+		url:        c.endpoint("@datarequest_post"),
+		authorised: true,
+		body:       payload,
+		expected:   []int{http.StatusCreated},
+		result:     &taskResp,
+	})
+	if nil != err {
+		return CLMSTaskResponse{}, err
+	}
+	return taskResp, nil
+}
+
+// RequestGeneratedData asks CLMS to prepare the item described by the
+// spec, which must already have been checked with ValidateGeneratedRequest.
+func (c *Client) RequestGeneratedData(ctx context.Context, spec RequestSpec) (CLMSTaskResponse, error) {
+	request := CLMSDatumRequest{
+		DatasetID:                    spec.UID,
+		DatasetDownloadInformationID: spec.DownloadID,
+		OutputFormat:                 spec.Format,
+		OutputGCS:                    spec.CoordinateSystem,
+		NUTS:                         spec.NUTS,
+	}
+	// We take bounding boxes as west, south, east, north
+	if 4 == len(spec.BoundingBox) {
+		request.BoundingBox = []float64{spec.BoundingBox[0], spec.BoundingBox[3], spec.BoundingBox[2], spec.BoundingBox[1]}
+	}
+	return c.requestData(ctx, CLMSDataRequest{
+		Datasets: []CLMSDatumRequest{request},
+	})
+}
+
+func (c *Client) RequestPrepackagedData(ctx context.Context, uid string, fileID string) (CLMSTaskResponse, error) {
+	return c.requestData(ctx, CLMSPrepackagedDataRequest{
+		Datasets: []CLMSPreparedDatumRequest{{
+			DatasetID: uid,
+			FileID:    fileID,
+		}},
+	})
+}
+
+// RequestDirectData gets the URLs of the files that make up an item that
+// can be downloaded directly without making a request.
+func (c *Client) RequestDirectData(ctx context.Context, uid string, downloadID string) ([]string, error) {
+	var downloadURLs []string
+	_, err := c.call(ctx, apiCall{
+		method:     http.MethodGet,
+		url:        c.endpoint(fmt.Sprintf("@get-download-file-urls?dataset_uid=%s&download_information_id=%s", url.QueryEscape(uid), url.QueryEscape(downloadID))),
+		authorised: true,
+		result:     &downloadURLs,
+	})
+	if nil != err {
+		return nil, err
+	}
+	return downloadURLs, nil
+}
+
+func (c *Client) TaskStatus(ctx context.Context, taskID string) (CLMSTaskStatus, error) {
+	var status CLMSTaskStatus
+	_, err := c.call(ctx, apiCall{
+		method:     http.MethodGet,
+		url:        c.endpoint(fmt.Sprintf("@datarequest_status_get?TaskID=%s", url.QueryEscape(taskID))),
+		authorised: true,
+		result:     &status,
+	})
+	if nil != err {
+		return CLMSTaskStatus{}, err
+	}
+	return status, nil
+}
+
+// Requests returns all the user's data requests, keyed by task ID.
+func (c *Client) Requests(ctx context.Context) (map[string]CLMSTaskStatus, error) {
+	var requests map[string]CLMSTaskStatus
+	_, err := c.call(ctx, apiCall{
+		method:     http.MethodGet,
+		url:        c.endpoint("@datarequest_search"),
+		authorised: true,
+		result:     &requests,
+	})
+	if nil != err {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (c *Client) CancelRequest(ctx context.Context, taskID string) error {
+	_, err := c.call(ctx, apiCall{
+		method:     http.MethodDelete,
+		url:        c.endpoint("@datarequest_delete"),
+		authorised: true,
+		body:       CLMSCancelRequest{TaskID: taskID},
+		expected:   []int{http.StatusOK, http.StatusNoContent},
+	})
+	return err
+}
+
+// DownloadTask saves the results of a finished request to output, which is
+// taken as a directory if it is one or if extracting gives several files.
+// With extract, the zip file the results come in is unpacked.
+func (c *Client) DownloadTask(ctx context.Context, status CLMSTaskStatus, extract bool, output string) error {
+	if "" == status.DownloadURL {
+		return fmt.Errorf("got an empty download URL for task")
+	}
+	downloadURL, err := url.Parse(status.DownloadURL)
+	if nil != err {
+		return fmt.Errorf("failed to parse download url: %w", err)
+	}
+	return utils.Download{
+		URL:         status.DownloadURL,
+		Filename:    path.Base(downloadURL.Path),
+		Extract:     extract,
+		Destination: output,
+		HTTPClient:  c.HTTPClient,
+	}.Fetch(ctx)
+}
+
+// WaitForTask polls a request until it is finished, returning its final
+// status, or an error if it fails, times out, or the context is done. If
+// progress isn't nil it is called after each check that finds the request
+// still pending.
+func (c *Client) WaitForTask(
+	ctx context.Context,
+	taskID string,
+	poll PollOptions,
+	progress func(elapsed time.Duration, status CLMSTaskStatus),
+) (CLMSTaskStatus, error) {
+	started := time.Now()
+	interval := poll.Interval
+	for {
+		status, err := c.TaskStatus(ctx, taskID)
+		if nil != err {
+			return CLMSTaskStatus{}, fmt.Errorf("error checking task status: %w", err)
+		}
+
+		err = CheckTaskStatus(taskID, status)
+		if nil == err {
+			return status, nil
+		}
+		if !IsTaskPending(err) {
+			return status, err
+		}
+
+		elapsed := time.Since(started)
+		if nil != progress {
+			progress(elapsed, status)
+		}
+		wait := interval
+		if poll.Timeout > 0 {
+			remaining := poll.Timeout - elapsed
+			if remaining <= 0 {
+				return status, fmt.Errorf("gave up waiting after %v, resume later with request ID %s: %w", poll.Timeout, taskID, err)
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status, errors.Join(ctx.Err(), err)
+		case <-timer.C:
+		}
+		interval = poll.next(interval)
+	}
+}
@@ -0,0 +1,179 @@
+package clms
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quantify.earth/reclaimer/clms/clmstest"
+)
+
+func newTestClient(t *testing.T) (*Client, *clmstest.Server) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := clmstest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddDataset(clmstest.Dataset{
+		UID:       "uid-corine",
+		Title:     "CORINE Land Cover 2018",
+		Downloads: []clmstest.DownloadInfo{{ID: "dl-raster", Name: "CLC 2018 raster 100m", FullFormat: "GeoTIFF"}},
+	})
+	client := &Client{
+		BaseURL:     server.BaseURL(),
+		accessToken: clmstest.AccessToken,
+	}
+	return client, server
+}
+
+func TestClientRequestAndWait(t *testing.T) {
+	client, server := newTestClient(t)
+	server.PollsUntilFinished = 3
+	ctx := context.Background()
+
+	dataset, found, err := client.FindGeneratedDataset(ctx, "uid-corine", false)
+	if (nil != err) || !found || ("CORINE Land Cover 2018" != dataset.Title) {
+		t.Fatalf("Expected to find dataset, got %v, %v: %v", dataset, found, err)
+	}
+
+	task, err := client.RequestGeneratedData(ctx, RequestSpec{UID: "uid-corine", DownloadID: "dl-raster", Format: "GeoTIFF", CoordinateSystem: "EPSG:4326"})
+	if (nil != err) || (1 != len(task.TaskIDs)) {
+		t.Fatalf("Expected one task, got %v: %v", task, err)
+	}
+
+	updates := 0
+	status, err := client.WaitForTask(ctx, task.TaskIDs[0].ID, PollOptions{Interval: time.Millisecond}, func(elapsed time.Duration, status CLMSTaskStatus) {
+		updates += 1
+	})
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if (TaskFinished != status.Status) || ("" == status.DownloadURL) {
+		t.Errorf("Expected finished task with download, got %v", status)
+	}
+	if 3 != updates {
+		t.Errorf("Expected 3 progress updates, got %d", updates)
+	}
+}
+
+func TestClientWaitForTaskCancelled(t *testing.T) {
+	client, server := newTestClient(t)
+	server.PollsUntilFinished = 1000
+	taskID := server.AddTask(clmstest.Task{Status: TaskInProgress})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := client.WaitForTask(ctx, taskID, PollOptions{Interval: time.Hour}, func(elapsed time.Duration, status CLMSTaskStatus) {
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) || !IsTaskPending(err) {
+		t.Errorf("Expected cancelled pending task error, got %v", err)
+	}
+}
+
+func TestClientNeedsCredentials(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.accessToken = ""
+
+	_, err := client.Requests(context.Background())
+	if nil == err {
+		t.Errorf("Expected error without credentials")
+	}
+
+	// but searching doesn't need them
+	_, err = client.FetchIndexGeneratedData(context.Background())
+	if nil != err {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestClientCancelRequest(t *testing.T) {
+	client, server := newTestClient(t)
+	taskID := server.AddTask(clmstest.Task{Status: TaskInProgress})
+
+	err := client.CancelRequest(context.Background(), taskID)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if task, _ := server.Task(taskID); TaskCancelled != task.Status {
+		t.Errorf("Expected task to be cancelled, got %s", task.Status)
+	}
+
+	err = client.CancelRequest(context.Background(), "missing")
+	if nil == err {
+		t.Errorf("Expected error cancelling unknown task")
+	}
+}
+
+// countingTransport lets tests check the client they gave was the one used.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientGetsTokenThroughItself(t *testing.T) {
+	client, server := newTestClient(t)
+	client.accessToken = ""
+	key := testRSAKey(t)
+	client.Tokens = NewSessionTokenSource(CLMSAuthenticationDetails{
+		ClientID:   "test-client",
+		KeyID:      "test-key",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		TokenURI:   "http://token.invalid/",
+	})
+	client.TokenURI = server.TokenURI()
+	transport := &countingTransport{}
+	client.HTTPClient = &http.Client{Transport: transport}
+
+	_, err := client.Requests(context.Background())
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if 1 != server.TokenRequests() {
+		t.Errorf("Expected one token request to the client's token URI, got %d", server.TokenRequests())
+	}
+	if 2 != transport.requests.Load() {
+		t.Errorf("Expected the token and requests to use the client's HTTP client, got %d requests", transport.requests.Load())
+	}
+
+	// And the context is honoured when getting a new one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.Tokens.Refresh(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled token request, got %v", err)
+	}
+}
+
+func TestClientDownloadTask(t *testing.T) {
+	client, server := newTestClient(t)
+	transport := &countingTransport{}
+	client.HTTPClient = &http.Client{Transport: transport}
+	status := CLMSTaskStatus{Status: TaskFinished, DownloadURL: server.AddFile("result.tif", []byte("raster"))}
+
+	output := t.TempDir()
+	err := client.DownloadTask(context.Background(), status, false, output)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	contents, err := os.ReadFile(path.Join(output, "result.tif"))
+	if (nil != err) || ("raster" != string(contents)) {
+		t.Errorf("Expected downloaded file, got %q: %v", contents, err)
+	}
+	if 1 != transport.requests.Load() {
+		t.Errorf("Expected the download to use the client's HTTP client, got %d requests", transport.requests.Load())
+	}
+
+	err = client.DownloadTask(context.Background(), CLMSTaskStatus{Status: TaskFinished}, false, output)
+	if nil == err {
+		t.Errorf("Expected error without a download URL")
+	}
+}
@@ -1,12 +1,12 @@
 package clms
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-
-	"quantify.earth/reclaimer/internal/utils"
+	"net/url"
+	"os"
+	"strings"
 )
 
 type CLMSSearchBatch struct {
@@ -16,25 +16,119 @@ type CLMSSearchBatch struct {
 	Next  string `json:"next"`
 }
 
+type CLMSFormat struct {
+	Token string `json:"token"`
+	Title string `json:"title"`
+}
+
+// The API returns full_format in several shapes: a plain string, a
+// single {token, title} object, or a list of either of those. This
+// normalises them all into a list.
+type CLMSFullFormat []CLMSFormat
+
+func (f *CLMSFullFormat) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if nil != err {
+		return err
+	}
+
+	var parse func(value interface{}) ([]CLMSFormat, error)
+	parse = func(value interface{}) ([]CLMSFormat, error) {
+		switch v := value.(type) {
+		case nil:
+			return nil, nil
+		case string:
+			if "" == v {
+				return nil, nil
+			}
+			return []CLMSFormat{{Token: v, Title: v}}, nil
+		case map[string]interface{}:
+			token, _ := v["token"].(string)
+			title, _ := v["title"].(string)
+			if "" == token {
+				token = title
+			}
+			if "" == title {
+				title = token
+			}
+			if "" == token {
+				return nil, fmt.Errorf("format object has no token or title")
+			}
+			return []CLMSFormat{{Token: token, Title: title}}, nil
+		case []interface{}:
+			formats := make([]CLMSFormat, 0, len(v))
+			for _, item := range v {
+				parsed, err := parse(item)
+				if nil != err {
+					return nil, err
+				}
+				formats = append(formats, parsed...)
+			}
+			return formats, nil
+		default:
+			return nil, fmt.Errorf("unexpected format value %v", value)
+		}
+	}
+
+	formats, err := parse(raw)
+	if nil != err {
+		return fmt.Errorf("failed to decode full_format: %w", err)
+	}
+	*f = formats
+	return nil
+}
+
+// Find matches a format name case insensitively, as CLMS isn't consistent
+// about "GeoTIFF" vs "Geotiff", and returns the dataset's own spelling.
+func (f CLMSFullFormat) Find(format string) (CLMSFormat, bool) {
+	for _, candidate := range f {
+		if strings.EqualFold(candidate.Token, format) || strings.EqualFold(candidate.Title, format) {
+			return candidate, true
+		}
+	}
+	return CLMSFormat{}, false
+}
+
+func (f CLMSFullFormat) Tokens() []string {
+	tokens := make([]string, len(f))
+	for idx, format := range f {
+		tokens[idx] = format.Token
+	}
+	return tokens
+}
+
 type CLMSDownloadInfo struct {
-	ID         string `json:"@id"`
-	Name       string `json:"name"`
-	Collection string `json:"collection"`
-	// This one is multiformat - can be a string or a struct
-	// FullFormat string `json:"full_format"`
-	FullPath   string   `json:"full_path"`
-	FullSource string   `json:"full_source"`
-	Layers     []string `json:"layers"`
+	ID         string         `json:"@id"`
+	Name       string         `json:"name"`
+	Collection string         `json:"collection"`
+	FullFormat CLMSFullFormat `json:"full_format"`
+	FullPath   string         `json:"full_path"`
+	FullSource string         `json:"full_source"`
+	Layers     []string       `json:"layers"`
+}
+
+// The IDs of a dataset's records in the metadata catalogues (GeoNetwork
+// instances) run by the EEA and VITO, which hold the INSPIRE/ISO metadata.
+type CLMSGeonetworkIdentifier struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type CLMSGeonetworkIdentifiers struct {
+	Items []CLMSGeonetworkIdentifier `json:"items"`
 }
 
 type CLMSDataset struct {
-	ID          string                        `json:"@id"`
-	Type        string                        `json:"@type"`
-	UID         string                        `json:"UID"`
-	Title       string                        `json:"title"`
-	Description string                        `json:"description"`
-	Downloads   map[string][]CLMSDownloadInfo `json:"dataset_download_information"`
-	ReviewState string                        `json:"review_state"`
+	ID                    string                        `json:"@id"`
+	Type                  string                        `json:"@type"`
+	UID                   string                        `json:"UID"`
+	Title                 string                        `json:"title"`
+	Description           string                        `json:"description"`
+	Downloads             map[string][]CLMSDownloadInfo `json:"dataset_download_information"`
+	CoordinateSystems     []string                      `json:"coordinateReferenceSystemList"`
+	GeonetworkIdentifiers CLMSGeonetworkIdentifiers     `json:"geonetwork_identifiers"`
+	ReviewState           string                        `json:"review_state"`
 }
 
 type CLMSSearch struct {
@@ -65,13 +159,14 @@ type CLMSFileList struct {
 }
 
 type CLMSPrepackagedDataset struct {
-	ID          string       `json:"@id"`
-	Type        string       `json:"@type"`
-	UID         string       `json:"UID"`
-	Title       string       `json:"title"`
-	Description string       `json:"description"`
-	Files       CLMSFileList `json:"downloadable_files"`
-	ReviewState string       `json:"review_state"`
+	ID                    string                    `json:"@id"`
+	Type                  string                    `json:"@type"`
+	UID                   string                    `json:"UID"`
+	Title                 string                    `json:"title"`
+	Description           string                    `json:"description"`
+	Files                 CLMSFileList              `json:"downloadable_files"`
+	GeonetworkIdentifiers CLMSGeonetworkIdentifiers `json:"geonetwork_identifiers"`
+	ReviewState           string                    `json:"review_state"`
 }
 
 type CLMSSearchPrepared struct {
@@ -86,6 +181,9 @@ type CLMSDatumRequest struct {
 	DatasetDownloadInformationID string `json:"DatasetDownloadInformationID"`
 	OutputFormat                 string `json:"OutputFormat"`
 	OutputGCS                    string `json:"OutputGCS"`
+	NUTS                         string `json:"NUTS,omitempty"`
+	// CLMS wants the corners top left first: west, north, east, south
+	BoundingBox []float64 `json:"BoundingBox,omitempty"`
 }
 
 type CLMSDataRequest struct {
@@ -110,6 +208,10 @@ type CLMSTaskResponse struct {
 	ErrorTaskIDs []CLMSTask `json:"ErrorTaskIds"`
 }
 
+type CLMSCancelRequest struct {
+	TaskID string `json:"TaskID"`
+}
+
 type CLMSTaskDataset struct {
 	DatasetFormat string   `json:"DatasetFormat"`
 	DatasetID     string   `json:"DatasetID"`
@@ -125,287 +227,144 @@ type CLMSTaskDataset struct {
 }
 
 type CLMSTaskStatus struct {
-	DownloadURL string            `json:"DownloadURL"`
-	FileSize    int64             `json:"FileSize"`
-	UserID      string            `json:"UserID"`
-	Status      string            `json:"Status"`
-	Message     string            `json:"Message"`
-	Datasets    []CLMSTaskDataset `json:"Datasets"`
+	DownloadURL          string            `json:"DownloadURL"`
+	FileSize             int64             `json:"FileSize"`
+	UserID               string            `json:"UserID"`
+	Status               string            `json:"Status"`
+	Message              string            `json:"Message"`
+	Datasets             []CLMSTaskDataset `json:"Datasets"`
+	RegistrationDateTime string            `json:"RegistrationDateTime"`
+	FinalizationDateTime string            `json:"FinalizationDateTime"`
 }
 
-const TaskInProgress = "In_progress"
-const TaskFinished = "Finished_ok"
+const DefaultBaseURL = "https://land.copernicus.eu/api/"
 
-const baseURL = "https://land.copernicus.eu/api/"
-const searchPathTemplate = "%s@search?b_start=%d&portal_type=DataSet&metadata_fields=UID&metadata_fields=dataset_full_format&&metadata_fields=dataset_download_information"
-const preparedSearchPathTemplate = "%s@search?b_start=%d&portal_type=DataSet&metadata_fields=UID&metadata_fields=downloadable_files"
+// BaseURL is the root of the CLMS API, which can be changed to point at a
+// staging server or a test double. It must end in a slash.
+var BaseURL = DefaultBaseURL
 
-func fetchIndexBatch(url string, batch interface{}) error {
+// TokenURI, if set, is used instead of the token_uri in the API key, as
+// the key will always name the production token endpoint.
+var TokenURI = ""
 
-	headers := map[string]string{
-		"Accept": "application/json",
-	}
-	resp, err := utils.HTTPGet(url, headers)
-	if nil != err {
-		return err
-	}
-	defer resp.Body.Close()
+// Environment variables that override BaseURL and TokenURI for the CLI.
+const BaseURLEnv = "CLMS_BASE_URL"
+const TokenURIEnv = "CLMS_TOKEN_URI"
 
-	if resp.StatusCode != http.StatusOK {
-		r, err := io.ReadAll(resp.Body)
-		body := resp.Status
-		if nil == err {
-			body = string(r)
+func configureEndpoints() error {
+	if value := os.Getenv(BaseURLEnv); "" != value {
+		parsed, err := url.Parse(value)
+		if (nil != err) || !parsed.IsAbs() {
+			return fmt.Errorf("$%s is not a valid URL: %s", BaseURLEnv, value)
+		}
+		if !strings.HasSuffix(value, "/") {
+			value += "/"
 		}
-		return fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, body)
+		BaseURL = value
 	}
-
-	err = json.NewDecoder(resp.Body).Decode(&batch)
-	if nil != err {
-		return fmt.Errorf("failed to decode response for %s: %w", url, err)
+	if value := os.Getenv(TokenURIEnv); "" != value {
+		TokenURI = value
 	}
 	return nil
 }
 
-func FetchIndexGeneratedData() ([]CLMSDataset, error) {
-	items := make([]CLMSDataset, 0)
-
-	url := fmt.Sprintf(searchPathTemplate, baseURL, 0)
-	for {
-		var batch CLMSSearch
-		err := fetchIndexBatch(url, &batch)
-		if nil != err {
-			return nil, err
-		}
-		if len(batch.Items) == 0 {
-			break
-		}
+const searchPathTemplate = "%s@search?b_start=%d&portal_type=DataSet&metadata_fields=UID&metadata_fields=dataset_full_format&&metadata_fields=dataset_download_information&metadata_fields=coordinateReferenceSystemList&metadata_fields=geonetwork_identifiers"
+const preparedSearchPathTemplate = "%s@search?b_start=%d&portal_type=DataSet&metadata_fields=UID&metadata_fields=downloadable_files&metadata_fields=geonetwork_identifiers"
 
-		items = append(items, batch.Items...)
-		if batch.Batch.Last == url {
-			break
-		}
-		if batch.Batch.Next == url {
-			break
-		}
-		url = batch.Batch.Next
-		if "" == url {
-			return nil, fmt.Errorf("got invald response: no next URL")
-		}
-	}
-	return items, nil
-}
-
-func FetchIndexPrepackagedData() ([]CLMSPrepackagedDataset, error) {
-	items := make([]CLMSPrepackagedDataset, 0)
-
-	url := fmt.Sprintf(preparedSearchPathTemplate, baseURL, 0)
-	for {
-		var batch CLMSSearchPrepared
-		err := fetchIndexBatch(url, &batch)
-		if nil != err {
-			return nil, err
-		}
-		if len(batch.Items) == 0 {
-			break
-		}
+// The functions below predate Client, and are kept for existing callers.
+// They use the default settings, and print nothing.
 
-		items = append(items, batch.Items...)
-		if batch.Batch.Last == url {
-			break
-		}
-		if batch.Batch.Next == url {
-			break
-		}
-		url = batch.Batch.Next
-		if "" == url {
-			return nil, fmt.Errorf("got invald response: no next URL")
-		}
-	}
-	return items, nil
+func tokenClient(sessionToken string) *Client {
+	return &Client{accessToken: sessionToken}
 }
 
-func requestData(sessionToken string, payload interface{}) (CLMSTaskResponse, error) {
+// Deprecated: use Client.FetchIndexGeneratedData.
+func FetchIndexGeneratedData() ([]CLMSDataset, error) {
+	return (&Client{}).FetchIndexGeneratedData(context.Background())
+}
 
-	jsonStrBytes, err := json.Marshal(payload)
-	if nil != err {
-		return CLMSTaskResponse{}, fmt.Errorf("failed to marshal request: %w", err)
-	}
-	fmt.Printf("request bytes: %s\n", string(jsonStrBytes))
+// Deprecated: use Client.FetchIndexPrepackagedData.
+func FetchIndexPrepackagedData() ([]CLMSPrepackagedDataset, error) {
+	return (&Client{}).FetchIndexPrepackagedData(context.Background())
+}
 
-	url := fmt.Sprintf("%s@datarequest_post", baseURL)
+// Deprecated: use Client.LoadIndexGeneratedData.
+func LoadIndexGeneratedData(refresh bool) ([]CLMSDataset, error) {
+	return (&Client{}).LoadIndexGeneratedData(context.Background(), refresh)
+}
 
-	auth := fmt.Sprintf("Bearer %s", sessionToken)
-	headers := map[string]string{
-		"Accept":        "application/json",
-		"Content-type":  "application/json",
-		"Authorization": auth,
-	}
-	resp, err := utils.HTTPPost(url, headers, string(jsonStrBytes))
-	if nil != err {
-		return CLMSTaskResponse{}, fmt.Errorf("failed request: %w", err)
-	}
-	defer resp.Body.Close()
+// Deprecated: use Client.LoadIndexPrepackagedData.
+func LoadIndexPrepackagedData(refresh bool) ([]CLMSPrepackagedDataset, error) {
+	return (&Client{}).LoadIndexPrepackagedData(context.Background(), refresh)
+}
 
-	if http.StatusCreated != resp.StatusCode {
-		r, err := io.ReadAll(resp.Body)
-		body := resp.Status
-		if nil == err {
-			body = string(r)
-		}
-		return CLMSTaskResponse{}, fmt.Errorf("unexpected request response HTTP status %d: %s", resp.StatusCode, body)
-	}
+// Deprecated: use Client.FindGeneratedDataset.
+func FindGeneratedDataset(uid string, refresh bool) (CLMSDataset, bool, error) {
+	return (&Client{}).FindGeneratedDataset(context.Background(), uid, refresh)
+}
 
-	// hopefully we have a task ID now
-	var taskResp CLMSTaskResponse
-	err = json.NewDecoder(resp.Body).Decode(&taskResp)
-	if nil != err {
-		return CLMSTaskResponse{}, fmt.Errorf("failed to decode response: %w", err)
-	}
+// Deprecated: use Client.FindPrepackagedDataset.
+func FindPrepackagedDataset(uid string, refresh bool) (CLMSPrepackagedDataset, bool, error) {
+	return (&Client{}).FindPrepackagedDataset(context.Background(), uid, refresh)
+}
 
-	return taskResp, nil
+// Deprecated: use Client.FormatConversionTable.
+func FetchFormatConversionTable() (CLMSFormatConversionTable, error) {
+	return (&Client{}).FormatConversionTable(context.Background())
 }
 
+// Deprecated: use Client.RequestGeneratedData.
 func RequestGeneratedData(
 	uid string,
 	downloadID string,
 	outputFormat string,
 	coordinateSystem string,
+	nuts string,
+	boundingBox []float64,
 	sessionToken string,
 	outputPath string,
 ) (CLMSTaskResponse, error) {
-	// Prep the request
-	request := CLMSDatumRequest{
-		DatasetID:                    uid,
-		DatasetDownloadInformationID: downloadID,
-		OutputFormat:                 outputFormat,
-		OutputGCS:                    coordinateSystem,
-	}
-	outerRequest := CLMSDataRequest{
-		Datasets: []CLMSDatumRequest{request},
-	}
-
-	return requestData(sessionToken, outerRequest)
+	return tokenClient(sessionToken).RequestGeneratedData(context.Background(), RequestSpec{
+		UID:              uid,
+		DownloadID:       downloadID,
+		Format:           outputFormat,
+		CoordinateSystem: coordinateSystem,
+		NUTS:             nuts,
+		BoundingBox:      boundingBox,
+	})
 }
 
+// Deprecated: use Client.RequestPrepackagedData.
 func RequestPrepackagedData(
 	uid string,
 	downloadID string,
 	sessionToken string,
 	outputPath string,
 ) (CLMSTaskResponse, error) {
-	// Prep the request
-	request := CLMSPreparedDatumRequest{
-		DatasetID: uid,
-		FileID:    downloadID,
-	}
-	outerRequest := CLMSPrepackagedDataRequest{
-		Datasets: []CLMSPreparedDatumRequest{request},
-	}
-
-	return requestData(sessionToken, outerRequest)
+	return tokenClient(sessionToken).RequestPrepackagedData(context.Background(), uid, downloadID)
 }
 
+// Deprecated: use Client.RequestDirectData.
 func RequestDirectData(
 	uid string,
 	downloadID string,
 	sessionToken string,
 	outputPath string,
 ) ([]string, error) {
-
-	url := fmt.Sprintf("%s@get-download-file-urls?dataset_uid=%s&download_information_id=%s", baseURL, uid, downloadID)
-
-	auth := fmt.Sprintf("Bearer %s", sessionToken)
-	headers := map[string]string{
-		"Accept":        "application/json",
-		"Authorization": auth,
-	}
-	resp, err := utils.HTTPGet(url, headers)
-	if nil != err {
-		return nil, fmt.Errorf("failed request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if http.StatusOK != resp.StatusCode {
-		r, err := io.ReadAll(resp.Body)
-		body := resp.Status
-		if nil == err {
-			body = string(r)
-		}
-		return nil, fmt.Errorf("unexpected request response HTTP status %d: %s", resp.StatusCode, body)
-	}
-
-	var downloadURLs []string
-	err = json.NewDecoder(resp.Body).Decode(&downloadURLs)
-	if nil != err {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return downloadURLs, nil
+	return tokenClient(sessionToken).RequestDirectData(context.Background(), uid, downloadID)
 }
 
+// Deprecated: use Client.TaskStatus.
 func GetTaskStatus(taskID string, sessionToken string) (CLMSTaskStatus, error) {
-	url := fmt.Sprintf("%s@datarequest_status_get?TaskID=%s", baseURL, taskID)
-	auth := fmt.Sprintf("Bearer %s", sessionToken)
-	headers := map[string]string{
-		"Accept":        "application/json",
-		"Content-type":  "application/json",
-		"Authorization": auth,
-	}
-	resp, err := utils.HTTPGet(url, headers)
-	if nil != err {
-		return CLMSTaskStatus{}, fmt.Errorf("failed request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if http.StatusOK != resp.StatusCode {
-		r, err := io.ReadAll(resp.Body)
-		body := resp.Status
-		if nil == err {
-			body = string(r)
-		}
-		return CLMSTaskStatus{}, fmt.Errorf("unexpected request HTTP status %d: %s", resp.StatusCode, body)
-	}
-
-	// hopefully we have a task ID now
-	var taskResp CLMSTaskStatus
-	err = json.NewDecoder(resp.Body).Decode(&taskResp)
-	if nil != err {
-		return CLMSTaskStatus{}, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return taskResp, nil
+	return tokenClient(sessionToken).TaskStatus(context.Background(), taskID)
 }
 
-func GetRequests(
-	sessionToken string,
-) (map[string]CLMSTaskStatus, error) {
-	url := fmt.Sprintf("%s@datarequest_search", baseURL)
-	auth := fmt.Sprintf("Bearer %s", sessionToken)
-	headers := map[string]string{
-		"Accept":        "application/json",
-		"Authorization": auth,
-	}
-	resp, err := utils.HTTPGet(url, headers)
-	if nil != err {
-		return nil, fmt.Errorf("failed request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if http.StatusOK != resp.StatusCode {
-		r, err := io.ReadAll(resp.Body)
-		body := resp.Status
-		if nil == err {
-			body = string(r)
-		}
-		return nil, fmt.Errorf("unexpected request HTTP status %d: %s", resp.StatusCode, body)
-	}
-
-	var taskResp map[string]CLMSTaskStatus
-	err = json.NewDecoder(resp.Body).Decode(&taskResp)
-	if nil != err {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
+// Deprecated: use Client.Requests.
+func GetRequests(sessionToken string) (map[string]CLMSTaskStatus, error) {
+	return tokenClient(sessionToken).Requests(context.Background())
+}
 
-	return taskResp, nil
+// Deprecated: use Client.CancelRequest.
+func CancelRequest(taskID string, sessionToken string) error {
+	return tokenClient(sessionToken).CancelRequest(context.Background(), taskID)
 }
@@ -0,0 +1,464 @@
+// Package clmstest provides a fake CLMS API server for testing, covering
+// the search index, token exchange, data requests and their progress, and
+// direct downloads. It deliberately doesn't import the clms package, so that
+// it can be used from that package's own tests.
+package clmstest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AccessToken = "clmstest-access-token"
+
+type DownloadInfo struct {
+	ID         string `json:"@id"`
+	Name       string `json:"name"`
+	Collection string `json:"collection"`
+	FullFormat string `json:"full_format"`
+	FullPath   string `json:"full_path"`
+	FullSource string `json:"full_source"`
+}
+
+type File struct {
+	ID         string `json:"@id"`
+	Area       string `json:"area"`
+	File       string `json:"file"`
+	Format     string `json:"format"`
+	Resolution string `json:"resolution"`
+	Version    string `json:"version"`
+	Year       string `json:"year"`
+}
+
+// A dataset is served with both its generated download information and its
+// prepackaged files, as the real index does. DirectFiles maps a download ID
+// to the names of files that the direct download endpoint will hand out.
+type Dataset struct {
+	UID               string
+	Title             string
+	Description       string
+	Downloads         []DownloadInfo
+	Files             []File
+	CoordinateSystems []string
+	DirectFiles       map[string][]string
+}
+
+func (d Dataset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"@id":                           "/api/datasets/" + d.UID,
+		"@type":                         "DataSet",
+		"UID":                           d.UID,
+		"title":                         d.Title,
+		"description":                   d.Description,
+		"review_state":                  "published",
+		"dataset_download_information":  map[string][]DownloadInfo{"items": d.Downloads},
+		"downloadable_files":            map[string][]File{"items": d.Files},
+		"coordinateReferenceSystemList": d.CoordinateSystems,
+		"geonetwork_identifiers":        map[string][]string{"items": {}},
+	})
+}
+
+type TaskDataset struct {
+	DatasetID    string    `json:"DatasetID"`
+	DatasetTitle string    `json:"DatasetTitle"`
+	OutputFormat string    `json:"OutputFormat"`
+	OutputGCS    string    `json:"OutputGCS"`
+	NUTSID       string    `json:"NUTSID,omitempty"`
+	BoundingBox  []float64 `json:"BoundingBox,omitempty"`
+}
+
+type Task struct {
+	DownloadURL          string        `json:"DownloadURL,omitempty"`
+	FileSize             int64         `json:"FileSize,omitempty"`
+	UserID               string        `json:"UserID"`
+	Status               string        `json:"Status"`
+	Message              string        `json:"Message,omitempty"`
+	Datasets             []TaskDataset `json:"Datasets"`
+	RegistrationDateTime string        `json:"RegistrationDateTime"`
+	FinalizationDateTime string        `json:"FinalizationDateTime,omitempty"`
+
+	polls int
+}
+
+type Server struct {
+	*httptest.Server
+
+	// How many datasets to return per page of the search index.
+	PageSize int
+	// How many times a new task reports In_progress before it finishes.
+	PollsUntilFinished int
+	// Which formats each format can be converted to.
+	FormatConversions map[string]map[string]bool
+
+	lock          sync.Mutex
+	datasets      []Dataset
+	tasks         map[string]*Task
+	files         map[string][]byte
+	nextTask      int
+	tokenRequests int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		PageSize:           2,
+		PollsUntilFinished: 1,
+		FormatConversions:  map[string]map[string]bool{"GeoTIFF": {"GeoTIFF": true, "Netcdf": true}},
+		tasks:              make(map[string]*Task),
+		files:              make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/api/@search", s.handleSearch)
+	mux.HandleFunc("/api/@format_conversion_table", s.handleFormatConversionTable)
+	mux.HandleFunc("/api/@datarequest_post", s.authorised(s.handleDataRequest))
+	mux.HandleFunc("/api/@datarequest_status_get", s.authorised(s.handleStatus))
+	mux.HandleFunc("/api/@datarequest_search", s.authorised(s.handleRequests))
+	mux.HandleFunc("/api/@datarequest_delete", s.authorised(s.handleCancel))
+	mux.HandleFunc("/api/@get-download-file-urls", s.authorised(s.handleDirectURLs))
+	mux.HandleFunc("/files/", s.handleFile)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// BaseURL is what the clms package's BaseURL should be set to.
+func (s *Server) BaseURL() string {
+	return s.URL + "/api/"
+}
+
+func (s *Server) TokenURI() string {
+	return s.URL + "/token"
+}
+
+// TokenRequests is how many session tokens have been handed out.
+func (s *Server) TokenRequests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tokenRequests
+}
+
+func (s *Server) AddDataset(dataset Dataset) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.datasets = append(s.datasets, dataset)
+	for _, names := range dataset.DirectFiles {
+		for _, name := range names {
+			s.files[name] = []byte("direct download " + name)
+		}
+	}
+}
+
+// AddFile makes contents available for download and returns its URL.
+func (s *Server) AddFile(name string, contents []byte) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[name] = contents
+	return s.URL + "/files/" + name
+}
+
+// AddTask records a request as if it had been made earlier, returning its ID.
+// A finished task is given a zip to download.
+func (s *Server) AddTask(task Task) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	taskID := s.newTaskID()
+	if "" == task.RegistrationDateTime {
+		task.RegistrationDateTime = time.Now().UTC().Format("2006-01-02T15:04:05.999999")
+	}
+	s.tasks[taskID] = &task
+	if "Finished_ok" == task.Status {
+		s.finish(taskID, &task)
+	}
+	return taskID
+}
+
+// Task returns the current state of a request.
+func (s *Server) Task(taskID string) (Task, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return Task{}, false
+	}
+	return *task, true
+}
+
+// Must be called with the lock held.
+func (s *Server) newTaskID() string {
+	s.nextTask += 1
+	return fmt.Sprintf("task%04d", s.nextTask)
+}
+
+// Must be called with the lock held.
+func (s *Server) finish(taskID string, task *Task) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	writer, _ := archive.Create(taskID + ".txt")
+	writer.Write([]byte("data for " + taskID))
+	archive.Close()
+
+	name := taskID + ".zip"
+	s.files[name] = buffer.Bytes()
+	task.Status = "Finished_ok"
+	task.DownloadURL = s.URL + "/files/" + name
+	task.FileSize = int64(buffer.Len())
+	task.FinalizationDateTime = time.Now().UTC().Format("2006-01-02T15:04:05.999999")
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (s *Server) authorised(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "invalid token"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if nil != err {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if "urn:ietf:params:oauth:grant-type:jwt-bearer" != r.PostForm.Get("grant_type") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if 3 != len(strings.Split(r.PostForm.Get("assertion"), ".")) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "assertion is not a JWT"})
+		return
+	}
+
+	s.lock.Lock()
+	s.tokenRequests += 1
+	s.lock.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": AccessToken,
+		"expires_in":   3600,
+		"token_type":   "Bearer",
+	})
+}
+
+// The client follows the batching links, and stops when the page it asked
+// for is the last one, so those links are made by changing b_start in the
+// URL it requested.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	datasets := s.datasets
+	if uid := r.URL.Query().Get("UID"); "" != uid {
+		datasets = make([]Dataset, 0)
+		for _, dataset := range s.datasets {
+			if dataset.UID == uid {
+				datasets = append(datasets, dataset)
+			}
+		}
+	}
+
+	startParam := r.URL.Query().Get("b_start")
+	start, _ := strconv.Atoi(startParam)
+	pageURL := func(offset int) string {
+		return s.URL + strings.Replace(r.URL.RequestURI(), "b_start="+startParam, "b_start="+strconv.Itoa(offset), 1)
+	}
+
+	end := start + s.PageSize
+	if end > len(datasets) {
+		end = len(datasets)
+	}
+	page := make([]Dataset, 0)
+	if start < end {
+		page = datasets[start:end]
+	}
+	last := 0
+	if len(datasets) > 0 {
+		last = ((len(datasets) - 1) / s.PageSize) * s.PageSize
+	}
+	batching := map[string]string{
+		"@id":   pageURL(start),
+		"first": pageURL(0),
+		"last":  pageURL(last),
+	}
+	if end < len(datasets) {
+		batching["next"] = pageURL(end)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"@id":         pageURL(start),
+		"batching":    batching,
+		"items":       page,
+		"items_total": len(datasets),
+	})
+}
+
+func (s *Server) handleFormatConversionTable(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.FormatConversions)
+}
+
+type datumRequest struct {
+	DatasetID                    string    `json:"DatasetID"`
+	DatasetDownloadInformationID string    `json:"DatasetDownloadInformationID"`
+	FileID                       string    `json:"FileID"`
+	OutputFormat                 string    `json:"OutputFormat"`
+	OutputGCS                    string    `json:"OutputGCS"`
+	NUTS                         string    `json:"NUTS"`
+	BoundingBox                  []float64 `json:"BoundingBox"`
+}
+
+func (s *Server) findDataset(uid string) (Dataset, bool) {
+	for _, dataset := range s.datasets {
+		if dataset.UID == uid {
+			return dataset, true
+		}
+	}
+	return Dataset{}, false
+}
+
+func (s *Server) handleDataRequest(w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Datasets []datumRequest `json:"Datasets"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if (nil != err) || (0 == len(request.Datasets)) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "msg": "invalid request"})
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	task := Task{
+		UserID:               "clmstest",
+		Status:               "In_progress",
+		RegistrationDateTime: time.Now().UTC().Format("2006-01-02T15:04:05.999999"),
+	}
+	for _, datum := range request.Datasets {
+		dataset, ok := s.findDataset(datum.DatasetID)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "msg": "unknown dataset " + datum.DatasetID})
+			return
+		}
+		task.Datasets = append(task.Datasets, TaskDataset{
+			DatasetID:    datum.DatasetID,
+			DatasetTitle: dataset.Title,
+			OutputFormat: datum.OutputFormat,
+			OutputGCS:    datum.OutputGCS,
+			NUTSID:       datum.NUTS,
+			BoundingBox:  datum.BoundingBox,
+		})
+	}
+
+	taskID := s.newTaskID()
+	s.tasks[taskID] = &task
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"TaskIds": []map[string]string{{"TaskID": taskID}},
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	taskID := r.URL.Query().Get("TaskID")
+	task, ok := s.tasks[taskID]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "error", "msg": "Error, task not found"})
+		return
+	}
+	if "In_progress" == task.Status {
+		if task.polls >= s.PollsUntilFinished {
+			s.finish(taskID, task)
+		}
+		task.polls += 1
+	}
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writeJSON(w, http.StatusOK, s.tasks)
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if http.MethodDelete != r.Method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		TaskID string `json:"TaskID"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if nil != err {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "msg": "invalid request"})
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	task, ok := s.tasks[request.TaskID]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "error", "msg": "Error, task not found"})
+		return
+	}
+	task.Status = "Cancelled"
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDirectURLs(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dataset, ok := s.findDataset(r.URL.Query().Get("dataset_uid"))
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "msg": "unknown dataset"})
+		return
+	}
+	names, ok := dataset.DirectFiles[r.URL.Query().Get("download_information_id")]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"status": "error", "msg": "no direct download for item"})
+		return
+	}
+	urls := make([]string, len(names))
+	for idx, name := range names {
+		// signed like the real thing, with a query that varies per call
+		urls[idx] = fmt.Sprintf("%s/files/%s?signature=%d", s.URL, name, time.Now().UnixNano())
+	}
+	writeJSON(w, http.StatusOK, urls)
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	s.lock.Lock()
+	contents, ok := s.files[name]
+	s.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+}
@@ -0,0 +1,189 @@
+package clms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Environment variables that can provide the API key, for containers and
+// CI where writing the key to a file is awkward.
+const APIKeyEnv = "CLMS_API_KEY"
+const APIKeyFileEnv = "CLMS_API_KEY_FILE"
+const APIKeyFDEnv = "CLMS_API_KEY_FD"
+
+// How to look the key up in the freedesktop secret service. Store it with:
+//
+//	secret-tool store --label "CLMS API key" service reclaimer type clms-api-key < key.json
+var secretToolCommand = []string{"secret-tool", "lookup", "service", "reclaimer", "type", "clms-api-key"}
+
+// The user config file, which currently only says where the API key lives:
+//
+//	{"clms": {"apikeyfile": "/path/to/key.json"}}
+type reclaimerConfig struct {
+	CLMS struct {
+		APIKeyFile string `json:"apikeyfile"`
+	} `json:"clms"`
+}
+
+func configFilePath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if nil != err {
+		return "", fmt.Errorf("failed to find user config dir: %w", err)
+	}
+	return path.Join(configDir, "reclaimer", "config.json"), nil
+}
+
+// The flags every verb that needs credentials takes.
+type credentialFlags struct {
+	KeyFile string
+	FD      int
+}
+
+func addCredentialFlags(flag *flag.FlagSet) *credentialFlags {
+	credentials := credentialFlags{FD: -1}
+	flag.StringVar(&credentials.KeyFile, "apikeyfile", "", fmt.Sprintf("Path of JSON API key downloaded from CLMS account page. Otherwise taken from $%s, $%s, $%s, the config file, or the secret service.", APIKeyEnv, APIKeyFileEnv, APIKeyFDEnv))
+	flag.IntVar(&credentials.FD, "apikeyfd", -1, "File descriptor to read the JSON API key from.")
+	return &credentials
+}
+
+func ParseAPIKey(contents []byte) (CLMSAuthenticationDetails, error) {
+	var token CLMSAuthenticationDetails
+	err := json.Unmarshal(contents, &token)
+	if nil != err {
+		return CLMSAuthenticationDetails{}, fmt.Errorf("failed to parse: %w", err)
+	}
+	return token, nil
+}
+
+func readAPIKeyFD(fd int) ([]byte, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if nil == file {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// A credential source returns the raw key JSON, or nil if it has nothing
+// to offer so that the next source should be tried.
+type credentialSource struct {
+	name string
+	load func() ([]byte, error)
+}
+
+func credentialSources(flags credentialFlags) []credentialSource {
+	return []credentialSource{
+		{"-apikeyfile", func() ([]byte, error) {
+			if "" == flags.KeyFile {
+				return nil, nil
+			}
+			return os.ReadFile(flags.KeyFile)
+		}},
+		{"-apikeyfd", func() ([]byte, error) {
+			if flags.FD < 0 {
+				return nil, nil
+			}
+			return readAPIKeyFD(flags.FD)
+		}},
+		{"$" + APIKeyEnv, func() ([]byte, error) {
+			value := os.Getenv(APIKeyEnv)
+			if "" == value {
+				return nil, nil
+			}
+			return []byte(value), nil
+		}},
+		{"$" + APIKeyFileEnv, func() ([]byte, error) {
+			value := os.Getenv(APIKeyFileEnv)
+			if "" == value {
+				return nil, nil
+			}
+			return os.ReadFile(value)
+		}},
+		{"$" + APIKeyFDEnv, func() ([]byte, error) {
+			value := os.Getenv(APIKeyFDEnv)
+			if "" == value {
+				return nil, nil
+			}
+			fd, err := strconv.Atoi(value)
+			if nil != err {
+				return nil, fmt.Errorf("expected a file descriptor number, got %s", value)
+			}
+			return readAPIKeyFD(fd)
+		}},
+		{"config file", func() ([]byte, error) {
+			configPath, err := configFilePath()
+			if nil != err {
+				return nil, nil
+			}
+			contents, err := os.ReadFile(configPath)
+			if nil != err {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			var config reclaimerConfig
+			err = json.Unmarshal(contents, &config)
+			if nil != err {
+				return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
+			}
+			if "" == config.CLMS.APIKeyFile {
+				return nil, nil
+			}
+			return os.ReadFile(config.CLMS.APIKeyFile)
+		}},
+		{"secret service", func() ([]byte, error) {
+			tool, err := exec.LookPath(secretToolCommand[0])
+			if nil != err {
+				return nil, nil
+			}
+			var stdout bytes.Buffer
+			cmd := exec.Command(tool, secretToolCommand[1:]...)
+			cmd.Stdout = &stdout
+			err = cmd.Run()
+			if nil != err {
+				// secret-tool exits with an error if there's no matching secret
+				return nil, nil
+			}
+			if "" == strings.TrimSpace(stdout.String()) {
+				return nil, nil
+			}
+			return stdout.Bytes(), nil
+		}},
+	}
+}
+
+// LoadCredentials finds the API key from the first source that provides
+// one, in this order: -apikeyfile, -apikeyfd, $CLMS_API_KEY (the JSON
+// itself), $CLMS_API_KEY_FILE, $CLMS_API_KEY_FD, the user config file,
+// and finally the freedesktop secret service. It also returns the name of
+// the source used.
+func LoadCredentials(flags credentialFlags) (CLMSAuthenticationDetails, string, error) {
+	names := make([]string, 0)
+	for _, source := range credentialSources(flags) {
+		names = append(names, source.name)
+		contents, err := source.load()
+		if nil != err {
+			return CLMSAuthenticationDetails{}, source.name, fmt.Errorf("failed to load api key from %s: %w", source.name, err)
+		}
+		if nil == contents {
+			continue
+		}
+		details, err := ParseAPIKey(contents)
+		if nil != err {
+			return CLMSAuthenticationDetails{}, source.name, fmt.Errorf("failed to load api key from %s: %w", source.name, err)
+		}
+		return details, source.name, nil
+	}
+	return CLMSAuthenticationDetails{}, "", fmt.Errorf("No API key provided, required for downloads. Looked in: %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,116 @@
+package clms
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, dir string, clientID string) string {
+	keyPath := path.Join(dir, clientID+".json")
+	err := os.WriteFile(keyPath, []byte(`{"client_id": "`+clientID+`"}`), 0o600)
+	if nil != err {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return keyPath
+}
+
+func isolateCredentials(t *testing.T) string {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	t.Setenv(APIKeyEnv, "")
+	t.Setenv(APIKeyFileEnv, "")
+	t.Setenv(APIKeyFDEnv, "")
+	saved := secretToolCommand
+	secretToolCommand = []string{"reclaimer-no-such-secret-tool"}
+	t.Cleanup(func() { secretToolCommand = saved })
+	return configDir
+}
+
+func TestLoadCredentialsPrecedence(t *testing.T) {
+	configDir := isolateCredentials(t)
+	dir := t.TempDir()
+
+	err := os.MkdirAll(path.Join(configDir, "reclaimer"), 0o700)
+	if nil != err {
+		t.Fatalf("Failed to make config dir: %v", err)
+	}
+	config := `{"clms": {"apikeyfile": "` + writeTestKey(t, dir, "config") + `"}}`
+	err = os.WriteFile(path.Join(configDir, "reclaimer", "config.json"), []byte(config), 0o600)
+	if nil != err {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	details, source, err := LoadCredentials(credentialFlags{FD: -1})
+	if (nil != err) || ("config" != details.ClientID) || ("config file" != source) {
+		t.Errorf("Expected key from config file, got %v from %s: %v", details, source, err)
+	}
+
+	t.Setenv(APIKeyFileEnv, writeTestKey(t, dir, "envfile"))
+	details, source, err = LoadCredentials(credentialFlags{FD: -1})
+	if (nil != err) || ("envfile" != details.ClientID) || ("$"+APIKeyFileEnv != source) {
+		t.Errorf("Expected key from %s, got %v from %s: %v", APIKeyFileEnv, details, source, err)
+	}
+
+	t.Setenv(APIKeyEnv, `{"client_id": "env"}`)
+	details, source, err = LoadCredentials(credentialFlags{FD: -1})
+	if (nil != err) || ("env" != details.ClientID) {
+		t.Errorf("Expected key from %s, got %v from %s: %v", APIKeyEnv, details, source, err)
+	}
+
+	details, source, err = LoadCredentials(credentialFlags{KeyFile: writeTestKey(t, dir, "flag"), FD: -1})
+	if (nil != err) || ("flag" != details.ClientID) || ("-apikeyfile" != source) {
+		t.Errorf("Expected key from flag, got %v from %s: %v", details, source, err)
+	}
+}
+
+func TestLoadCredentialsFromFD(t *testing.T) {
+	isolateCredentials(t)
+
+	reader, writer, err := os.Pipe()
+	if nil != err {
+		t.Fatalf("Failed to make pipe: %v", err)
+	}
+	_, err = writer.Write([]byte(`{"client_id": "fd"}`))
+	if nil != err {
+		t.Fatalf("Failed to write to pipe: %v", err)
+	}
+	writer.Close()
+	// LoadCredentials closes the descriptor it's given, so give it its own
+	// rather than one reader will close again when it's garbage collected,
+	// by which time the number may belong to something else.
+	fd, err := syscall.Dup(int(reader.Fd()))
+	if nil != err {
+		t.Fatalf("Failed to dup pipe: %v", err)
+	}
+	reader.Close()
+
+	details, source, err := LoadCredentials(credentialFlags{FD: fd})
+	if (nil != err) || ("fd" != details.ClientID) || ("-apikeyfd" != source) {
+		t.Errorf("Expected key from fd, got %v from %s: %v", details, source, err)
+	}
+}
+
+func TestLoadCredentialsErrors(t *testing.T) {
+	isolateCredentials(t)
+
+	_, _, err := LoadCredentials(credentialFlags{FD: -1})
+	if (nil == err) || !strings.Contains(err.Error(), "No API key provided") {
+		t.Errorf("Expected no key error, got %v", err)
+	}
+
+	t.Setenv(APIKeyEnv, "not json")
+	_, source, err := LoadCredentials(credentialFlags{FD: -1})
+	if (nil == err) || ("$"+APIKeyEnv != source) {
+		t.Errorf("Expected parse error from %s, got %v from %s", APIKeyEnv, err, source)
+	}
+
+	t.Setenv(APIKeyEnv, "")
+	t.Setenv(APIKeyFDEnv, "stdin")
+	_, _, err = LoadCredentials(credentialFlags{FD: -1})
+	if nil == err {
+		t.Errorf("Expected error for bad fd")
+	}
+}
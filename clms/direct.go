@@ -0,0 +1,137 @@
+package clms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// Direct downloads can be hundreds of tiles, so we keep a record in the
+// output directory of which have been fetched and which failed, so that a
+// rerun can pick up where the last one left off.
+const directRecordName = ".reclaimer-direct.json"
+
+type directFile struct {
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Completed time.Time `json:"completed"`
+}
+
+type directRecord struct {
+	Completed map[string]directFile `json:"completed"`
+	Failed    map[string]string     `json:"failed"`
+}
+
+// The URLs CLMS hands out may be signed, with a query string that changes
+// each time we ask for them, so records are keyed on the URL without it.
+func directRecordKey(link *url.URL) string {
+	key := *link
+	key.RawQuery = ""
+	key.Fragment = ""
+	return key.String()
+}
+
+func directRecordPath(outputPath string) (string, error) {
+	if "" == outputPath {
+		cwd, err := os.Getwd()
+		if nil != err {
+			return "", fmt.Errorf("failed to look up cwd: %w", err)
+		}
+		outputPath = cwd
+	}
+	return path.Join(outputPath, directRecordName), nil
+}
+
+func loadDirectRecord(outputPath string) (directRecord, error) {
+	record := directRecord{
+		Completed: make(map[string]directFile),
+		Failed:    make(map[string]string),
+	}
+	recordPath, err := directRecordPath(outputPath)
+	if nil != err {
+		return record, err
+	}
+	contents, err := os.ReadFile(recordPath)
+	if nil != err {
+		if errors.Is(err, fs.ErrNotExist) {
+			return record, nil
+		}
+		return record, fmt.Errorf("failed to read download record: %w", err)
+	}
+	err = json.Unmarshal(contents, &record)
+	if nil != err {
+		return record, fmt.Errorf("failed to parse download record %s: %w", recordPath, err)
+	}
+	if nil == record.Completed {
+		record.Completed = make(map[string]directFile)
+	}
+	if nil == record.Failed {
+		record.Failed = make(map[string]string)
+	}
+	return record, nil
+}
+
+func saveDirectRecord(outputPath string, record directRecord) error {
+	recordPath, err := directRecordPath(outputPath)
+	if nil != err {
+		return err
+	}
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if nil != err {
+		return fmt.Errorf("failed to encode download record: %w", err)
+	}
+	// The record is rewritten after every file, so an interrupted run
+	// mustn't leave it half written, or the next can't resume.
+	return writeFileAtomically(recordPath, contents, 0o644)
+}
+
+// remoteSize asks the server how big a file is without fetching it,
+// returning -1 if it won't say.
+func (c *Client) remoteSize(ctx context.Context, link string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, link, nil)
+	if nil != err {
+		return -1, err
+	}
+	req.Header.Set("User-Agent", "Reclaimer/0.1")
+	resp, err := c.httpClient().Do(req)
+	if nil != err {
+		return -1, err
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		return -1, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+// alreadyDownloaded decides whether we can skip a file. If we have a
+// record of fetching it we trust that, otherwise if there's a file of the
+// right name and the same size as the server says the remote one is, we
+// assume it's from a previous run that didn't get to write its record.
+// Extracted archives don't leave a file we can check, so they rely on the
+// record alone.
+func (c *Client) alreadyDownloaded(ctx context.Context, record directRecord, link *url.URL, localPath string, extract bool) bool {
+	if done, ok := record.Completed[directRecordKey(link)]; ok {
+		if extract {
+			return true
+		}
+		info, err := os.Stat(localPath)
+		return (nil == err) && (info.Size() == done.Size)
+	}
+	if extract {
+		return false
+	}
+	info, err := os.Stat(localPath)
+	if nil != err {
+		return false
+	}
+	size, err := c.remoteSize(ctx, link.String())
+	return (nil == err) && (size == info.Size())
+}
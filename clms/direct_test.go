@@ -0,0 +1,103 @@
+package clms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDirectRecordKeyIgnoresSignature(t *testing.T) {
+	first, _ := url.Parse("https://example.com/tiles/a.zip?X-Amz-Signature=abc")
+	second, _ := url.Parse("https://example.com/tiles/a.zip?X-Amz-Signature=def")
+	if directRecordKey(first) != directRecordKey(second) {
+		t.Errorf("Expected same key, got %s and %s", directRecordKey(first), directRecordKey(second))
+	}
+}
+
+func TestDirectRecordRoundTrip(t *testing.T) {
+	tempdir := t.TempDir()
+
+	record, err := loadDirectRecord(tempdir)
+	if nil != err {
+		t.Fatalf("Expected no error for missing record, got %v", err)
+	}
+	record.Completed["a"] = directFile{Filename: "a.zip", Size: 10, Completed: time.Now()}
+	record.Failed["b"] = "timeout"
+	err = saveDirectRecord(tempdir, record)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	loaded, err := loadDirectRecord(tempdir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if (10 != loaded.Completed["a"].Size) || ("timeout" != loaded.Failed["b"]) {
+		t.Errorf("Got unexpected record %v", loaded)
+	}
+
+	// Written via a temporary file, which shouldn't be left behind
+	entries, err := os.ReadDir(tempdir)
+	if (nil != err) || (1 != len(entries)) || (directRecordName != entries[0].Name()) {
+		t.Errorf("Expected just the record in %s, got %v: %v", tempdir, entries, err)
+	}
+	info, err := os.Stat(path.Join(tempdir, directRecordName))
+	if (nil != err) || (0o644 != info.Mode().Perm()) {
+		t.Errorf("Expected record to be readable by all, got %v: %v", info, err)
+	}
+}
+
+func TestAlreadyDownloaded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	tempdir := t.TempDir()
+	localPath := path.Join(tempdir, "a.zip")
+	link, _ := url.Parse(server.URL + "/a.zip")
+
+	ctx := context.Background()
+	client := &Client{HTTPClient: server.Client()}
+	record := directRecord{
+		Completed: make(map[string]directFile),
+		Failed:    make(map[string]string),
+	}
+	if client.alreadyDownloaded(ctx, record, link, localPath, false) {
+		t.Errorf("Expected missing file to need downloading")
+	}
+
+	err := os.WriteFile(localPath, []byte("01234"), 0o644)
+	if nil != err {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if client.alreadyDownloaded(ctx, record, link, localPath, false) {
+		t.Errorf("Expected partial file to need downloading")
+	}
+
+	err = os.WriteFile(localPath, []byte("0123456789"), 0o644)
+	if nil != err {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if !client.alreadyDownloaded(ctx, record, link, localPath, false) {
+		t.Errorf("Expected file matching remote size to be skipped")
+	}
+	if client.alreadyDownloaded(ctx, record, link, localPath, true) {
+		t.Errorf("Expected extracted download with no record to need downloading")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if client.alreadyDownloaded(cancelled, record, link, localPath, false) {
+		t.Errorf("Expected file to need downloading if the server can't be asked")
+	}
+
+	record.Completed[directRecordKey(link)] = directFile{Filename: "a.zip"}
+	if !client.alreadyDownloaded(ctx, record, link, localPath, true) {
+		t.Errorf("Expected recorded extracted download to be skipped")
+	}
+}
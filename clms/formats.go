@@ -0,0 +1,93 @@
+package clms
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The CLMS servers can convert generated data between some formats, and
+// publish which conversions are possible as a table mapping each source
+// format to the target formats it can be turned into.
+type CLMSFormatConversionTable map[string]map[string]bool
+
+// OutputFormats returns the formats that can be requested for an item,
+// which is its own format plus anything that can be converted to from it.
+// If there is no conversion table then only the source format is returned.
+func (t CLMSFormatConversionTable) OutputFormats(info CLMSDownloadInfo) CLMSFullFormat {
+	formats := make(CLMSFullFormat, 0)
+	seen := make(map[string]bool)
+	add := func(format CLMSFormat) {
+		key := strings.ToLower(format.Token)
+		if !seen[key] {
+			seen[key] = true
+			formats = append(formats, format)
+		}
+	}
+
+	for _, source := range info.FullFormat {
+		add(source)
+		for tableSource, targets := range t {
+			if !strings.EqualFold(tableSource, source.Token) && !strings.EqualFold(tableSource, source.Title) {
+				continue
+			}
+			for target, allowed := range targets {
+				if allowed {
+					add(CLMSFormat{Token: target, Title: target})
+				}
+			}
+		}
+	}
+	return formats
+}
+
+func findDownload(dataset CLMSDataset, downloadID string) (CLMSDownloadInfo, bool) {
+	for _, info := range dataset.Downloads["items"] {
+		if info.ID == downloadID {
+			return info, true
+		}
+	}
+	return CLMSDownloadInfo{}, false
+}
+
+// ValidateGeneratedRequest checks that the requested output format and
+// coordinate system are ones the dataset says it can provide, so that we
+// fail before submitting rather than having the request fail server side.
+// It returns the format using the server's spelling of it. Where the
+// dataset doesn't tell us what it offers no check is made.
+func ValidateGeneratedRequest(
+	dataset CLMSDataset,
+	downloadID string,
+	outputFormat string,
+	coordinateSystem string,
+	table CLMSFormatConversionTable,
+) (string, error) {
+	info, ok := findDownload(dataset, downloadID)
+	if !ok {
+		return "", fmt.Errorf("dataset %s has no download item %s", dataset.UID, downloadID)
+	}
+
+	if 0 != len(info.FullFormat) {
+		available := table.OutputFormats(info)
+		format, ok := available.Find(outputFormat)
+		if ok {
+			outputFormat = format.Token
+		} else if nil != table {
+			return "", fmt.Errorf("format %s not available for %s, options are: %s", outputFormat, info.Name, strings.Join(available.Tokens(), ", "))
+		}
+	}
+
+	if 0 != len(dataset.CoordinateSystems) {
+		found := false
+		for _, crs := range dataset.CoordinateSystems {
+			if strings.EqualFold(crs, coordinateSystem) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("coordinate system %s not available for %s, options are: %s", coordinateSystem, dataset.Title, strings.Join(dataset.CoordinateSystems, ", "))
+		}
+	}
+
+	return outputFormat, nil
+}
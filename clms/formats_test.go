@@ -0,0 +1,111 @@
+package clms
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeFullFormat(t *testing.T) {
+	testcases := []struct {
+		raw      string
+		expected []string
+	}{
+		{`{"full_format": "GeoTIFF"}`, []string{"GeoTIFF"}},
+		{`{"full_format": {"token": "Shapefile", "title": "ESRI Shapefile"}}`, []string{"Shapefile"}},
+		{`{"full_format": {"title": "Netcdf"}}`, []string{"Netcdf"}},
+		{`{"full_format": ["GeoTIFF", {"token": "Netcdf", "title": "NetCDF"}]}`, []string{"GeoTIFF", "Netcdf"}},
+		{`{"full_format": null}`, []string{}},
+		{`{}`, []string{}},
+	}
+	for _, testcase := range testcases {
+		var info CLMSDownloadInfo
+		err := json.Unmarshal([]byte(testcase.raw), &info)
+		if nil != err {
+			t.Errorf("Expected no error decoding %s, got %v", testcase.raw, err)
+			continue
+		}
+		tokens := info.FullFormat.Tokens()
+		if len(tokens) != len(testcase.expected) {
+			t.Errorf("Expected %v from %s, got %v", testcase.expected, testcase.raw, tokens)
+			continue
+		}
+		for idx, token := range tokens {
+			if token != testcase.expected[idx] {
+				t.Errorf("Expected %v from %s, got %v", testcase.expected, testcase.raw, tokens)
+				break
+			}
+		}
+	}
+
+	var info CLMSDownloadInfo
+	err := json.Unmarshal([]byte(`{"full_format": 42}`), &info)
+	if nil == err {
+		t.Errorf("Expected error decoding numeric format")
+	}
+}
+
+func TestFullFormatSurvivesCache(t *testing.T) {
+	original := CLMSDownloadInfo{
+		FullFormat: CLMSFullFormat{{Token: "Shapefile", Title: "ESRI Shapefile"}},
+	}
+	encoded, err := json.Marshal(original)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var decoded CLMSDownloadInfo
+	err = json.Unmarshal(encoded, &decoded)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if (1 != len(decoded.FullFormat)) || (decoded.FullFormat[0] != original.FullFormat[0]) {
+		t.Errorf("Expected %v, got %v", original.FullFormat, decoded.FullFormat)
+	}
+}
+
+func TestValidateGeneratedRequest(t *testing.T) {
+	dataset := CLMSDataset{
+		UID:               "clc",
+		Title:             "CORINE Land Cover",
+		CoordinateSystems: []string{"EPSG:3035", "EPSG:4326"},
+		Downloads: map[string][]CLMSDownloadInfo{
+			"items": {
+				{ID: "raster", Name: "Raster", FullFormat: CLMSFullFormat{{Token: "GeoTIFF", Title: "GeoTIFF"}}},
+				{ID: "unknown", Name: "Unknown"},
+			},
+		},
+	}
+	table := CLMSFormatConversionTable{
+		"GeoTIFF": {"GeoTIFF": true, "Netcdf": true, "Shapefile": false},
+	}
+
+	testcases := []struct {
+		downloadID string
+		format     string
+		crs        string
+		table      CLMSFormatConversionTable
+		expected   string
+		fails      bool
+	}{
+		{"raster", "Geotiff", "EPSG:4326", table, "GeoTIFF", false},
+		{"raster", "netcdf", "epsg:3035", table, "Netcdf", false},
+		{"raster", "Shapefile", "EPSG:4326", table, "", true},
+		{"raster", "GeoTIFF", "EPSG:27700", table, "", true},
+		{"raster", "Shapefile", "EPSG:4326", nil, "Shapefile", false},
+		{"unknown", "Shapefile", "EPSG:4326", table, "Shapefile", false},
+		{"missing", "GeoTIFF", "EPSG:4326", table, "", true},
+	}
+	for idx, testcase := range testcases {
+		format, err := ValidateGeneratedRequest(dataset, testcase.downloadID, testcase.format, testcase.crs, testcase.table)
+		if testcase.fails {
+			if nil == err {
+				t.Errorf("Case %d: expected error, got %s", idx, format)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("Case %d: expected no error, got %v", idx, err)
+		} else if format != testcase.expected {
+			t.Errorf("Case %d: expected %s, got %s", idx, testcase.expected, format)
+		}
+	}
+}
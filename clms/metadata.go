@@ -0,0 +1,146 @@
+package clms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+)
+
+// Where to fetch the ISO 19139 XML record for a dataset from each of the
+// metadata catalogues CLMS refers to.
+var geonetworkRecordTemplates = map[string]string{
+	"EEA":  "https://sdi.eea.europa.eu/catalogue/srv/api/records/%s/formatters/xml",
+	"VITO": "https://land.copernicus.vgt.vito.be/geonetwork/srv/api/records/%s/formatters/xml",
+}
+
+// A metadata document to save, along with the name to save it as.
+type metadataDocument struct {
+	Filename string
+	URL      string
+}
+
+// metadataDocuments works out which documents to fetch for a dataset and
+// what to call them. Names are prefixed with the dataset UID so that the
+// metadata for several datasets can live in the same directory:
+//
+//	<uid>-metadata.json        the CLMS catalogue record
+//	<uid>-iso19139-<id>.xml    the INSPIRE/ISO record from GeoNetwork
+//	<uid>-<name>               any other documents CLMS links to
+func metadataDocuments(uid string, identifiers CLMSGeonetworkIdentifiers, extraURLs []string) []metadataDocument {
+	documents := make([]metadataDocument, 0)
+	for _, identifier := range identifiers.Items {
+		template, ok := geonetworkRecordTemplates[strings.ToUpper(identifier.Type)]
+		if !ok || ("" == identifier.ID) {
+			continue
+		}
+		documents = append(documents, metadataDocument{
+			Filename: fmt.Sprintf("%s-iso19139-%s.xml", uid, unsafeDirNameChars.ReplaceAllString(identifier.ID, "_")),
+			URL:      fmt.Sprintf(template, url.PathEscape(identifier.ID)),
+		})
+	}
+	for _, extra := range extraURLs {
+		parsed, err := url.Parse(extra)
+		if (nil != err) || (("http" != parsed.Scheme) && ("https" != parsed.Scheme)) {
+			continue
+		}
+		name := unsafeDirNameChars.ReplaceAllString(path.Base(parsed.Path), "_")
+		if ("" == name) || ("." == name) || ("_" == name) {
+			name = "metadata"
+		}
+		documents = append(documents, metadataDocument{
+			Filename: fmt.Sprintf("%s-%s", uid, name),
+			URL:      extra,
+		})
+	}
+	return documents
+}
+
+// The output path might be a directory or a filename, and metadata goes
+// in the directory either way.
+func metadataDir(outputPath string) (string, error) {
+	if "" == outputPath {
+		return os.Getwd()
+	}
+	info, err := os.Stat(outputPath)
+	if (nil == err) && info.IsDir() {
+		return outputPath, nil
+	}
+	return path.Dir(outputPath), nil
+}
+
+// SaveDatasetMetadata writes the catalogue record for a dataset and
+// fetches any associated metadata documents into the output directory.
+func (c *Client) SaveDatasetMetadata(
+	ctx context.Context,
+	uid string,
+	record interface{},
+	identifiers CLMSGeonetworkIdentifiers,
+	extraURLs []string,
+	outputPath string,
+) error {
+	dir, err := metadataDir(outputPath)
+	if nil != err {
+		return fmt.Errorf("failed to find metadata directory: %w", err)
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if nil != err {
+		return fmt.Errorf("failed to make metadata directory: %w", err)
+	}
+
+	encoded, err := json.MarshalIndent(record, "", "  ")
+	if nil != err {
+		return fmt.Errorf("failed to encode dataset record: %w", err)
+	}
+	recordPath := path.Join(dir, fmt.Sprintf("%s-metadata.json", uid))
+	err = os.WriteFile(recordPath, encoded, 0o644)
+	if nil != err {
+		return fmt.Errorf("failed to write dataset record: %w", err)
+	}
+
+	for _, document := range metadataDocuments(uid, identifiers, extraURLs) {
+		err = utils.Download{
+			URL:         document.URL,
+			Filename:    document.Filename,
+			Destination: path.Join(dir, document.Filename),
+			HTTPClient:  c.HTTPClient,
+		}.Fetch(ctx)
+		if nil != err {
+			return fmt.Errorf("failed to fetch metadata %s: %w", document.URL, err)
+		}
+	}
+	return nil
+}
+
+// saveTaskMetadata saves metadata for each dataset in a finished request.
+// The request only has the dataset ID, so we look the dataset up in the
+// catalogue to find where its ISO record lives.
+func (c *Client) saveTaskMetadata(ctx context.Context, status CLMSTaskStatus, outputPath string) error {
+	for _, dataset := range status.Datasets {
+		var record interface{} = dataset
+		var identifiers CLMSGeonetworkIdentifiers
+
+		generated, found, err := c.FindGeneratedDataset(ctx, dataset.DatasetID, false)
+		if (nil == err) && found {
+			record = generated
+			identifiers = generated.GeonetworkIdentifiers
+		} else {
+			prepackaged, found, err := c.FindPrepackagedDataset(ctx, dataset.DatasetID, false)
+			if (nil == err) && found {
+				record = prepackaged
+				identifiers = prepackaged.GeonetworkIdentifiers
+			}
+		}
+
+		err = c.SaveDatasetMetadata(ctx, dataset.DatasetID, record, identifiers, dataset.Metadata, outputPath)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package clms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMetadataDocumentNames(t *testing.T) {
+	identifiers := CLMSGeonetworkIdentifiers{
+		Items: []CLMSGeonetworkIdentifier{
+			{ID: "abc-123", Type: "EEA"},
+			{ID: "def", Type: "vito"},
+			{ID: "ghi", Type: "Unknown"},
+		},
+	}
+	extra := []string{
+		"https://example.com/docs/product_user_manual.pdf",
+		"not a url",
+	}
+	documents := metadataDocuments("uid", identifiers, extra)
+	expected := []metadataDocument{
+		{"uid-iso19139-abc-123.xml", "https://sdi.eea.europa.eu/catalogue/srv/api/records/abc-123/formatters/xml"},
+		{"uid-iso19139-def.xml", "https://land.copernicus.vgt.vito.be/geonetwork/srv/api/records/def/formatters/xml"},
+		{"uid-product_user_manual.pdf", "https://example.com/docs/product_user_manual.pdf"},
+	}
+	if len(documents) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, documents)
+	}
+	for idx, document := range documents {
+		if document != expected[idx] {
+			t.Errorf("Expected %v, got %v", expected[idx], document)
+		}
+	}
+}
+
+func TestSaveDatasetMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<xml/>"))
+	}))
+	defer server.Close()
+
+	tempdir := t.TempDir()
+	dataset := CLMSDataset{UID: "uid", Title: "Test"}
+	err := (&Client{}).SaveDatasetMetadata(context.Background(), "uid", dataset, dataset.GeonetworkIdentifiers, []string{server.URL + "/record.xml"}, tempdir)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, name := range []string{"uid-metadata.json", "uid-record.xml"} {
+		_, err := os.Stat(path.Join(tempdir, name))
+		if nil != err {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package clms
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PollOptions control how we wait for a data request to be processed. The
+// interval between status checks starts at Interval and grows by Backoff
+// each time up to MaxInterval, as some requests take hours and there's no
+// point hammering the server. A zero Timeout means wait forever.
+type PollOptions struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	Backoff     float64
+	Timeout     time.Duration
+}
+
+var DefaultPollOptions = PollOptions{
+	Interval:    5 * time.Second,
+	MaxInterval: 5 * time.Minute,
+	Backoff:     1.5,
+	Timeout:     0,
+}
+
+func addPollFlags(flag *flag.FlagSet) *PollOptions {
+	options := DefaultPollOptions
+	flag.DurationVar(&options.Interval, "poll", options.Interval, "Initial interval between checks on request status.")
+	flag.DurationVar(&options.MaxInterval, "max-poll", options.MaxInterval, "Longest interval between checks on request status.")
+	flag.Float64Var(&options.Backoff, "backoff", options.Backoff, "Factor the interval between checks grows by each time, up to -max-poll. 1 keeps it constant.")
+	flag.DurationVar(&options.Timeout, "timeout", options.Timeout, "Give up waiting for the request after this long. Zero waits forever.")
+	return &options
+}
+
+func (p PollOptions) next(current time.Duration) time.Duration {
+	if p.Backoff > 1.0 {
+		current = time.Duration(float64(current) * p.Backoff)
+	}
+	if (p.MaxInterval > 0) && (current > p.MaxInterval) {
+		current = p.MaxInterval
+	}
+	return current
+}
+
+func formatElapsed(elapsed time.Duration) string {
+	elapsed = elapsed.Round(time.Second)
+	hours := elapsed / time.Hour
+	minutes := (elapsed % time.Hour) / time.Minute
+	seconds := (elapsed % time.Minute) / time.Second
+	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+}
+
+// progressLine redraws a single status line in place when writing to a
+// terminal, and writes one line per update otherwise so logs stay readable.
+type progressLine struct {
+	interactive bool
+	lastWidth   int
+}
+
+func newProgressLine() *progressLine {
+	interactive := false
+	info, err := os.Stdout.Stat()
+	if nil == err {
+		interactive = 0 != (info.Mode() & os.ModeCharDevice)
+	}
+	return &progressLine{interactive: interactive}
+}
+
+func (p *progressLine) update(elapsed time.Duration, status string) {
+	line := fmt.Sprintf("[%s] %s: %s", formatElapsed(elapsed), status, DescribeTaskStatus(status))
+	if !p.interactive {
+		fmt.Printf("%s\n", line)
+		return
+	}
+	padding := ""
+	if len(line) < p.lastWidth {
+		padding = strings.Repeat(" ", p.lastWidth-len(line))
+	}
+	p.lastWidth = len(line)
+	fmt.Printf("\r%s%s", line, padding)
+}
+
+func (p *progressLine) done() {
+	if p.interactive && (p.lastWidth > 0) {
+		fmt.Printf("\n")
+	}
+	p.lastWidth = 0
+}
@@ -0,0 +1,57 @@
+package clms
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestPollBackoff(t *testing.T) {
+	options := PollOptions{
+		Interval:    time.Second,
+		MaxInterval: 4 * time.Second,
+		Backoff:     2.0,
+	}
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second}
+	interval := options.Interval
+	for idx, want := range expected {
+		interval = options.next(interval)
+		if interval != want {
+			t.Errorf("Step %d: expected %v, got %v", idx, want, interval)
+		}
+	}
+
+	options.Backoff = 0
+	if options.next(time.Second) != time.Second {
+		t.Errorf("Expected no backoff to keep the interval constant")
+	}
+}
+
+func TestPollFlags(t *testing.T) {
+	flagset := flag.NewFlagSet("test", flag.ContinueOnError)
+	options := addPollFlags(flagset)
+	err := flagset.Parse([]string{"-poll", "1s", "-backoff", "3"})
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if (time.Second != options.Interval) || (3.0 != options.Backoff) || (DefaultPollOptions.MaxInterval != options.MaxInterval) {
+		t.Errorf("Got unexpected options %+v", options)
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	testcases := []struct {
+		elapsed  time.Duration
+		expected string
+	}{
+		{0, "00:00:00"},
+		{1500 * time.Millisecond, "00:00:02"},
+		{(2 * time.Hour) + (3 * time.Minute) + (4 * time.Second), "02:03:04"},
+	}
+	for _, testcase := range testcases {
+		result := formatElapsed(testcase.elapsed)
+		if result != testcase.expected {
+			t.Errorf("Expected %s for %v, got %s", testcase.expected, testcase.elapsed, result)
+		}
+	}
+}
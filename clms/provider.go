@@ -0,0 +1,204 @@
+package clms
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+// Provider makes CLMS available through reclaimer's provider registry. Its
+// command line is the clms verbs, but it also presents datasets as records
+// whose items are requested and waited for, which is how the fetch verb
+// gets CLMS data the same way as everything else.
+type Provider struct {
+	// Used if set, otherwise one is made with the usual credentials.
+	Client *Client
+
+	lock        sync.Mutex
+	credentials *credentialFlags
+}
+
+func (p *Provider) Name() string {
+	return "clms"
+}
+
+func (p *Provider) Description() string {
+	return "Copernicus Land Monitoring Service datasets"
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	p.credentials = addCredentialFlags(flagset)
+}
+
+func (p *Provider) client() (*Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if nil == p.Client {
+		credentials := credentialFlags{FD: -1}
+		if nil != p.credentials {
+			credentials = *p.credentials
+		}
+		client, err := newClient(credentials)
+		if nil != err {
+			return nil, err
+		}
+		p.Client = client
+	}
+	return p.Client, nil
+}
+
+// Searching doesn't need credentials, so don't insist on them just to
+// resolve a dataset.
+func (p *Provider) searchClient() *Client {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if nil != p.Client {
+		return p.Client
+	}
+	return &Client{Logger: newCLILogger()}
+}
+
+// Resolve takes a dataset UID, and lists the dataset's items as files.
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	err := configureEndpoints()
+	if nil != err {
+		return provider.Record{}, err
+	}
+	client := p.searchClient()
+	dataset, found, err := client.FindGeneratedDataset(ctx, identifier, false)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	if found {
+		record := provider.Record{ID: dataset.UID, Title: dataset.Title}
+		for _, info := range (SearchFilter{}).FilterDownloads(dataset) {
+			record.Files = append(record.Files, provider.File{ID: info.ID, Name: info.Name, Async: true})
+		}
+		return record, nil
+	}
+
+	prepackaged, found, err := client.FindPrepackagedDataset(ctx, identifier, false)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	if !found {
+		return provider.Record{}, fmt.Errorf("no dataset with UID %s", identifier)
+	}
+	record := provider.Record{
+		ID:      prepackaged.UID,
+		Title:   prepackaged.Title,
+		Details: []provider.Detail{{Name: "prepackaged", Value: "true"}},
+	}
+	for _, info := range (SearchFilter{}).FilterFiles(prepackaged) {
+		record.Files = append(record.Files, provider.File{ID: info.ID, Name: info.File, Async: true})
+	}
+	return record, nil
+}
+
+// Request asks for an item in its first format and the dataset's default
+// coordinate system. For anything more particular use the download verb.
+func (p *Provider) Request(ctx context.Context, record provider.Record, file provider.File) (string, error) {
+	client, err := p.client()
+	if nil != err {
+		return "", err
+	}
+
+	var task CLMSTaskResponse
+	dataset, found, err := client.FindGeneratedDataset(ctx, record.ID, false)
+	if nil != err {
+		return "", err
+	}
+	if found {
+		spec := GeneratedRequestSpec(dataset, SearchFilter{})
+		spec.DownloadID = file.ID
+		spec.Options = nil
+		for _, info := range dataset.Downloads["items"] {
+			if (info.ID == file.ID) && (0 != len(info.FullFormat)) {
+				spec.Format = info.FullFormat[0].Token
+			}
+		}
+		task, err = client.RequestGeneratedData(ctx, spec)
+	} else {
+		task, err = client.RequestPrepackagedData(ctx, record.ID, file.ID)
+	}
+	if nil != err {
+		return "", err
+	}
+	if len(task.ErrorTaskIDs) > 0 {
+		return "", fmt.Errorf("only got error for tasks.")
+	}
+	if len(task.TaskIDs) != 1 {
+		return "", fmt.Errorf("expected one task, got %d", len(task.TaskIDs))
+	}
+	taskID := task.TaskIDs[0].ID
+
+	// So that it can be picked up with the resume verb if we're interrupted
+	err = UpdateTaskRecord(taskID, func(taskRecord *TaskRecord) {
+		taskRecord.DatasetID = record.ID
+		taskRecord.Requested = time.Now()
+	})
+	if nil != err {
+		client.logger().Warn("failed to record request", "task", taskID, "error", err)
+	}
+	return taskID, nil
+}
+
+func (p *Provider) Poll(ctx context.Context, taskID string) (provider.File, bool, error) {
+	client, err := p.client()
+	if nil != err {
+		return provider.File{}, false, err
+	}
+	status, err := client.TaskStatus(ctx, taskID)
+	if nil != err {
+		return provider.File{}, false, err
+	}
+	err = CheckTaskStatus(taskID, status)
+	if nil != err {
+		if IsTaskPending(err) {
+			return provider.File{}, false, nil
+		}
+		return provider.File{}, false, err
+	}
+	if "" == status.DownloadURL {
+		return provider.File{}, false, fmt.Errorf("got an empty download URL for task")
+	}
+	downloadURL, err := url.Parse(status.DownloadURL)
+	if nil != err {
+		return provider.File{}, false, fmt.Errorf("failed to parse download url: %w", err)
+	}
+	return provider.File{
+		Name: path.Base(downloadURL.Path),
+		Size: status.FileSize,
+		URL:  status.DownloadURL,
+	}, true, nil
+}
+
+// Command runs the clms verbs.
+func (p *Provider) Command(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("Supported verbs are:\n")
+		for cmd := range verbs {
+			fmt.Printf("\t%s\n", cmd)
+		}
+		return nil
+	}
+
+	cmd, args := args[0], args[1:]
+
+	err := configureEndpoints()
+	if nil != err {
+		return err
+	}
+
+	subcmd, ok := verbs[cmd]
+	if !ok {
+		return fmt.Errorf("unrecognised verb %s, options are: %s", cmd, verbNames())
+	}
+	return subcmd(ctx, args)
+}
@@ -0,0 +1,53 @@
+package clms
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestProviderResolve(t *testing.T) {
+	newTestServer(t)
+
+	record, err := (&Provider{}).Resolve(context.Background(), "uid-corine")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if 2 != len(record.Files) {
+		t.Fatalf("expected two files, got %+v", record.Files)
+	}
+	if ("dl-raster" != record.Files[0].ID) || !record.Files[0].Async {
+		t.Errorf("unexpected file %+v", record.Files[0])
+	}
+
+	_, err = (&Provider{}).Resolve(context.Background(), "no-such-uid")
+	if nil == err {
+		t.Errorf("expected error for unknown dataset")
+	}
+}
+
+func TestProviderFetch(t *testing.T) {
+	server := newTestServer(t)
+	output := t.TempDir()
+
+	err := provider.Run(context.Background(), &Provider{}, []string{
+		"-files", "CLC 2018 raster 100m",
+		"-extract",
+		"-output", output,
+		"-poll-interval", "1ms",
+		"uid-corine",
+	})
+	if nil != err {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	if _, ok := server.Task("task0001"); !ok {
+		t.Fatalf("expected a request to have been made")
+	}
+	if _, err := os.Stat(path.Join(output, "task0001.txt")); nil != err {
+		t.Errorf("expected extracted file: %v", err)
+	}
+}
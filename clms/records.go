@@ -0,0 +1,86 @@
+package clms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+const taskRecordsCacheName = "clms-tasks.json"
+
+// TaskRecord is our local note of a data request we've made, so that it
+// can be picked up again later without having to copy task IDs around.
+type TaskRecord struct {
+	TaskID    string    `json:"task_id"`
+	DatasetID string    `json:"dataset_id"`
+	Requested time.Time `json:"requested"`
+	Output    string    `json:"output,omitempty"`
+	Extract   bool      `json:"extract,omitempty"`
+	// Zero until the data has been downloaded
+	Downloaded   time.Time `json:"downloaded"`
+	DownloadedTo string    `json:"downloaded_to,omitempty"`
+}
+
+// Several downloads may finish at once, and each will want to update the
+// records file.
+var taskRecordsLock sync.Mutex
+
+func LoadTaskRecords() (map[string]TaskRecord, error) {
+	taskRecordsLock.Lock()
+	defer taskRecordsLock.Unlock()
+	return loadTaskRecords()
+}
+
+func loadTaskRecords() (map[string]TaskRecord, error) {
+	records := make(map[string]TaskRecord)
+
+	recordsPath, err := cacheFilePath(taskRecordsCacheName)
+	if nil != err {
+		return nil, err
+	}
+	contents, err := os.ReadFile(recordsPath)
+	if nil != err {
+		if errors.Is(err, fs.ErrNotExist) {
+			return records, nil
+		}
+		return nil, fmt.Errorf("failed to read task records: %w", err)
+	}
+
+	err = json.Unmarshal(contents, &records)
+	if nil != err {
+		return nil, fmt.Errorf("failed to parse task records %s: %w", recordsPath, err)
+	}
+	return records, nil
+}
+
+// UpdateTaskRecord applies the update to the record for a task, creating
+// it if it doesn't exist yet, and saves the result.
+func UpdateTaskRecord(taskID string, update func(record *TaskRecord)) error {
+	taskRecordsLock.Lock()
+	defer taskRecordsLock.Unlock()
+
+	records, err := loadTaskRecords()
+	if nil != err {
+		return err
+	}
+	record, ok := records[taskID]
+	if !ok {
+		record = TaskRecord{TaskID: taskID}
+	}
+	update(&record)
+	records[taskID] = record
+
+	contents, err := json.MarshalIndent(records, "", "  ")
+	if nil != err {
+		return fmt.Errorf("failed to encode task records: %w", err)
+	}
+	recordsPath, err := cacheFilePath(taskRecordsCacheName)
+	if nil != err {
+		return err
+	}
+	return writeCacheFile(recordsPath, contents)
+}
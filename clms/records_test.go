@@ -0,0 +1,42 @@
+package clms
+
+import (
+	"testing"
+)
+
+func TestTaskRecords(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	records, err := LoadTaskRecords()
+	if nil != err {
+		t.Fatalf("Expected no error with no records, got %v", err)
+	}
+	if 0 != len(records) {
+		t.Errorf("Expected no records, got %v", records)
+	}
+
+	err = UpdateTaskRecord("abc", func(record *TaskRecord) {
+		record.DatasetID = "dataset"
+	})
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = UpdateTaskRecord("abc", func(record *TaskRecord) {
+		record.Output = "somewhere"
+	})
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	records, err = LoadTaskRecords()
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	record, ok := records["abc"]
+	if !ok {
+		t.Fatalf("Expected record for task")
+	}
+	if ("abc" != record.TaskID) || ("dataset" != record.DatasetID) || ("somewhere" != record.Output) {
+		t.Errorf("Got unexpected record %v", record)
+	}
+}
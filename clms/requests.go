@@ -0,0 +1,246 @@
+package clms
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"quantify.earth/reclaimer/internal/utils"
+)
+
+// CLMS doesn't include a timezone offset on its timestamps, and isn't
+// consistent about fractional seconds, so try a few layouts.
+var clmsTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseCLMSTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range clmsTimeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if nil == err {
+			return parsed, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// RequestRow is a single line in the requests listing. A request can be
+// for several datasets, in which case it gets one row per dataset.
+type RequestRow struct {
+	TaskID  string          `json:"task_id"`
+	Status  CLMSTaskStatus  `json:"status"`
+	Dataset CLMSTaskDataset `json:"dataset"`
+}
+
+func (r RequestRow) Registered() (time.Time, bool) {
+	return parseCLMSTime(r.Status.RegistrationDateTime)
+}
+
+func (r RequestRow) format() string {
+	if "" != r.Dataset.OutputFormat {
+		return r.Dataset.OutputFormat
+	}
+	return r.Dataset.DatasetFormat
+}
+
+// RequestFilter selects which requests to show. Statuses matches any of
+// the listed states, Dataset matches either the dataset ID or part of its
+// title, and Since matches requests registered at or after that time.
+type RequestFilter struct {
+	Statuses []string
+	Dataset  string
+	Since    time.Time
+}
+
+// ParseSince accepts either a date, a date and time, or a duration which
+// is taken as that long ago.
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if "" == value {
+		return time.Time{}, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if nil == err {
+		return now.Add(-duration), nil
+	}
+	parsed, ok := parseCLMSTime(value)
+	if !ok {
+		return time.Time{}, fmt.Errorf("expected date (YYYY-MM-DD) or duration (e.g. 48h), got %s", value)
+	}
+	return parsed, nil
+}
+
+func (f RequestFilter) matches(row RequestRow) bool {
+	if 0 != len(f.Statuses) {
+		found := false
+		for _, status := range f.Statuses {
+			if strings.EqualFold(status, row.Status.Status) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if "" != f.Dataset {
+		if (f.Dataset != row.Dataset.DatasetID) && !containsFold(row.Dataset.DatasetTitle, f.Dataset) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() {
+		registered, ok := row.Registered()
+		if !ok || registered.Before(f.Since) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterRequests flattens the requests into rows and returns those that
+// match the filter.
+func FilterRequests(statuses map[string]CLMSTaskStatus, filter RequestFilter) []RequestRow {
+	rows := make([]RequestRow, 0)
+	for taskID, status := range statuses {
+		// Cancelled requests can come back with no datasets, but we
+		// still want to see them
+		if 0 == len(status.Datasets) {
+			row := RequestRow{TaskID: taskID, Status: status}
+			if filter.matches(row) {
+				rows = append(rows, row)
+			}
+		}
+		for _, dataset := range status.Datasets {
+			row := RequestRow{TaskID: taskID, Status: status, Dataset: dataset}
+			if filter.matches(row) {
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+type requestColumn struct {
+	header string
+	value  func(RequestRow) string
+	less   func(a RequestRow, b RequestRow) bool
+}
+
+func lessString(value func(RequestRow) string) func(a RequestRow, b RequestRow) bool {
+	return func(a RequestRow, b RequestRow) bool {
+		return value(a) < value(b)
+	}
+}
+
+var requestColumns = map[string]requestColumn{
+	"id": {
+		header: "Request ID",
+		value:  func(r RequestRow) string { return r.TaskID },
+	},
+	"dataset": {
+		header: "Dataset ID",
+		value:  func(r RequestRow) string { return r.Dataset.DatasetID },
+	},
+	"title": {
+		header: "Title",
+		value:  func(r RequestRow) string { return r.Dataset.DatasetTitle },
+	},
+	"status": {
+		header: "Status",
+		value:  func(r RequestRow) string { return r.Status.Status },
+	},
+	"format": {
+		header: "Format",
+		value:  RequestRow.format,
+	},
+	"size": {
+		header: "Size",
+		value: func(r RequestRow) string {
+			if 0 == r.Status.FileSize {
+				return ""
+			}
+			return utils.FormatSize(r.Status.FileSize)
+		},
+		less: func(a RequestRow, b RequestRow) bool { return a.Status.FileSize < b.Status.FileSize },
+	},
+	"registered": {
+		header: "Registered",
+		value:  func(r RequestRow) string { return r.Status.RegistrationDateTime },
+		less: func(a RequestRow, b RequestRow) bool {
+			at, _ := a.Registered()
+			bt, _ := b.Registered()
+			return at.Before(bt)
+		},
+	},
+	"url": {
+		header: "Download URL",
+		value:  func(r RequestRow) string { return r.Status.DownloadURL },
+	},
+	"message": {
+		header: "Message",
+		value:  func(r RequestRow) string { return r.Status.Message },
+	},
+}
+
+const DefaultRequestColumns = "id,title,status,size,registered"
+
+func RequestColumnNames() []string {
+	names := make([]string, 0, len(requestColumns))
+	for name := range requestColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseRequestColumns(spec string) ([]requestColumn, error) {
+	columns := make([]requestColumn, 0)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if "" == name {
+			continue
+		}
+		column, ok := requestColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s, options are: %s", name, strings.Join(RequestColumnNames(), ", "))
+		}
+		columns = append(columns, column)
+	}
+	if 0 == len(columns) {
+		return nil, fmt.Errorf("no columns specified")
+	}
+	return columns, nil
+}
+
+// SortRequests orders rows by the named column, falling back on request
+// ID so that the order is stable between runs.
+func SortRequests(rows []RequestRow, by string, reverse bool) error {
+	column, ok := requestColumns[strings.ToLower(by)]
+	if !ok {
+		return fmt.Errorf("unknown sort column %s, options are: %s", by, strings.Join(RequestColumnNames(), ", "))
+	}
+	less := column.less
+	if nil == less {
+		less = lessString(column.value)
+	}
+	sort.SliceStable(rows, func(i int, j int) bool {
+		a, b := rows[i], rows[j]
+		if reverse {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.TaskID < b.TaskID
+	})
+	return nil
+}
@@ -0,0 +1,121 @@
+package clms
+
+import (
+	"testing"
+	"time"
+)
+
+var testRequests = map[string]CLMSTaskStatus{
+	"a": {
+		Status:               TaskFinished,
+		FileSize:             2048,
+		RegistrationDateTime: "2024-08-01T10:00:00.123456",
+		Datasets:             []CLMSTaskDataset{{DatasetID: "clc", DatasetTitle: "CORINE Land Cover 2018"}},
+	},
+	"b": {
+		Status:               TaskInProgress,
+		RegistrationDateTime: "2024-08-03T10:00:00",
+		Datasets:             []CLMSTaskDataset{{DatasetID: "tcd", DatasetTitle: "Tree Cover Density"}},
+	},
+	"c": {
+		Status:               TaskCancelled,
+		RegistrationDateTime: "2024-07-01T10:00:00",
+	},
+}
+
+func rowIDs(rows []RequestRow) []string {
+	ids := make([]string, len(rows))
+	for idx, row := range rows {
+		ids[idx] = row.TaskID
+	}
+	return ids
+}
+
+func TestFilterRequests(t *testing.T) {
+	testcases := []struct {
+		filter   RequestFilter
+		expected []string
+	}{
+		{RequestFilter{}, []string{"c", "a", "b"}},
+		{RequestFilter{Statuses: []string{"finished_ok", "Cancelled"}}, []string{"c", "a"}},
+		{RequestFilter{Dataset: "tcd"}, []string{"b"}},
+		{RequestFilter{Dataset: "corine"}, []string{"a"}},
+		{RequestFilter{Since: time.Date(2024, 8, 2, 0, 0, 0, 0, time.UTC)}, []string{"b"}},
+	}
+	for idx, testcase := range testcases {
+		rows := FilterRequests(testRequests, testcase.filter)
+		err := SortRequests(rows, "registered", false)
+		if nil != err {
+			t.Fatalf("Expected no error sorting, got %v", err)
+		}
+		ids := rowIDs(rows)
+		if len(ids) != len(testcase.expected) {
+			t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, ids)
+			continue
+		}
+		for jdx, id := range ids {
+			if id != testcase.expected[jdx] {
+				t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestSortRequests(t *testing.T) {
+	rows := FilterRequests(testRequests, RequestFilter{})
+	err := SortRequests(rows, "size", true)
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if "a" != rows[0].TaskID {
+		t.Errorf("Expected largest first, got %v", rowIDs(rows))
+	}
+
+	err = SortRequests(rows, "colour", false)
+	if nil == err {
+		t.Errorf("Expected error for unknown column")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 8, 10, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		value    string
+		expected time.Time
+		fails    bool
+	}{
+		{"", time.Time{}, false},
+		{"48h", time.Date(2024, 8, 8, 12, 0, 0, 0, time.UTC), false},
+		{"2024-08-01", time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC), false},
+		{"last week", time.Time{}, true},
+	}
+	for _, testcase := range testcases {
+		result, err := ParseSince(testcase.value, now)
+		if testcase.fails {
+			if nil == err {
+				t.Errorf("Expected error for %q", testcase.value)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("Expected no error for %q, got %v", testcase.value, err)
+		} else if !result.Equal(testcase.expected) {
+			t.Errorf("Expected %v for %q, got %v", testcase.expected, testcase.value, result)
+		}
+	}
+}
+
+func TestParseRequestColumns(t *testing.T) {
+	columns, err := parseRequestColumns(DefaultRequestColumns)
+	if nil != err {
+		t.Fatalf("Expected default columns to parse, got %v", err)
+	}
+	if 5 != len(columns) {
+		t.Errorf("Expected 5 columns, got %d", len(columns))
+	}
+	_, err = parseRequestColumns("id,colour")
+	if nil == err {
+		t.Errorf("Expected error for unknown column")
+	}
+}
@@ -0,0 +1,95 @@
+package clms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var unsafeDirNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// datasetDirName makes a directory name for a request's data from the
+// dataset title, falling back on IDs if there isn't one.
+func datasetDirName(row RequestRow) string {
+	name := strings.Trim(unsafeDirNameChars.ReplaceAllString(row.Dataset.DatasetTitle, "_"), "_.")
+	if "" == name {
+		name = strings.Trim(unsafeDirNameChars.ReplaceAllString(row.Dataset.DatasetID, "_"), "_.")
+	}
+	if "" == name {
+		name = strings.Trim(unsafeDirNameChars.ReplaceAllString(row.TaskID, "_"), "_.")
+	}
+	return name
+}
+
+// pendingDownloads picks out one row per finished request that we don't
+// have a record of having downloaded already.
+func pendingDownloads(rows []RequestRow, records map[string]TaskRecord, force bool) []RequestRow {
+	pending := make([]RequestRow, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if seen[row.TaskID] {
+			continue
+		}
+		seen[row.TaskID] = true
+		if TaskFinished != row.Status.Status {
+			continue
+		}
+		if record, ok := records[row.TaskID]; ok && !record.Downloaded.IsZero() && !force {
+			continue
+		}
+		pending = append(pending, row)
+	}
+	return pending
+}
+
+// downloadAllFinished fetches every finished request into a directory per
+// dataset under outputPath, a few at a time.
+func downloadAllFinished(ctx context.Context, client *Client, rows []RequestRow, extract bool, metadata bool, outputPath string, parallel int) error {
+	if "" == outputPath {
+		cwd, err := os.Getwd()
+		if nil != err {
+			return fmt.Errorf("failed to look up cwd: %w", err)
+		}
+		outputPath = cwd
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	failures := make([]error, 0)
+	semaphore := make(chan struct{}, parallel)
+	for _, row := range rows {
+		wg.Add(1)
+		go func(row RequestRow) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			destination := path.Join(outputPath, datasetDirName(row))
+			err := os.MkdirAll(destination, os.ModePerm)
+			if nil == err {
+				err = downloadFinishedTask(ctx, client, row.TaskID, row.Status, extract, metadata, destination)
+			}
+			if nil != err {
+				lock.Lock()
+				failures = append(failures, fmt.Errorf("%s: %w", row.TaskID, err))
+				lock.Unlock()
+				return
+			}
+			fmt.Printf("Downloaded %s to %s\n", row.TaskID, destination)
+		}(row)
+	}
+	wg.Wait()
+
+	if 0 != len(failures) {
+		return fmt.Errorf("failed to download %d of %d requests: %w", len(failures), len(rows), errors.Join(failures...))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package clms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatasetDirName(t *testing.T) {
+	testcases := []struct {
+		row      RequestRow
+		expected string
+	}{
+		{RequestRow{TaskID: "t", Dataset: CLMSTaskDataset{DatasetID: "d", DatasetTitle: "CORINE Land Cover 2018 (raster 100 m)"}}, "CORINE_Land_Cover_2018_raster_100_m"},
+		{RequestRow{TaskID: "t", Dataset: CLMSTaskDataset{DatasetID: "d", DatasetTitle: "../../etc"}}, "etc"},
+		{RequestRow{TaskID: "t", Dataset: CLMSTaskDataset{DatasetID: "d"}}, "d"},
+		{RequestRow{TaskID: "t"}, "t"},
+	}
+	for _, testcase := range testcases {
+		result := datasetDirName(testcase.row)
+		if result != testcase.expected {
+			t.Errorf("Expected %s, got %s", testcase.expected, result)
+		}
+	}
+}
+
+func TestPendingDownloads(t *testing.T) {
+	rows := []RequestRow{
+		{TaskID: "a", Status: CLMSTaskStatus{Status: TaskFinished}, Dataset: CLMSTaskDataset{DatasetID: "x"}},
+		{TaskID: "a", Status: CLMSTaskStatus{Status: TaskFinished}, Dataset: CLMSTaskDataset{DatasetID: "y"}},
+		{TaskID: "b", Status: CLMSTaskStatus{Status: TaskFinished}},
+		{TaskID: "c", Status: CLMSTaskStatus{Status: TaskInProgress}},
+		{TaskID: "d", Status: CLMSTaskStatus{Status: TaskFinished}},
+	}
+	records := map[string]TaskRecord{
+		"b": {TaskID: "b", Downloaded: time.Now()},
+		"d": {TaskID: "d"},
+	}
+
+	pending := pendingDownloads(rows, records, false)
+	ids := rowIDs(pending)
+	if (2 != len(ids)) || ("a" != ids[0]) || ("d" != ids[1]) {
+		t.Errorf("Expected [a d], got %v", ids)
+	}
+
+	pending = pendingDownloads(rows, records, true)
+	ids = rowIDs(pending)
+	if 3 != len(ids) {
+		t.Errorf("Expected forced download of [a b d], got %v", ids)
+	}
+}
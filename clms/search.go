@@ -0,0 +1,156 @@
+package clms
+
+import (
+	"strings"
+)
+
+// SearchFilter narrows down the CLMS catalogue. The free text query is
+// matched against a dataset's title and description, and every term must
+// be present. The other fields are matched against the individual items
+// within a dataset, and a dataset is only kept if at least one of its
+// items matches all the fields that are set.
+type SearchFilter struct {
+	Query      string
+	Collection string
+	Resolution string
+	Year       string
+	Format     string
+}
+
+func (f SearchFilter) hasItemFilters() bool {
+	return ("" != f.Collection) || ("" != f.Resolution) || ("" != f.Year) || ("" != f.Format)
+}
+
+func containsFold(haystack string, needle string) bool {
+	return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+}
+
+// Resolutions get written as "100m", "100 m" and "100M" in different
+// places, so ignore case and spacing.
+func normaliseResolution(resolution string) string {
+	return strings.ToLower(strings.Join(strings.Fields(resolution), ""))
+}
+
+func (f SearchFilter) matchesText(title string, description string) bool {
+	for _, term := range strings.Fields(f.Query) {
+		if !containsFold(title, term) && !containsFold(description, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// Generated data items don't have explicit year or resolution fields, but
+// CLMS consistently puts them in the item name, e.g. "CLC 2018 100m".
+func (f SearchFilter) matchesDownload(info CLMSDownloadInfo) bool {
+	if ("" != f.Collection) && !strings.EqualFold(f.Collection, info.Collection) {
+		return false
+	}
+	if "" != f.Year {
+		if !containsFold(info.Name, f.Year) && !containsFold(info.FullPath, f.Year) {
+			return false
+		}
+	}
+	if "" != f.Resolution {
+		resolution := normaliseResolution(f.Resolution)
+		if !strings.Contains(normaliseResolution(info.Name), resolution) && !strings.Contains(normaliseResolution(info.FullPath), resolution) {
+			return false
+		}
+	}
+	if "" != f.Format {
+		if _, ok := info.FullFormat.Find(f.Format); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (f SearchFilter) matchesFile(info CLMSFileInfo) bool {
+	if ("" != f.Year) && (strings.TrimSpace(info.Year) != f.Year) {
+		return false
+	}
+	if ("" != f.Resolution) && (normaliseResolution(info.Resolution) != normaliseResolution(f.Resolution)) {
+		return false
+	}
+	if ("" != f.Format) && !strings.EqualFold(strings.TrimSpace(info.Format), f.Format) {
+		return false
+	}
+	return true
+}
+
+// FilterDownloads returns just the download items within a dataset that
+// match the filter's item fields.
+func (f SearchFilter) FilterDownloads(dataset CLMSDataset) []CLMSDownloadInfo {
+	matches := make([]CLMSDownloadInfo, 0)
+	for _, info := range dataset.Downloads["items"] {
+		if f.matchesDownload(info) {
+			matches = append(matches, info)
+		}
+	}
+	return matches
+}
+
+// The downloads map is shared with the index cache, so make a new one
+// rather than editing it in place.
+func (f SearchFilter) withMatchingDownloads(dataset CLMSDataset) CLMSDataset {
+	downloads := make(map[string][]CLMSDownloadInfo)
+	for key, value := range dataset.Downloads {
+		downloads[key] = value
+	}
+	downloads["items"] = f.FilterDownloads(dataset)
+	dataset.Downloads = downloads
+	return dataset
+}
+
+// FilterFiles returns just the files within a prepackaged dataset that
+// match the filter's item fields.
+func (f SearchFilter) FilterFiles(dataset CLMSPrepackagedDataset) []CLMSFileInfo {
+	matches := make([]CLMSFileInfo, 0)
+	for _, info := range dataset.Files.Items {
+		if f.matchesFile(info) {
+			matches = append(matches, info)
+		}
+	}
+	return matches
+}
+
+// FilterGeneratedDatasets returns the datasets that match the filter. If
+// any item filters are set then the returned datasets only contain the
+// matching items.
+func (f SearchFilter) FilterGeneratedDatasets(datasets []CLMSDataset) []CLMSDataset {
+	results := make([]CLMSDataset, 0)
+	for _, dataset := range datasets {
+		if !f.matchesText(dataset.Title, dataset.Description) {
+			continue
+		}
+		if f.hasItemFilters() {
+			dataset = f.withMatchingDownloads(dataset)
+			if 0 == len(dataset.Downloads["items"]) {
+				continue
+			}
+		}
+		results = append(results, dataset)
+	}
+	return results
+}
+
+// FilterPrepackagedDatasets returns the datasets that match the filter. If
+// any item filters are set then the returned datasets only contain the
+// matching files.
+func (f SearchFilter) FilterPrepackagedDatasets(datasets []CLMSPrepackagedDataset) []CLMSPrepackagedDataset {
+	results := make([]CLMSPrepackagedDataset, 0)
+	for _, dataset := range datasets {
+		if !f.matchesText(dataset.Title, dataset.Description) {
+			continue
+		}
+		if f.hasItemFilters() {
+			matches := f.FilterFiles(dataset)
+			if 0 == len(matches) {
+				continue
+			}
+			dataset.Files.Items = matches
+		}
+		results = append(results, dataset)
+	}
+	return results
+}
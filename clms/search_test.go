@@ -0,0 +1,131 @@
+package clms
+
+import (
+	"testing"
+)
+
+var testGeneratedDatasets = []CLMSDataset{
+	{
+		UID:         "clc",
+		Title:       "CORINE Land Cover",
+		Description: "Pan-European land cover inventory",
+		Downloads: map[string][]CLMSDownloadInfo{
+			"items": {
+				{ID: "a", Name: "CLC 2018 100m", Collection: "Raster", FullFormat: CLMSFullFormat{{Token: "GeoTIFF"}}},
+				{ID: "b", Name: "CLC 2018", Collection: "Vector"},
+				{ID: "c", Name: "CLC 2012 100 m", Collection: "Raster"},
+			},
+		},
+	},
+	{
+		UID:         "tcd",
+		Title:       "Tree Cover Density",
+		Description: "Level of tree cover density",
+		Downloads: map[string][]CLMSDownloadInfo{
+			"items": {
+				{ID: "d", Name: "TCD 2018 10m", Collection: "Raster"},
+			},
+		},
+	},
+}
+
+func TestFilterGeneratedByText(t *testing.T) {
+	testcases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"clc", "tcd"}},
+		{"land", []string{"clc"}},
+		{"LAND cover", []string{"clc"}},
+		{"cover", []string{"clc", "tcd"}},
+		{"tree inventory", []string{}},
+	}
+	for _, testcase := range testcases {
+		filter := SearchFilter{Query: testcase.query}
+		results := filter.FilterGeneratedDatasets(testGeneratedDatasets)
+		if len(results) != len(testcase.expected) {
+			t.Errorf("Query %q: expected %d results, got %d", testcase.query, len(testcase.expected), len(results))
+			continue
+		}
+		for idx, result := range results {
+			if result.UID != testcase.expected[idx] {
+				t.Errorf("Query %q: expected %s, got %s", testcase.query, testcase.expected[idx], result.UID)
+			}
+		}
+	}
+}
+
+func TestFilterGeneratedByItem(t *testing.T) {
+	testcases := []struct {
+		filter   SearchFilter
+		expected []string
+	}{
+		{SearchFilter{Collection: "raster"}, []string{"a", "c", "d"}},
+		{SearchFilter{Year: "2018"}, []string{"a", "b", "d"}},
+		{SearchFilter{Resolution: "100m"}, []string{"a", "c"}},
+		{SearchFilter{Resolution: "100m", Year: "2012"}, []string{"c"}},
+		{SearchFilter{Collection: "Vector", Query: "tree"}, []string{}},
+		{SearchFilter{Format: "geotiff"}, []string{"a"}},
+	}
+	for idx, testcase := range testcases {
+		results := testcase.filter.FilterGeneratedDatasets(testGeneratedDatasets)
+		ids := make([]string, 0)
+		for _, result := range results {
+			for _, item := range result.Downloads["items"] {
+				ids = append(ids, item.ID)
+			}
+		}
+		if len(ids) != len(testcase.expected) {
+			t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, ids)
+			continue
+		}
+		for jdx, id := range ids {
+			if id != testcase.expected[jdx] {
+				t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, ids)
+				break
+			}
+		}
+	}
+
+	// Filtering should not modify the original
+	if 3 != len(testGeneratedDatasets[0].Downloads["items"]) {
+		t.Errorf("Filtering modified the source dataset")
+	}
+}
+
+func TestFilterPrepackagedFiles(t *testing.T) {
+	dataset := CLMSPrepackagedDataset{
+		UID:   "hrl",
+		Title: "Imperviousness",
+		Files: CLMSFileList{
+			Items: []CLMSFileInfo{
+				{ID: "a", Year: "2018", Resolution: "100 m", Format: "GeoTIFF"},
+				{ID: "b", Year: "2018", Resolution: "10 m", Format: "GeoTIFF"},
+				{ID: "c", Year: "2015", Resolution: "100 m", Format: "ESRI Geodatabase"},
+			},
+		},
+	}
+
+	testcases := []struct {
+		filter   SearchFilter
+		expected []string
+	}{
+		{SearchFilter{Year: "2018"}, []string{"a", "b"}},
+		{SearchFilter{Resolution: "100m"}, []string{"a", "c"}},
+		{SearchFilter{Resolution: "10m"}, []string{"b"}},
+		{SearchFilter{Format: "geotiff", Year: "2015"}, []string{}},
+	}
+	for idx, testcase := range testcases {
+		files := testcase.filter.FilterFiles(dataset)
+		if len(files) != len(testcase.expected) {
+			t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, files)
+			continue
+		}
+		for jdx, file := range files {
+			if file.ID != testcase.expected[jdx] {
+				t.Errorf("Case %d: expected %v, got %v", idx, testcase.expected, files)
+				break
+			}
+		}
+	}
+}
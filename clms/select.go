@@ -0,0 +1,177 @@
+package clms
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ItemSelector picks a single item out of a dataset by its properties,
+// rather than by the opaque download ID. Name matches against the item
+// name or path, either as a case insensitive substring or as a glob if it
+// contains wildcards. Area and Version only apply to prepackaged files.
+type ItemSelector struct {
+	Name       string
+	Year       string
+	Resolution string
+	Area       string
+	Version    string
+}
+
+func addSelectorFlags(flag *flag.FlagSet) *ItemSelector {
+	selector := ItemSelector{}
+	flag.StringVar(&selector.Name, "name", "", "Select the item by name or path, as a substring or glob, instead of -download_id.")
+	flag.StringVar(&selector.Year, "year", "", "Select the item by year, instead of -download_id.")
+	flag.StringVar(&selector.Resolution, "resolution", "", "Select the item by resolution, e.g. 100m, instead of -download_id.")
+	flag.StringVar(&selector.Area, "area", "", "Select the prepackaged file by area, instead of -download_id.")
+	flag.StringVar(&selector.Version, "version", "", "Select the prepackaged file by version, instead of -download_id.")
+	return &selector
+}
+
+func (s ItemSelector) Empty() bool {
+	return ("" == s.Name) && ("" == s.Year) && ("" == s.Resolution) && ("" == s.Area) && ("" == s.Version)
+}
+
+func (s ItemSelector) String() string {
+	parts := make([]string, 0)
+	for _, part := range []struct {
+		name  string
+		value string
+	}{
+		{"name", s.Name},
+		{"year", s.Year},
+		{"resolution", s.Resolution},
+		{"area", s.Area},
+		{"version", s.Version},
+	} {
+		if "" != part.value {
+			parts = append(parts, fmt.Sprintf("%s %q", part.name, part.value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Returns whether the name matches, and whether it was an exact match,
+// so that "CLC 2018" can pick that item even though "CLC 2018 100m" also
+// contains it.
+func matchName(pattern string, candidates ...string) (bool, bool) {
+	if "" == pattern {
+		return true, false
+	}
+	lowerPattern := strings.ToLower(pattern)
+	isGlob := strings.ContainsAny(pattern, "*?[")
+	matched := false
+	for _, candidate := range candidates {
+		lowerCandidate := strings.ToLower(candidate)
+		if lowerCandidate == lowerPattern {
+			return true, true
+		}
+		if isGlob {
+			ok, err := path.Match(lowerPattern, lowerCandidate)
+			if (nil == err) && ok {
+				matched = true
+			}
+		} else if strings.Contains(lowerCandidate, lowerPattern) {
+			matched = true
+		}
+	}
+	return matched, false
+}
+
+func describeCandidates(ids []string, names []string) string {
+	lines := make([]string, len(ids))
+	for idx := range ids {
+		lines[idx] = fmt.Sprintf("\t%s: %s", ids[idx], names[idx])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SelectDownload finds the one download item in a generated dataset that
+// matches the selector.
+func SelectDownload(dataset CLMSDataset, selector ItemSelector) (CLMSDownloadInfo, error) {
+	if ("" != selector.Area) || ("" != selector.Version) {
+		return CLMSDownloadInfo{}, fmt.Errorf("area and version selection only apply to prepackaged data")
+	}
+	filter := SearchFilter{Year: selector.Year, Resolution: selector.Resolution}
+
+	matches := make([]CLMSDownloadInfo, 0)
+	exact := make([]CLMSDownloadInfo, 0)
+	for _, info := range dataset.Downloads["items"] {
+		if !filter.matchesDownload(info) {
+			continue
+		}
+		ok, isExact := matchName(selector.Name, info.Name, info.FullPath)
+		if !ok {
+			continue
+		}
+		matches = append(matches, info)
+		if isExact {
+			exact = append(exact, info)
+		}
+	}
+	if 1 == len(exact) {
+		return exact[0], nil
+	}
+
+	switch len(matches) {
+	case 0:
+		return CLMSDownloadInfo{}, fmt.Errorf("no items in %s match %s", dataset.Title, selector)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		names := make([]string, len(matches))
+		for idx, info := range matches {
+			ids[idx] = info.ID
+			names[idx] = info.Name
+		}
+		return CLMSDownloadInfo{}, fmt.Errorf("%d items in %s match %s, be more specific:\n%s", len(matches), dataset.Title, selector, describeCandidates(ids, names))
+	}
+}
+
+// SelectFile finds the one file in a prepackaged dataset that matches the
+// selector.
+func SelectFile(dataset CLMSPrepackagedDataset, selector ItemSelector) (CLMSFileInfo, error) {
+	filter := SearchFilter{Year: selector.Year, Resolution: selector.Resolution}
+
+	matches := make([]CLMSFileInfo, 0)
+	exact := make([]CLMSFileInfo, 0)
+	for _, info := range dataset.Files.Items {
+		if !filter.matchesFile(info) {
+			continue
+		}
+		if ("" != selector.Area) && !strings.EqualFold(strings.TrimSpace(info.Area), selector.Area) {
+			continue
+		}
+		if ("" != selector.Version) && !strings.EqualFold(strings.TrimSpace(info.Version), selector.Version) {
+			continue
+		}
+		ok, isExact := matchName(selector.Name, info.File, info.Title, info.Path)
+		if !ok {
+			continue
+		}
+		matches = append(matches, info)
+		if isExact {
+			exact = append(exact, info)
+		}
+	}
+	if 1 == len(exact) {
+		return exact[0], nil
+	}
+
+	switch len(matches) {
+	case 0:
+		return CLMSFileInfo{}, fmt.Errorf("no files in %s match %s", dataset.Title, selector)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		names := make([]string, len(matches))
+		for idx, info := range matches {
+			ids[idx] = info.ID
+			names[idx] = fmt.Sprintf("%s (%s, %s, %s, %s)", info.File, info.Year, info.Resolution, info.Area, info.Version)
+		}
+		return CLMSFileInfo{}, fmt.Errorf("%d files in %s match %s, be more specific:\n%s", len(matches), dataset.Title, selector, describeCandidates(ids, names))
+	}
+}
@@ -0,0 +1,77 @@
+package clms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectDownload(t *testing.T) {
+	dataset := testGeneratedDatasets[0]
+	testcases := []struct {
+		selector ItemSelector
+		expected string
+		fails    string
+	}{
+		{ItemSelector{Name: "CLC 2018"}, "b", ""},
+		{ItemSelector{Name: "clc 2018*"}, "", "2 items"},
+		{ItemSelector{Year: "2012"}, "c", ""},
+		{ItemSelector{Year: "2018", Resolution: "100m"}, "a", ""},
+		{ItemSelector{Resolution: "100m"}, "", "be more specific"},
+		{ItemSelector{Year: "1990"}, "", "no items"},
+		{ItemSelector{Year: "2018", Area: "Europe"}, "", "prepackaged"},
+	}
+	for idx, testcase := range testcases {
+		info, err := SelectDownload(dataset, testcase.selector)
+		if "" != testcase.fails {
+			if nil == err {
+				t.Errorf("Case %d: expected error, got %v", idx, info)
+			} else if !strings.Contains(err.Error(), testcase.fails) {
+				t.Errorf("Case %d: expected error containing %q, got %v", idx, testcase.fails, err)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("Case %d: expected no error, got %v", idx, err)
+		} else if info.ID != testcase.expected {
+			t.Errorf("Case %d: expected %s, got %s", idx, testcase.expected, info.ID)
+		}
+	}
+}
+
+func TestSelectFile(t *testing.T) {
+	dataset := CLMSPrepackagedDataset{
+		Title: "Imperviousness",
+		Files: CLMSFileList{
+			Items: []CLMSFileInfo{
+				{ID: "a", File: "IMD_2018_100m_eu.zip", Year: "2018", Resolution: "100 m", Area: "Europe", Version: "V1"},
+				{ID: "b", File: "IMD_2018_100m_eu_v2.zip", Year: "2018", Resolution: "100 m", Area: "Europe", Version: "V2"},
+				{ID: "c", File: "IMD_2018_10m_mt.zip", Year: "2018", Resolution: "10 m", Area: "Malta", Version: "V1"},
+			},
+		},
+	}
+	testcases := []struct {
+		selector ItemSelector
+		expected string
+		fails    bool
+	}{
+		{ItemSelector{Year: "2018", Resolution: "100m", Version: "v2"}, "b", false},
+		{ItemSelector{Area: "malta"}, "c", false},
+		{ItemSelector{Name: "*eu.zip"}, "a", false},
+		{ItemSelector{Year: "2018", Resolution: "100m"}, "", true},
+		{ItemSelector{Area: "Iceland"}, "", true},
+	}
+	for idx, testcase := range testcases {
+		info, err := SelectFile(dataset, testcase.selector)
+		if testcase.fails {
+			if nil == err {
+				t.Errorf("Case %d: expected error, got %v", idx, info)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("Case %d: expected no error, got %v", idx, err)
+		} else if info.ID != testcase.expected {
+			t.Errorf("Case %d: expected %s, got %s", idx, testcase.expected, info.ID)
+		}
+	}
+}
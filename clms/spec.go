@@ -0,0 +1,178 @@
+package clms
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A request spec records everything needed to request an item from CLMS,
+// so that a request that took some working out can be saved, shared, and
+// made again without retyping all the flags. The spec can be generated by
+// search with -emit-spec and is read by download with -spec.
+const requestSpecVersion = 1
+
+type RequestSpec struct {
+	Version          int    `json:"version"`
+	UID              string `json:"uid"`
+	Title            string `json:"title,omitempty"`
+	Prepackaged      bool   `json:"prepackaged,omitempty"`
+	DownloadID       string `json:"download_id"`
+	Format           string `json:"format,omitempty"`
+	CoordinateSystem string `json:"cgs,omitempty"`
+	NUTS             string `json:"nuts,omitempty"`
+	// west, south, east, north, in EPSG:4326
+	BoundingBox []float64 `json:"bbox,omitempty"`
+	// If the item to download couldn't be narrowed down to one, these are
+	// the ones to choose from. They aren't used when making the request.
+	Options []RequestSpecOption `json:"options,omitempty"`
+}
+
+type RequestSpecOption struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Formats []string `json:"formats,omitempty"`
+}
+
+// CLMS will reproject to most things, but EPSG:4326 is what we default to
+// elsewhere so prefer it if the dataset offers it.
+func defaultCoordinateSystem(dataset CLMSDataset) string {
+	for _, crs := range dataset.CoordinateSystems {
+		if strings.EqualFold(crs, "EPSG:4326") {
+			return crs
+		}
+	}
+	if 0 != len(dataset.CoordinateSystems) {
+		return dataset.CoordinateSystems[0]
+	}
+	return "EPSG:4326"
+}
+
+// GeneratedRequestSpec makes a spec for the items in a dataset that match
+// the filter. If there is more than one the download ID is left blank and
+// the candidates are listed in the spec's options.
+func GeneratedRequestSpec(dataset CLMSDataset, filter SearchFilter) RequestSpec {
+	spec := RequestSpec{
+		Version:          requestSpecVersion,
+		UID:              dataset.UID,
+		Title:            dataset.Title,
+		Format:           filter.Format,
+		CoordinateSystem: defaultCoordinateSystem(dataset),
+	}
+	matches := filter.FilterDownloads(dataset)
+	if 1 == len(matches) {
+		spec.DownloadID = matches[0].ID
+		if format, ok := matches[0].FullFormat.Find(filter.Format); ok {
+			spec.Format = format.Token
+		} else if 0 != len(matches[0].FullFormat) {
+			spec.Format = matches[0].FullFormat[0].Token
+		}
+		return spec
+	}
+	for _, info := range matches {
+		spec.Options = append(spec.Options, RequestSpecOption{
+			ID:      info.ID,
+			Name:    info.Name,
+			Formats: info.FullFormat.Tokens(),
+		})
+	}
+	return spec
+}
+
+// PrepackagedRequestSpec is GeneratedRequestSpec for prepackaged files,
+// which come as they are so have no format or area.
+func PrepackagedRequestSpec(dataset CLMSPrepackagedDataset, filter SearchFilter) RequestSpec {
+	spec := RequestSpec{
+		Version:     requestSpecVersion,
+		UID:         dataset.UID,
+		Title:       dataset.Title,
+		Prepackaged: true,
+	}
+	matches := filter.FilterFiles(dataset)
+	if 1 == len(matches) {
+		spec.DownloadID = matches[0].ID
+		return spec
+	}
+	for _, info := range matches {
+		spec.Options = append(spec.Options, RequestSpecOption{
+			ID:   info.ID,
+			Name: info.File,
+		})
+	}
+	return spec
+}
+
+// Validate checks the spec describes a single request we can make.
+func (s RequestSpec) Validate() error {
+	if requestSpecVersion != s.Version {
+		return fmt.Errorf("unsupported request spec version %d, expected %d", s.Version, requestSpecVersion)
+	}
+	if "" == s.UID {
+		return fmt.Errorf("request spec has no uid")
+	}
+	if "" == s.DownloadID {
+		if 0 == len(s.Options) {
+			return fmt.Errorf("request spec has no download_id")
+		}
+		ids := make([]string, len(s.Options))
+		for idx, option := range s.Options {
+			ids[idx] = fmt.Sprintf("%s (%s)", option.ID, option.Name)
+		}
+		return fmt.Errorf("request spec has no download_id, set it to one of: %s", strings.Join(ids, ", "))
+	}
+	if s.Prepackaged {
+		if ("" != s.Format) || ("" != s.CoordinateSystem) || ("" != s.NUTS) || (0 != len(s.BoundingBox)) {
+			return fmt.Errorf("format, coordinate system and area can not be set for prepackaged data")
+		}
+	}
+	if ("" != s.NUTS) && (0 != len(s.BoundingBox)) {
+		return fmt.Errorf("only one of nuts and bbox can be set")
+	}
+	if 0 != len(s.BoundingBox) {
+		return validateBoundingBox(s.BoundingBox)
+	}
+	return nil
+}
+
+func validateBoundingBox(bbox []float64) error {
+	if 4 != len(bbox) {
+		return fmt.Errorf("bounding box must have four values, got %d", len(bbox))
+	}
+	if (bbox[0] >= bbox[2]) || (bbox[1] >= bbox[3]) {
+		return fmt.Errorf("bounding box must be west,south,east,north, got %v", bbox)
+	}
+	return nil
+}
+
+// ParseBoundingBox reads a "west,south,east,north" flag value.
+func ParseBoundingBox(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	bbox := make([]float64, len(parts))
+	for idx, part := range parts {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if nil != err {
+			return nil, fmt.Errorf("invalid bounding box value %q", part)
+		}
+		bbox[idx] = parsed
+	}
+	err := validateBoundingBox(bbox)
+	if nil != err {
+		return nil, err
+	}
+	return bbox, nil
+}
+
+func LoadRequestSpec(path string) (RequestSpec, error) {
+	contents, err := os.ReadFile(path)
+	if nil != err {
+		return RequestSpec{}, err
+	}
+	var spec RequestSpec
+	err = json.Unmarshal(contents, &spec)
+	if nil != err {
+		return RequestSpec{}, fmt.Errorf("failed to parse request spec %s: %w", path, err)
+	}
+	return spec, nil
+}
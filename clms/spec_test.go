@@ -0,0 +1,74 @@
+package clms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratedRequestSpec(t *testing.T) {
+	dataset := testGeneratedDatasets[0]
+
+	spec := GeneratedRequestSpec(dataset, SearchFilter{Year: "2018", Resolution: "100m", Format: "geotiff"})
+	if ("a" != spec.DownloadID) || ("GeoTIFF" != spec.Format) || ("EPSG:4326" != spec.CoordinateSystem) || (0 != len(spec.Options)) {
+		t.Errorf("Expected spec for item a, got %v", spec)
+	}
+	err := spec.Validate()
+	if nil != err {
+		t.Errorf("Expected valid spec, got %v", err)
+	}
+
+	spec = GeneratedRequestSpec(dataset, SearchFilter{Year: "2018"})
+	if ("" != spec.DownloadID) || (2 != len(spec.Options)) {
+		t.Errorf("Expected spec with two options, got %v", spec)
+	}
+	err = spec.Validate()
+	if (nil == err) || !strings.Contains(err.Error(), "a (CLC 2018 100m)") {
+		t.Errorf("Expected error listing options, got %v", err)
+	}
+}
+
+func TestRequestSpecValidate(t *testing.T) {
+	testcases := []struct {
+		spec  RequestSpec
+		fails bool
+	}{
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d"}, false},
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d", NUTS: "ITC11"}, false},
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d", BoundingBox: []float64{1, 2, 3, 4}}, false},
+		{RequestSpec{Version: 2, UID: "u", DownloadID: "d"}, true},
+		{RequestSpec{Version: 1, DownloadID: "d"}, true},
+		{RequestSpec{Version: 1, UID: "u"}, true},
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d", NUTS: "ITC11", BoundingBox: []float64{1, 2, 3, 4}}, true},
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d", BoundingBox: []float64{3, 2, 1, 4}}, true},
+		{RequestSpec{Version: 1, UID: "u", DownloadID: "d", Prepackaged: true, Format: "GeoTIFF"}, true},
+	}
+	for idx, testcase := range testcases {
+		err := testcase.spec.Validate()
+		if testcase.fails && (nil == err) {
+			t.Errorf("Case %d: expected error", idx)
+		} else if !testcase.fails && (nil != err) {
+			t.Errorf("Case %d: expected no error, got %v", idx, err)
+		}
+	}
+}
+
+func TestParseBoundingBox(t *testing.T) {
+	bbox, err := ParseBoundingBox("-1.5, 50, 2,52.25")
+	if nil != err {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []float64{-1.5, 50, 2, 52.25}
+	for idx, value := range expected {
+		if bbox[idx] != value {
+			t.Errorf("Expected %v, got %v", expected, bbox)
+			break
+		}
+	}
+
+	for _, value := range []string{"", "1,2,3", "1,2,3,x", "1,5,3,4"} {
+		_, err = ParseBoundingBox(value)
+		if nil == err {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package clms
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The states a CLMS data request moves through. A request starts off
+// queued, moves to in progress, and then ends in one of the other states.
+const TaskQueued = "Queued"
+const TaskInProgress = "In_progress"
+const TaskFinished = "Finished_ok"
+const TaskFinishedWithErrors = "Finished_nok"
+const TaskCancelled = "Cancelled"
+const TaskRejected = "Rejected"
+
+// TaskPending reports whether a request in this state may still complete
+// if we wait for it.
+func TaskPending(status string) bool {
+	return (TaskQueued == status) || (TaskInProgress == status)
+}
+
+// DescribeTaskStatus gives a user facing explanation of a request state.
+func DescribeTaskStatus(status string) string {
+	switch status {
+	case TaskQueued:
+		return "waiting for the CLMS servers to start processing the request"
+	case TaskInProgress:
+		return "the CLMS servers are preparing the data"
+	case TaskFinished:
+		return "the data is ready to download"
+	case TaskFinishedWithErrors:
+		return "the CLMS servers failed to prepare the data, try requesting it again"
+	case TaskCancelled:
+		return "the request was cancelled"
+	case TaskRejected:
+		return "the CLMS servers rejected the request, check the dataset, format and coordinate system"
+	default:
+		return "unrecognised request status"
+	}
+}
+
+// TaskError is returned when a data request isn't in a state where it can
+// be downloaded. Use Pending to tell whether it is worth waiting longer or
+// whether the request has permanently failed.
+type TaskError struct {
+	TaskID  string
+	Status  string
+	Message string
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("request %s is %s: %s", e.TaskID, e.Status, DescribeTaskStatus(e.Status))
+	if "" != e.Message {
+		msg = fmt.Sprintf("%s (server said: %s)", msg, e.Message)
+	}
+	return msg
+}
+
+func (e *TaskError) Pending() bool {
+	return TaskPending(e.Status)
+}
+
+// IsTaskPending reports whether an error is because a request is still
+// being processed, rather than because it failed.
+func IsTaskPending(err error) bool {
+	var taskErr *TaskError
+	return errors.As(err, &taskErr) && taskErr.Pending()
+}
+
+// CheckTaskStatus returns nil if the request is ready to download, and a
+// TaskError otherwise.
+func CheckTaskStatus(taskID string, status CLMSTaskStatus) error {
+	if TaskFinished == status.Status {
+		return nil
+	}
+	return &TaskError{
+		TaskID:  taskID,
+		Status:  status.Status,
+		Message: status.Message,
+	}
+}
@@ -0,0 +1,58 @@
+package clms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckTaskStatus(t *testing.T) {
+	testcases := []struct {
+		status  string
+		ready   bool
+		pending bool
+	}{
+		{TaskQueued, false, true},
+		{TaskInProgress, false, true},
+		{TaskFinished, true, false},
+		{TaskFinishedWithErrors, false, false},
+		{TaskCancelled, false, false},
+		{TaskRejected, false, false},
+		{"Something_new", false, false},
+	}
+	for _, testcase := range testcases {
+		err := CheckTaskStatus("abc", CLMSTaskStatus{Status: testcase.status})
+		if testcase.ready {
+			if nil != err {
+				t.Errorf("%s: expected no error, got %v", testcase.status, err)
+			}
+			continue
+		}
+		if nil == err {
+			t.Errorf("%s: expected error", testcase.status)
+			continue
+		}
+		var taskErr *TaskError
+		if !errors.As(err, &taskErr) {
+			t.Errorf("%s: expected TaskError, got %T", testcase.status, err)
+		}
+		if IsTaskPending(err) != testcase.pending {
+			t.Errorf("%s: expected pending %v", testcase.status, testcase.pending)
+		}
+	}
+}
+
+func TestTaskErrorIncludesMessage(t *testing.T) {
+	err := CheckTaskStatus("abc", CLMSTaskStatus{Status: TaskRejected, Message: "Area too large"})
+	wrapped := fmt.Errorf("failed: %w", err)
+	if !strings.Contains(wrapped.Error(), "Area too large") {
+		t.Errorf("Expected server message in error, got %v", wrapped)
+	}
+	if IsTaskPending(wrapped) {
+		t.Errorf("Expected rejected task to not be pending")
+	}
+	if IsTaskPending(fmt.Errorf("some other error")) {
+		t.Errorf("Expected other errors to not be pending")
+	}
+}
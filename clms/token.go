@@ -0,0 +1,183 @@
+package clms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// How long a token is taken to last if the server doesn't say, which is
+// as long as CLMS's usually do.
+const defaultTokenLifetime = time.Hour
+
+// How close to expiry we allow a token to get before we consider it
+// stale, so that a request started just before expiry doesn't fail
+// half way through.
+const tokenExpiryMargin = time.Minute
+
+// A session token as obtained from the CLMS token endpoint, along with
+// enough information to know when it is no longer usable. This is what
+// gets stored in the on disk cache.
+type CLMSSessionToken struct {
+	AccessToken string    `json:"access_token"`
+	Expires     time.Time `json:"expires"`
+	ClientID    string    `json:"client_id"`
+	KeyID       string    `json:"key_id"`
+	TokenURI    string    `json:"token_uri"`
+}
+
+func (t CLMSSessionToken) Valid(now time.Time) bool {
+	if "" == t.AccessToken {
+		return false
+	}
+	return now.Add(tokenExpiryMargin).Before(t.Expires)
+}
+
+var unsafeCacheNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// A token is only good for the endpoint that issued it, so tokens from a
+// test or staging server are kept apart from those from the real one. The
+// URI is too long to put in the name as is, so it is hashed.
+func tokenCachePath(details CLMSAuthenticationDetails, tokenURI string) (string, error) {
+	name := unsafeCacheNameChars.ReplaceAllString(details.ClientID+"-"+details.KeyID, "_")
+	endpoint := sha256.Sum256([]byte(tokenURI))
+	return cacheFilePath(fmt.Sprintf("clms-token-%s-%x.json", name, endpoint[:4]))
+}
+
+func loadCachedToken(details CLMSAuthenticationDetails, tokenURI string) (CLMSSessionToken, error) {
+	cachePath, err := tokenCachePath(details, tokenURI)
+	if nil != err {
+		return CLMSSessionToken{}, err
+	}
+	contents, err := os.ReadFile(cachePath)
+	if nil != err {
+		return CLMSSessionToken{}, err
+	}
+
+	var token CLMSSessionToken
+	err = json.Unmarshal(contents, &token)
+	if nil != err {
+		return CLMSSessionToken{}, fmt.Errorf("failed to parse cached token: %w", err)
+	}
+
+	// The name is sanitised, so double check this is really for the key we have
+	if (token.ClientID != details.ClientID) || (token.KeyID != details.KeyID) {
+		return CLMSSessionToken{}, fmt.Errorf("cached token is for a different key")
+	}
+	if token.TokenURI != tokenURI {
+		return CLMSSessionToken{}, fmt.Errorf("cached token is from a different token endpoint")
+	}
+	return token, nil
+}
+
+// The token is as good as a password for the lifetime of the token, so
+// it's important that writeCacheFile only lets the user read it.
+func saveCachedToken(details CLMSAuthenticationDetails, token CLMSSessionToken) error {
+	cachePath, err := tokenCachePath(details, token.TokenURI)
+	if nil != err {
+		return err
+	}
+	contents, err := json.Marshal(token)
+	if nil != err {
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	return writeCacheFile(cachePath, contents)
+}
+
+// SessionTokenSource hands out session tokens for an API key, reusing
+// a cached token where one is still valid and fetching a fresh one from
+// the CLMS token endpoint otherwise. It is intended to be held for the
+// duration of an operation, so that long running polls can keep asking
+// for a token and transparently get a new one when the old one expires.
+type SessionTokenSource struct {
+	details CLMSAuthenticationDetails
+	// Held while the token is checked or fetched, so that a Client's
+	// parallel requests share one token rather than all fetching their own.
+	lock  sync.Mutex
+	token CLMSSessionToken
+	// The token endpoint, defaulting to the package's TokenURI and then
+	// the one in the key.
+	TokenURI string
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Where the current token came from, for debugging
+	FromCache bool
+	// Defaults to discarding everything.
+	Logger *slog.Logger
+}
+
+func NewSessionTokenSource(details CLMSAuthenticationDetails) *SessionTokenSource {
+	return &SessionTokenSource{details: details}
+}
+
+func (s *SessionTokenSource) Session(ctx context.Context) (CLMSSessionToken, error) {
+	return s.session(ctx, s.HTTPClient, s.TokenURI)
+}
+
+// session lets a Client use its own HTTP client and token endpoint.
+func (s *SessionTokenSource) session(ctx context.Context, client *http.Client, tokenURI string) (CLMSSessionToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	tokenURI = s.details.tokenEndpoint(tokenURI)
+	if s.token.Valid(now) && (s.token.TokenURI == tokenURI) {
+		return s.token, nil
+	}
+
+	cached, err := loadCachedToken(s.details, tokenURI)
+	if (nil == err) && cached.Valid(now) {
+		s.token = cached
+		s.FromCache = true
+		return s.token, nil
+	}
+
+	return s.refresh(ctx, client, tokenURI)
+}
+
+// Refresh always fetches a new token from the server, replacing any
+// cached one.
+func (s *SessionTokenSource) Refresh(ctx context.Context) (CLMSSessionToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refresh(ctx, s.HTTPClient, s.TokenURI)
+}
+
+// Must be called with the lock held.
+func (s *SessionTokenSource) refresh(ctx context.Context, client *http.Client, tokenURI string) (CLMSSessionToken, error) {
+	token, err := s.details.RequestSessionTokenWithContext(ctx, client, tokenURI)
+	if nil != err {
+		return CLMSSessionToken{}, err
+	}
+	s.token = token
+	s.FromCache = false
+
+	err = saveCachedToken(s.details, token)
+	if nil != err {
+		logger := s.Logger
+		if nil == logger {
+			logger = discardLogger
+		}
+		logger.Warn("failed to cache session token", "error", err)
+	}
+	return s.token, nil
+}
+
+func (s *SessionTokenSource) Token(ctx context.Context) (string, error) {
+	token, err := s.Session(ctx)
+	if nil != err {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func (s *SessionTokenSource) CachePath() (string, error) {
+	return tokenCachePath(s.details, s.details.tokenEndpoint(s.TokenURI))
+}
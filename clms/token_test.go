@@ -0,0 +1,220 @@
+package clms
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"quantify.earth/reclaimer/clms/clmstest"
+)
+
+func TestSessionTokenValidity(t *testing.T) {
+	now := time.Now()
+	testcases := []struct {
+		token    CLMSSessionToken
+		expected bool
+	}{
+		{CLMSSessionToken{AccessToken: "abc", Expires: now.Add(time.Hour)}, true},
+		{CLMSSessionToken{AccessToken: "abc", Expires: now.Add(-time.Hour)}, false},
+		{CLMSSessionToken{AccessToken: "abc", Expires: now.Add(tokenExpiryMargin / 2)}, false},
+		{CLMSSessionToken{AccessToken: "", Expires: now.Add(time.Hour)}, false},
+	}
+	for idx, testcase := range testcases {
+		if testcase.token.Valid(now) != testcase.expected {
+			t.Errorf("Case %d: expected %v for token expiring %v", idx, testcase.expected, testcase.token.Expires)
+		}
+	}
+}
+
+func TestTokenCacheRoundTrip(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	details, err := LoadAPIKey("testdata/exampleapi.key")
+	if nil != err {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+
+	token := CLMSSessionToken{
+		AccessToken: "abc123",
+		Expires:     time.Now().Add(time.Hour).Round(time.Second),
+		ClientID:    details.ClientID,
+		KeyID:       details.KeyID,
+		TokenURI:    details.TokenURI,
+	}
+	err = saveCachedToken(details, token)
+	if nil != err {
+		t.Fatalf("Expected no error saving token, got %v", err)
+	}
+
+	cachePath, err := tokenCachePath(details, details.TokenURI)
+	if nil != err {
+		t.Fatalf("Expected no error getting cache path, got %v", err)
+	}
+	info, err := os.Stat(cachePath)
+	if nil != err {
+		t.Fatalf("Expected cache file, got %v", err)
+	}
+	if 0o600 != info.Mode().Perm() {
+		t.Errorf("Expected cache file to be private, got %v", info.Mode().Perm())
+	}
+
+	loaded, err := loadCachedToken(details, details.TokenURI)
+	if nil != err {
+		t.Fatalf("Expected no error loading token, got %v", err)
+	}
+	if (loaded.AccessToken != token.AccessToken) || !loaded.Expires.Equal(token.Expires) {
+		t.Errorf("Expected %v, got %v", token, loaded)
+	}
+
+	// A cached token should be picked up without going near the network
+	session := NewSessionTokenSource(details)
+	accessToken, err := session.Token(context.Background())
+	if nil != err {
+		t.Fatalf("Expected no error getting token, got %v", err)
+	}
+	if accessToken != token.AccessToken {
+		t.Errorf("Expected cached token %s, got %s", token.AccessToken, accessToken)
+	}
+	if !session.FromCache {
+		t.Errorf("Expected token to come from cache")
+	}
+}
+
+func TestTokenCacheIgnoresOtherKeys(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	details, err := LoadAPIKey("testdata/exampleapi.key")
+	if nil != err {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+
+	token := CLMSSessionToken{
+		AccessToken: "abc123",
+		Expires:     time.Now().Add(time.Hour),
+		ClientID:    details.ClientID,
+		KeyID:       "someotherkey",
+		TokenURI:    details.TokenURI,
+	}
+	err = saveCachedToken(details, token)
+	if nil != err {
+		t.Fatalf("Expected no error saving token, got %v", err)
+	}
+
+	_, err = loadCachedToken(details, details.TokenURI)
+	if nil == err {
+		t.Errorf("Expected error loading token for other key")
+	}
+}
+
+func TestTokenCacheIgnoresOtherEndpoints(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	details, err := LoadAPIKey("testdata/exampleapi.key")
+	if nil != err {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+
+	token := CLMSSessionToken{
+		AccessToken: "abc123",
+		Expires:     time.Now().Add(time.Hour),
+		ClientID:    details.ClientID,
+		KeyID:       details.KeyID,
+		TokenURI:    "https://staging.example.com/token",
+	}
+	err = saveCachedToken(details, token)
+	if nil != err {
+		t.Fatalf("Expected no error saving token, got %v", err)
+	}
+
+	_, err = loadCachedToken(details, details.TokenURI)
+	if nil == err {
+		t.Errorf("Expected no token for the key's own endpoint")
+	}
+	loaded, err := loadCachedToken(details, token.TokenURI)
+	if (nil != err) || (token.AccessToken != loaded.AccessToken) {
+		t.Errorf("Expected cached token for the staging endpoint, got %v: %v", loaded, err)
+	}
+
+	// Even if the file is copied over, the token isn't used for the wrong endpoint
+	stagingPath, _ := tokenCachePath(details, token.TokenURI)
+	ownPath, _ := tokenCachePath(details, details.TokenURI)
+	contents, err := os.ReadFile(stagingPath)
+	if nil != err {
+		t.Fatalf("Expected cache file, got %v", err)
+	}
+	err = os.WriteFile(ownPath, contents, 0o600)
+	if nil != err {
+		t.Fatalf("Failed to write cache file: %v", err)
+	}
+	_, err = loadCachedToken(details, details.TokenURI)
+	if nil == err {
+		t.Errorf("Expected error loading token from another endpoint")
+	}
+}
+
+func testAPIKey(t *testing.T, tokenURI string) CLMSAuthenticationDetails {
+	key := testRSAKey(t)
+	return CLMSAuthenticationDetails{
+		ClientID:   "test-client",
+		KeyID:      "test-key",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		TokenURI:   tokenURI,
+	}
+}
+
+// Run with -race to check the source is safe to share.
+func TestSessionTokenSourceConcurrent(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := clmstest.NewServer()
+	t.Cleanup(server.Close)
+	session := NewSessionTokenSource(testAPIKey(t, server.TokenURI()))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			_, errs[idx] = session.Token(context.Background())
+		}(idx)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		if nil != err {
+			t.Errorf("Call %d: expected no error, got %v", idx, err)
+		}
+	}
+	if 1 != server.TokenRequests() {
+		t.Errorf("Expected one token to be shared, got %d requests", server.TokenRequests())
+	}
+}
+
+func TestSessionTokenDefaultLifetime(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		w.Write([]byte(`{"access_token": "abc", "token_type": "Bearer"}`))
+	}))
+	t.Cleanup(server.Close)
+	session := NewSessionTokenSource(testAPIKey(t, server.URL))
+
+	for range 2 {
+		token, err := session.Session(context.Background())
+		if nil != err {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !token.Valid(time.Now()) {
+			t.Errorf("Expected token without an expiry to be usable, expires %v", token.Expires)
+		}
+	}
+	if 1 != requests {
+		t.Errorf("Expected the token to be reused, got %d requests", requests)
+	}
+}
@@ -0,0 +1,364 @@
+// Package dataverse fetches datasets from Dataverse installations, such as
+// Harvard's and many national and institutional repositories.
+package dataverse
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultServer = "https://dataverse.harvard.edu"
+
+// TokenEnv is where the API token is looked for when -token isn't given.
+// Only restricted files need one.
+const TokenEnv = "DATAVERSE_API_TOKEN"
+
+type DataverseChecksum struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type DataverseDataFile struct {
+	ID                 int               `json:"id"`
+	PersistentID       string            `json:"persistentId"`
+	Filename           string            `json:"filename"`
+	ContentType        string            `json:"contentType"`
+	Filesize           int64             `json:"filesize"`
+	Checksum           DataverseChecksum `json:"checksum"`
+	MD5                string            `json:"md5"`
+	TabularData        bool              `json:"tabularData"`
+	OriginalFileFormat string            `json:"originalFileFormat"`
+	OriginalFileName   string            `json:"originalFileName"`
+	OriginalFileSize   int64             `json:"originalFileSize"`
+}
+
+type DataverseFile struct {
+	Label          string            `json:"label"`
+	DirectoryLabel string            `json:"directoryLabel"`
+	Restricted     bool              `json:"restricted"`
+	DataFile       DataverseDataFile `json:"dataFile"`
+}
+
+// Metadata fields' values are strings, lists, or compound values depending
+// on the field, so are left for the fields we care about to decode.
+type DataverseField struct {
+	TypeName string          `json:"typeName"`
+	Multiple bool            `json:"multiple"`
+	Value    json.RawMessage `json:"value"`
+}
+
+type DataverseMetadataBlock struct {
+	Fields []DataverseField `json:"fields"`
+}
+
+type DataverseLicense struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+type DataverseVersion struct {
+	ID                  int                               `json:"id"`
+	DatasetPersistentID string                            `json:"datasetPersistentId"`
+	VersionNumber       int                               `json:"versionNumber"`
+	VersionMinorNumber  int                               `json:"versionMinorNumber"`
+	VersionState        string                            `json:"versionState"`
+	License             DataverseLicense                  `json:"license"`
+	MetadataBlocks      map[string]DataverseMetadataBlock `json:"metadataBlocks"`
+	Files               []DataverseFile                   `json:"files"`
+}
+
+// Name is how Dataverse shows versions: "1.2", or "DRAFT".
+func (v DataverseVersion) Name() string {
+	if "DRAFT" == v.VersionState {
+		return "DRAFT"
+	}
+	return fmt.Sprintf("%d.%d", v.VersionNumber, v.VersionMinorNumber)
+}
+
+func (v DataverseVersion) citationField(name string) (json.RawMessage, bool) {
+	for _, field := range v.MetadataBlocks["citation"].Fields {
+		if name == field.TypeName {
+			return field.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (v DataverseVersion) Title() string {
+	var title string
+	if raw, ok := v.citationField("title"); ok {
+		json.Unmarshal(raw, &title)
+	}
+	return title
+}
+
+func (v DataverseVersion) Authors() []string {
+	var authors []map[string]DataverseField
+	if raw, ok := v.citationField("author"); ok {
+		json.Unmarshal(raw, &authors)
+	}
+	names := make([]string, 0, len(authors))
+	for _, author := range authors {
+		var name string
+		json.Unmarshal(author["authorName"].Value, &name)
+		if "" != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Every response is wrapped like this.
+type dataverseResponse[T any] struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Data    T      `json:"data"`
+}
+
+// Provider fetches datasets from a Dataverse installation, by default
+// Harvard's.
+type Provider struct {
+	// The root of the installation, e.g. https://dataverse.harvard.edu.
+	Server string
+	// For restricted files. Defaults to $DATAVERSE_API_TOKEN.
+	Token string
+
+	version string
+	tabular bool
+}
+
+func (p *Provider) Name() string {
+	return "dataverse"
+}
+
+func (p *Provider) Description() string {
+	return "Dataverse datasets, by persistent ID or URL"
+}
+
+// Some of the larger installations, as there's no telling from a DOI alone
+// that it's for a Dataverse dataset. Their landing pages give the server
+// along with the persistent ID, so any of them can be fetched.
+var knownHosts = []string{
+	"dataverse.harvard.edu",
+	"dataverse.nl",
+	"borealisdata.ca",
+	"dataverse.no",
+	"data.qdr.syr.edu",
+}
+
+// Only the default server's prefix, as a DOI on its own is looked up on the
+// configured server.
+func (p *Provider) DOIPrefixes() []string {
+	if DefaultServer != p.server() {
+		return nil
+	}
+	return []string{"10.7910"}
+}
+
+func (p *Provider) Hosts() []string {
+	hosts := append([]string{}, knownHosts...)
+	if parsed, err := url.Parse(p.server()); nil == err {
+		hosts = append(hosts, parsed.Hostname())
+	}
+	return hosts
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	server := p.Server
+	if "" == server {
+		server = DefaultServer
+	}
+	flagset.Var(&options.Files, "filename", "Specific item within dataset to download")
+	flagset.StringVar(&p.Server, "server", server, "Root URL of the Dataverse installation. Taken from the identifier if that is a dataset URL.")
+	flagset.StringVar(&p.Token, "token", p.Token, fmt.Sprintf("API token, needed for restricted files. Otherwise taken from $%s. Only sent to -server.", TokenEnv))
+	flagset.StringVar(&p.version, "version", "", "Version of the dataset to fetch, e.g. 1.0, or :draft. Defaults to the latest published version.")
+	flagset.BoolVar(&p.tabular, "tabular", false, "For tabular files, download the tab separated version made by Dataverse rather than the file as uploaded")
+}
+
+var persistentIDPattern = regexp.MustCompile(`^(?:doi:10\.\d{4,9}/\S+|hdl:\S+)$`)
+
+// ParseIdentifier gets the persistent ID, such as doi:10.7910/DVN/ABCDEF,
+// from an ID, DOI, or dataset URL, and the server if it was a URL.
+func ParseIdentifier(identifier string) (string, string, error) {
+	identifier = strings.TrimSpace(identifier)
+	// Dataverse wants DOIs written with doi: in front
+	if doi := provider.TrimDOI(identifier); strings.HasPrefix(doi, "10.") {
+		identifier = "doi:" + doi
+	}
+	for _, resolver := range []string{"https://hdl.handle.net/", "http://hdl.handle.net/"} {
+		if strings.HasPrefix(identifier, resolver) {
+			identifier = "hdl:" + strings.TrimPrefix(identifier, resolver)
+		}
+	}
+	if persistentIDPattern.MatchString(identifier) {
+		return identifier, "", nil
+	}
+
+	parsed, err := url.Parse(identifier)
+	if (nil == err) && parsed.IsAbs() {
+		persistentID := parsed.Query().Get("persistentId")
+		if persistentIDPattern.MatchString(persistentID) {
+			return persistentID, fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host), nil
+		}
+	}
+	return "", "", fmt.Errorf("%q is not a Dataverse persistent ID or dataset URL", identifier)
+}
+
+// The key is only for the server the user configured. A dataset URL can
+// name any server, and whoever runs it mustn't get the key just by having
+// a link to it fetched. The key goes with file downloads too, which utils
+// only sends to the server itself and not to the storage they are often
+// redirected to.
+func (p *Provider) headers(server string) map[string]string {
+	if strings.TrimSuffix(server, "/") != p.server() {
+		return nil
+	}
+	token := p.Token
+	if "" == token {
+		token = os.Getenv(TokenEnv)
+	}
+	if "" == token {
+		return nil
+	}
+	return map[string]string{"X-Dataverse-key": token}
+}
+
+func (p *Provider) server() string {
+	if "" == p.Server {
+		return DefaultServer
+	}
+	return strings.TrimSuffix(p.Server, "/")
+}
+
+func get[T any](ctx context.Context, p *Provider, server string, path string, query url.Values) (T, error) {
+	var response dataverseResponse[T]
+	err := utils.HTTPGetJSON(ctx, fmt.Sprintf("%s%s?%s", server, path, query.Encode()), p.headers(server), &response)
+	if nil != err {
+		return response.Data, err
+	}
+	if "OK" != response.Status {
+		return response.Data, fmt.Errorf("dataverse error: %s", response.Message)
+	}
+	return response.Data, nil
+}
+
+func (p *Provider) FetchVersions(ctx context.Context, server string, persistentID string) ([]DataverseVersion, error) {
+	query := url.Values{"persistentId": {persistentID}}
+	return get[[]DataverseVersion](ctx, p, server, "/api/datasets/:persistentId/versions", query)
+}
+
+// FetchVersion gets one version of a dataset, which can be a number like
+// "1.0" or one of Dataverse's names such as ":latest-published".
+func (p *Provider) FetchVersion(ctx context.Context, server string, persistentID string, version string) (DataverseVersion, error) {
+	query := url.Values{"persistentId": {persistentID}}
+	return get[DataverseVersion](ctx, p, server, "/api/datasets/:persistentId/versions/"+url.PathEscape(version), query)
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	persistentID, server, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	if "" == server {
+		server = p.server()
+	}
+
+	version := p.version
+	if "" == version {
+		version = ":latest-published"
+	}
+	if _, err := strconv.Atoi(version); nil == err {
+		// Dataverse wants major.minor
+		version += ".0"
+	}
+	selected, err := p.FetchVersion(ctx, server, persistentID, version)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	record := provider.Record{
+		ID:      persistentID,
+		Title:   selected.Title(),
+		Version: selected.Name(),
+		Files:   make([]provider.File, 0, len(selected.Files)),
+	}
+	if strings.HasPrefix(persistentID, "doi:") {
+		record.DOI = strings.TrimPrefix(persistentID, "doi:")
+	}
+	for _, author := range selected.Authors() {
+		record.Details = append(record.Details, provider.Detail{Name: "author", Value: author})
+	}
+	if "" != selected.License.Name {
+		record.Details = append(record.Details, provider.Detail{Name: "license", Value: selected.License.Name})
+	}
+	// Someone who can see a draft may still not be allowed to list its
+	// versions, so the dataset is resolved without them in that case.
+	if versions, err := p.FetchVersions(ctx, server, persistentID); nil == err {
+		names := make([]string, len(versions))
+		for idx, v := range versions {
+			names[idx] = v.Name()
+		}
+		record.Details = append(record.Details, provider.Detail{Name: "versions", Value: strings.Join(names, ", ")})
+	}
+
+	headers := p.headers(server)
+	for _, file := range selected.Files {
+		record.Files = append(record.Files, p.recordFile(server, file, headers))
+	}
+	return record, nil
+}
+
+func (p *Provider) recordFile(server string, file DataverseFile, headers map[string]string) provider.File {
+	data := file.DataFile
+	downloadURL := fmt.Sprintf("%s/api/access/datafile/%d", server, data.ID)
+	name := file.Label
+	if "" == name {
+		name = data.Filename
+	}
+	size := data.Filesize
+
+	// Dataverse's checksum is of the file as uploaded, so the tab separated
+	// version it makes from tabular files can't be checked against it, but
+	// the original can.
+	checksum := ""
+	if "" != data.Checksum.Value {
+		checksum = data.Checksum.Type + ":" + data.Checksum.Value
+	} else if "" != data.MD5 {
+		checksum = "md5:" + data.MD5
+	}
+	if data.TabularData {
+		if p.tabular {
+			checksum = ""
+		} else {
+			downloadURL += "?format=original"
+			if "" != data.OriginalFileName {
+				name = data.OriginalFileName
+			}
+			if 0 != data.OriginalFileSize {
+				size = data.OriginalFileSize
+			}
+		}
+	}
+	if "" != file.DirectoryLabel {
+		name = path.Join(file.DirectoryLabel, name)
+	}
+	return provider.File{
+		ID:       strconv.Itoa(data.ID),
+		Name:     name,
+		Size:     size,
+		URL:      downloadURL,
+		Checksum: checksum,
+		Headers:  headers,
+	}
+}
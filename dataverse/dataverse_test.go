@@ -0,0 +1,253 @@
+package dataverse
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	cases := []struct {
+		identifier   string
+		persistentID string
+		server       string
+	}{
+		{"doi:10.7910/DVN/ABCDEF", "doi:10.7910/DVN/ABCDEF", ""},
+		{"10.7910/DVN/ABCDEF", "doi:10.7910/DVN/ABCDEF", ""},
+		{"https://doi.org/10.7910/DVN/ABCDEF", "doi:10.7910/DVN/ABCDEF", ""},
+		{"https://dx.doi.org/10.7910/DVN/ABCDEF", "doi:10.7910/DVN/ABCDEF", ""},
+		{"hdl:1902.1/12345", "hdl:1902.1/12345", ""},
+		{"http://hdl.handle.net/1902.1/12345", "hdl:1902.1/12345", ""},
+		{"https://hdl.handle.net/1902.1/12345", "hdl:1902.1/12345", ""},
+		{"https://dataverse.nl/dataset.xhtml?persistentId=doi:10.34894/XYZ&version=1.0", "doi:10.34894/XYZ", "https://dataverse.nl"},
+	}
+	for _, tc := range cases {
+		persistentID, server, err := ParseIdentifier(tc.identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", tc.identifier, err)
+			continue
+		}
+		if (tc.persistentID != persistentID) || (tc.server != server) {
+			t.Errorf("%s: expected %s on %q, got %s on %q", tc.identifier, tc.persistentID, tc.server, persistentID, server)
+		}
+	}
+	for _, identifier := range []string{"", "ABCDEF", "https://dataverse.nl/dataset.xhtml"} {
+		if _, _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+const (
+	originalCSV = "a,b\n1,2\n"
+	ingestedTab = "a\tb\n1\t2\n"
+	secret      = "restricted\n"
+)
+
+func versionJSON(major int, state string) string {
+	return fmt.Sprintf(`{
+		"versionNumber": %d, "versionMinorNumber": 0, "versionState": %q,
+		"license": {"name": "CC0 1.0"},
+		"metadataBlocks": {"citation": {"fields": [
+			{"typeName": "title", "multiple": false, "value": "Survey results"},
+			{"typeName": "author", "multiple": true, "value": [{"authorName": {"typeName": "authorName", "value": "Smith, Jo"}}]}
+		]}},
+		"files": [
+			{"label": "results.tab", "directoryLabel": "data", "dataFile": {
+				"id": 10, "filename": "results.tab", "filesize": %d, "tabularData": true,
+				"originalFileName": "results.csv", "originalFileSize": %d,
+				"checksum": {"type": "MD5", "value": %q}}},
+			{"label": "secret.txt", "restricted": true, "dataFile": {
+				"id": 11, "filename": "secret.txt", "filesize": %d,
+				"checksum": {"type": "MD5", "value": %q}}}
+		]
+	}`, major, state, len(ingestedTab), len(originalCSV), md5Hex(originalCSV), len(secret), md5Hex(secret))
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "doi:10.7910/DVN/ABCDEF" != r.URL.Query().Get("persistentId") && strings.HasPrefix(r.URL.Path, "/api/datasets/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": "ERROR", "message": "not found"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/api/datasets/:persistentId/versions":
+			fmt.Fprintf(w, `{"status": "OK", "data": [%s, %s]}`, versionJSON(2, "RELEASED"), versionJSON(1, "RELEASED"))
+		case "/api/datasets/:persistentId/versions/:latest-published", "/api/datasets/:persistentId/versions/2.0":
+			fmt.Fprintf(w, `{"status": "OK", "data": %s}`, versionJSON(2, "RELEASED"))
+		case "/api/datasets/:persistentId/versions/1.0":
+			fmt.Fprintf(w, `{"status": "OK", "data": %s}`, versionJSON(1, "RELEASED"))
+		case "/api/access/datafile/10":
+			if "original" == r.URL.Query().Get("format") {
+				w.Write([]byte(originalCSV))
+			} else {
+				w.Write([]byte(ingestedTab))
+			}
+		case "/api/access/datafile/11":
+			if "sekrit" != r.Header.Get("X-Dataverse-key") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(secret))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv(TokenEnv, "")
+	server := newTestServer(t)
+	p := &Provider{Server: server.URL}
+
+	record, err := p.Resolve(context.Background(), "doi:10.7910/DVN/ABCDEF")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if ("Survey results" != record.Title) || ("2.0" != record.Version) || ("10.7910/DVN/ABCDEF" != record.DOI) {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if (2 != len(record.Files)) || ("data/results.csv" != record.Files[0].Name) || (int64(len(originalCSV)) != record.Files[0].Size) {
+		t.Fatalf("unexpected files %+v", record.Files)
+	}
+	expected := []provider.Detail{
+		{Name: "author", Value: "Smith, Jo"},
+		{Name: "license", Value: "CC0 1.0"},
+		{Name: "versions", Value: "2.0, 1.0"},
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(record.Details) {
+		t.Errorf("expected details %v, got %v", expected, record.Details)
+	}
+
+	p.version = "1"
+	record, err = p.Resolve(context.Background(), "doi:10.7910/DVN/ABCDEF")
+	if (nil != err) || ("1.0" != record.Version) {
+		t.Errorf("expected version 1.0, got %+v: %v", record, err)
+	}
+
+	_, err = p.Resolve(context.Background(), "doi:10.7910/DVN/MISSING")
+	if nil == err {
+		t.Errorf("expected error for missing dataset")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	t.Setenv(TokenEnv, "")
+	server := newTestServer(t)
+	p := &Provider{}
+
+	output := t.TempDir()
+	err := provider.Run(context.Background(), p, []string{"-server", server.URL, "-filename", "data/*", "-output", output, "doi:10.7910/DVN/ABCDEF"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	contents, err := os.ReadFile(path.Join(output, "results.csv"))
+	if (nil != err) || (originalCSV != string(contents)) {
+		t.Errorf("expected original file, got %q: %v", contents, err)
+	}
+
+	err = provider.Run(context.Background(), p, []string{"-server", server.URL, "-tabular", "-filename", "data/*", "-output", output, "doi:10.7910/DVN/ABCDEF"})
+	if nil != err {
+		t.Fatalf("failed to download tabular: %v", err)
+	}
+	contents, err = os.ReadFile(path.Join(output, "results.tab"))
+	if (nil != err) || (ingestedTab != string(contents)) {
+		t.Errorf("expected ingested file, got %q: %v", contents, err)
+	}
+
+	err = provider.Run(context.Background(), p, []string{"-server", server.URL, "-filename", "secret.txt", "-output", output, "doi:10.7910/DVN/ABCDEF"})
+	if (nil == err) || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected restricted file to need a token, got %v", err)
+	}
+	t.Setenv(TokenEnv, "sekrit")
+	err = provider.Run(context.Background(), p, []string{"-server", server.URL, "-filename", "secret.txt", "-output", output, "doi:10.7910/DVN/ABCDEF"})
+	if nil != err {
+		t.Errorf("failed to download with token: %v", err)
+	}
+}
+
+func TestTokenNotSentToStorage(t *testing.T) {
+	t.Setenv(TokenEnv, "sekrit")
+	// Dataverse redirects downloads of files kept in S3 and the like
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "" != r.Header.Get("X-Dataverse-key") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("leaked token"))
+			return
+		}
+		w.Write([]byte(secret))
+	}))
+	t.Cleanup(storage.Close)
+	dataverse := newTestServer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/api/access/datafile/11" == r.URL.Path {
+			if "sekrit" != r.Header.Get("X-Dataverse-key") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, r, storage.URL+"/bucket/secret.txt", http.StatusFound)
+			return
+		}
+		dataverse.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	output := t.TempDir()
+	err := provider.Run(context.Background(), &Provider{}, []string{"-server", server.URL, "-filename", "secret.txt", "-output", output, "doi:10.7910/DVN/ABCDEF"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	contents, err := os.ReadFile(path.Join(output, "secret.txt"))
+	if (nil != err) || (secret != string(contents)) {
+		t.Errorf("expected file from storage, got %q: %v", contents, err)
+	}
+}
+
+func TestTokenOnlySentToConfiguredServer(t *testing.T) {
+	dataverse := newTestServer(t)
+	leaked := false
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "" != r.Header.Get("X-Dataverse-key") {
+			leaked = true
+		}
+		dataverse.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(other.Close)
+
+	// A link to a dataset on some other server doesn't get the key
+	p := &Provider{Token: "sekrit"}
+	_, err := p.Resolve(context.Background(), other.URL+"/dataset.xhtml?persistentId=doi:10.7910/DVN/ABCDEF")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if leaked {
+		t.Errorf("expected token not to be sent to a server only named in the URL")
+	}
+
+	// Unless that is the server the user gave
+	p.Server = other.URL + "/"
+	_, err = p.Resolve(context.Background(), other.URL+"/dataset.xhtml?persistentId=doi:10.7910/DVN/ABCDEF")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if !leaked {
+		t.Errorf("expected token to be sent to the configured server")
+	}
+}
+
+func md5Hex(contents string) string {
+	sum := md5.Sum([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
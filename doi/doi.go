@@ -0,0 +1,192 @@
+// Package doi fetches records by DOI alone, by working out which
+// repository hosts the DOI and passing it to that repository's provider.
+package doi
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultResolver = "https://doi.org/"
+
+type handleValue struct {
+	Type string `json:"type"`
+	Data struct {
+		Format string      `json:"format"`
+		Value  interface{} `json:"value"`
+	} `json:"data"`
+}
+
+type handleResponse struct {
+	ResponseCode int           `json:"responseCode"`
+	Handle       string        `json:"handle"`
+	Values       []handleValue `json:"values"`
+}
+
+// Dispatcher is a provider for any DOI from a repository that one of the
+// other providers supports.
+type Dispatcher struct {
+	// The DOI resolver, whose handle API tells us where a DOI points.
+	Resolver string
+	// The providers to choose between, which defaults to all those
+	// registered.
+	Providers []provider.Provider
+}
+
+func (d *Dispatcher) Name() string {
+	return "fetch"
+}
+
+func (d *Dispatcher) Description() string {
+	return "Any DOI, passed to the provider for the repository hosting it"
+}
+
+// The flags are those of whichever provider the DOI is passed to, so are
+// added once it is known.
+func (d *Dispatcher) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+}
+
+// ParseDOI gets the DOI itself from a DOI, which may have a doi: prefix or
+// be given as a doi.org URL.
+func ParseDOI(identifier string) (string, error) {
+	doi := provider.TrimDOI(identifier)
+	if !strings.HasPrefix(doi, "10.") || !strings.Contains(doi, "/") {
+		return "", fmt.Errorf("%q is not a DOI", identifier)
+	}
+	return doi, nil
+}
+
+func (d *Dispatcher) hosters() []provider.Hoster {
+	providers := d.Providers
+	if nil == providers {
+		providers = provider.Providers()
+	}
+	hosters := make([]provider.Hoster, 0, len(providers))
+	for _, p := range providers {
+		if hoster, ok := p.(provider.Hoster); ok {
+			hosters = append(hosters, hoster)
+		}
+	}
+	return hosters
+}
+
+// LandingPage asks the resolver where a DOI points, without following it
+// there, as the page itself is of no use.
+func (d *Dispatcher) LandingPage(ctx context.Context, doi string) (string, error) {
+	resolver := d.Resolver
+	if "" == resolver {
+		resolver = DefaultResolver
+	}
+	if !strings.HasSuffix(resolver, "/") {
+		resolver += "/"
+	}
+	var response handleResponse
+	err := utils.HTTPGetJSON(ctx, resolver+"api/handles/"+doi, nil, &response)
+	if nil != err {
+		return "", fmt.Errorf("failed to resolve %s: %w", doi, err)
+	}
+	for _, value := range response.Values {
+		if target, ok := value.Data.Value.(string); ok && ("URL" == value.Type) {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("%s does not point to a URL", doi)
+}
+
+func hostMatches(pattern string, host string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(host, pattern)
+	}
+	return pattern == host
+}
+
+// prefixMatches checks a DOI against a prefix from DOIPrefixes, which is
+// either a whole registrant prefix or, where the registrant is shared, the
+// start of the DOI as a whole.
+func prefixMatches(candidate string, doi string) bool {
+	doi, candidate = strings.ToLower(doi), strings.ToLower(candidate)
+	if !strings.Contains(candidate, "/") {
+		candidate += "/"
+	}
+	return strings.HasPrefix(doi, candidate)
+}
+
+// Route finds the provider for a DOI, and the identifier to give it. The
+// DOI prefixes of the repositories that mint their own DOIs are checked
+// first, and otherwise the DOI is resolved and the host it points to
+// decides.
+func (d *Dispatcher) Route(ctx context.Context, identifier string) (provider.Provider, string, error) {
+	doi, err := ParseDOI(identifier)
+	if nil != err {
+		return nil, "", err
+	}
+	hosters := d.hosters()
+
+	for _, hoster := range hosters {
+		for _, candidate := range hoster.DOIPrefixes() {
+			if prefixMatches(candidate, doi) {
+				return hoster.(provider.Provider), "doi:" + doi, nil
+			}
+		}
+	}
+
+	landing, err := d.LandingPage(ctx, doi)
+	if nil != err {
+		return nil, "", err
+	}
+	parsed, err := url.Parse(landing)
+	if nil != err {
+		return nil, "", fmt.Errorf("%s points to an invalid URL %s: %w", doi, landing, err)
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	for _, hoster := range hosters {
+		for _, candidate := range hoster.Hosts() {
+			if hostMatches(candidate, host) {
+				return hoster.(provider.Provider), landing, nil
+			}
+		}
+	}
+
+	supported := make([]string, 0, len(hosters))
+	for _, hoster := range hosters {
+		supported = append(supported, fmt.Sprintf("%s (%s)", hoster.(provider.Provider).Name(), strings.Join(hoster.Hosts(), ", ")))
+	}
+	sort.Strings(supported)
+	return nil, "", fmt.Errorf("%s is hosted at %s, which no provider supports. Supported repositories are: %s", doi, host, strings.Join(supported, "; "))
+}
+
+func (d *Dispatcher) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	p, id, err := d.Route(ctx, identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	return p.Resolve(ctx, id)
+}
+
+// Command takes the DOI as the first or last argument, so that the rest can
+// be the flags of the provider it is passed to.
+func (d *Dispatcher) Command(ctx context.Context, args []string) error {
+	if 0 == len(args) {
+		return fmt.Errorf("a DOI is required, e.g. %s doi:10.5281/zenodo.1234567 -files data.csv", d.Name())
+	}
+	var identifier string
+	var rest []string
+	if !strings.HasPrefix(args[0], "-") {
+		identifier, rest = args[0], args[1:]
+	} else {
+		identifier, rest = args[len(args)-1], args[:len(args)-1]
+	}
+
+	p, id, err := d.Route(ctx, identifier)
+	if nil != err {
+		return err
+	}
+	return provider.Run(ctx, p, append(append([]string{}, rest...), id))
+}
@@ -0,0 +1,187 @@
+package doi
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/pangaea"
+	"quantify.earth/reclaimer/provider"
+)
+
+type fakeHoster struct {
+	name     string
+	prefixes []string
+	hosts    []string
+
+	version  string
+	resolved string
+}
+
+func (f *fakeHoster) Name() string          { return f.name }
+func (f *fakeHoster) Description() string   { return "for testing" }
+func (f *fakeHoster) DOIPrefixes() []string { return f.prefixes }
+func (f *fakeHoster) Hosts() []string       { return f.hosts }
+
+func (f *fakeHoster) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	flagset.StringVar(&f.version, "version", "", "")
+}
+
+func (f *fakeHoster) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	f.resolved = identifier
+	return provider.Record{ID: identifier}, nil
+}
+
+// A provider that isn't for a repository, so is never picked.
+type fakeOther struct{}
+
+func (f *fakeOther) Name() string                                              { return "other" }
+func (f *fakeOther) Description() string                                       { return "for testing" }
+func (f *fakeOther) AddFlags(flagset *flag.FlagSet, options *provider.Options) {}
+func (f *fakeOther) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	return provider.Record{}, fmt.Errorf("should not be used")
+}
+
+var landingPages = map[string]string{
+	"10.9999/inst.1":      "https://data.example.org/dataset.xhtml?persistentId=doi:10.9999/inst.1",
+	"10.8888/abc":         "https://www.repo.example.com/records/abc",
+	"10.7777/xyz":         "https://journal.example.net/articles/xyz",
+	"10.1594/IEDA.100001": "https://www.marine-geo.org/tools/search/Files.php?data_set_uid=100001",
+}
+
+func newTestDispatcher(t *testing.T) (*Dispatcher, *fakeHoster, *fakeHoster) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doi := strings.TrimPrefix(r.URL.Path, "/api/handles/")
+		landing, ok := landingPages[doi]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"responseCode": 100}`))
+			return
+		}
+		fmt.Fprintf(w, `{"responseCode": 1, "handle": %q, "values": [
+			{"index": 100, "type": "HS_ADMIN", "data": {"format": "admin", "value": {"index": 200}}},
+			{"index": 1, "type": "URL", "data": {"format": "string", "value": %q}}]}`, doi, landing)
+	}))
+	t.Cleanup(server.Close)
+
+	minting := &fakeHoster{name: "minting", prefixes: []string{"10.1234"}, hosts: []string{"repo.example.com"}}
+	installed := &fakeHoster{name: "installed", hosts: []string{".example.org"}}
+	dispatcher := &Dispatcher{
+		Resolver:  server.URL,
+		Providers: []provider.Provider{&fakeOther{}, minting, installed},
+	}
+	return dispatcher, minting, installed
+}
+
+func TestParseDOI(t *testing.T) {
+	for _, identifier := range []string{
+		"10.1234/abc.5",
+		"doi:10.1234/abc.5",
+		"https://doi.org/10.1234/abc.5",
+		"http://dx.doi.org/10.1234/abc.5",
+	} {
+		doi, err := ParseDOI(identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", identifier, err)
+		} else if "10.1234/abc.5" != doi {
+			t.Errorf("%s: expected 10.1234/abc.5, got %s", identifier, doi)
+		}
+	}
+	for _, identifier := range []string{"", "12345", "10.1234", "https://example.com/10.1234/abc"} {
+		if _, err := ParseDOI(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	dispatcher, minting, installed := newTestDispatcher(t)
+
+	tests := []struct {
+		identifier string
+		provider   provider.Provider
+		id         string
+	}{
+		// By prefix, without resolving
+		{"doi:10.1234/anything", minting, "doi:10.1234/anything"},
+		// By the host it resolves to, including subdomains
+		{"10.8888/abc", minting, landingPages["10.8888/abc"]},
+		{"https://doi.org/10.9999/inst.1", installed, landingPages["10.9999/inst.1"]},
+	}
+	for _, test := range tests {
+		p, id, err := dispatcher.Route(context.Background(), test.identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", test.identifier, err)
+			continue
+		}
+		if test.provider != p {
+			t.Errorf("%s: expected %s, got %s", test.identifier, test.provider.Name(), p.Name())
+		}
+		if test.id != id {
+			t.Errorf("%s: expected identifier %s, got %s", test.identifier, test.id, id)
+		}
+	}
+}
+
+func TestRouteUnsupported(t *testing.T) {
+	dispatcher, _, _ := newTestDispatcher(t)
+
+	_, _, err := dispatcher.Route(context.Background(), "10.7777/xyz")
+	if nil == err {
+		t.Fatalf("expected error")
+	}
+	for _, expected := range []string{"journal.example.net", "minting (repo.example.com)", "installed (.example.org)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q, got %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "other") {
+		t.Errorf("expected error to only list repositories, got %v", err)
+	}
+
+	_, _, err = dispatcher.Route(context.Background(), "10.7777/missing")
+	if (nil == err) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected unknown DOI to fail, got %v", err)
+	}
+}
+
+func TestRouteSharedPrefix(t *testing.T) {
+	dispatcher, _, _ := newTestDispatcher(t)
+	pangaeaProvider := &pangaea.Provider{}
+	dispatcher.Providers = []provider.Provider{pangaeaProvider}
+
+	p, _, err := dispatcher.Route(context.Background(), "doi:10.1594/pangaea.912345")
+	if (nil != err) || (pangaeaProvider != p) {
+		t.Errorf("expected PANGAEA DOI to go to pangaea, got %v: %v", p, err)
+	}
+
+	// Other repositories' DOIs under the same prefix aren't PANGAEA's
+	_, _, err = dispatcher.Route(context.Background(), "10.1594/IEDA.100001")
+	if (nil == err) || !strings.Contains(err.Error(), "marine-geo.org") || !strings.Contains(err.Error(), "pangaea (") {
+		t.Errorf("expected unsupported repository error, got %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	for _, args := range [][]string{
+		{"doi:10.1234/abc", "-version", "2", "-json"},
+		{"-version", "2", "-json", "doi:10.1234/abc"},
+	} {
+		dispatcher, minting, _ := newTestDispatcher(t)
+		err := dispatcher.Command(context.Background(), args)
+		if nil != err {
+			t.Errorf("%v: unexpected error: %v", args, err)
+			continue
+		}
+		if "doi:10.1234/abc" != minting.resolved {
+			t.Errorf("%v: expected DOI to be resolved, got %q", args, minting.resolved)
+		}
+		if "2" != minting.version {
+			t.Errorf("%v: expected provider's flags to be parsed, got version %q", args, minting.version)
+		}
+	}
+}
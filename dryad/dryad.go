@@ -0,0 +1,300 @@
+// Package dryad fetches datasets from the Dryad data repository.
+package dryad
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultBaseURL = "https://datadryad.org/"
+
+// The API is HAL, so everything refers to everything else by links.
+type DryadLink struct {
+	Href string `json:"href"`
+}
+
+type DryadAuthor struct {
+	FirstName   string `json:"firstName"`
+	LastName    string `json:"lastName"`
+	Affiliation string `json:"affiliation"`
+}
+
+type DryadDataset struct {
+	Identifier       string               `json:"identifier"`
+	Title            string               `json:"title"`
+	Abstract         string               `json:"abstract"`
+	Authors          []DryadAuthor        `json:"authors"`
+	License          string               `json:"license"`
+	VersionNumber    int                  `json:"versionNumber"`
+	PublicationDate  string               `json:"publicationDate"`
+	StorageSize      int64                `json:"storageSize"`
+	VisibilityStatus string               `json:"visibility"`
+	Links            map[string]DryadLink `json:"_links"`
+}
+
+type DryadVersion struct {
+	VersionNumber int                  `json:"versionNumber"`
+	VersionStatus string               `json:"versionStatus"`
+	LastModified  string               `json:"lastModificationDate"`
+	StorageSize   int64                `json:"storageSize"`
+	Links         map[string]DryadLink `json:"_links"`
+}
+
+type DryadFile struct {
+	Path       string               `json:"path"`
+	Size       int64                `json:"size"`
+	MimeType   string               `json:"mimeType"`
+	Digest     string               `json:"digest"`
+	DigestType string               `json:"digestType"`
+	Links      map[string]DryadLink `json:"_links"`
+}
+
+type dryadVersionPage struct {
+	Links    map[string]DryadLink `json:"_links"`
+	Embedded struct {
+		Versions []DryadVersion `json:"stash:versions"`
+	} `json:"_embedded"`
+}
+
+type dryadFilePage struct {
+	Links    map[string]DryadLink `json:"_links"`
+	Embedded struct {
+		Files []DryadFile `json:"stash:files"`
+	} `json:"_embedded"`
+}
+
+// Provider fetches datasets from datadryad.org, or another Dryad instance
+// if BaseURL is set.
+type Provider struct {
+	BaseURL string
+
+	version int
+	zip     bool
+}
+
+func (p *Provider) Name() string {
+	return "dryad"
+}
+
+func (p *Provider) Description() string {
+	return "Dryad datasets, by DOI or URL"
+}
+
+func (p *Provider) DOIPrefixes() []string {
+	return []string{"10.5061"}
+}
+
+func (p *Provider) Hosts() []string {
+	return []string{"datadryad.org"}
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	flagset.Var(&options.Files, "filename", "Specific item within dataset to download")
+	flagset.IntVar(&p.version, "version", 0, "Version of the dataset to fetch, defaults to the latest")
+	flagset.BoolVar(&p.zip, "zip", false, "List the whole version as a single zip file rather than its individual files")
+}
+
+var dryadDOIPattern = regexp.MustCompile(`(?i)10\.5061/dryad\.[a-z0-9]+`)
+
+// ParseIdentifier finds the DOI in a DOI or Dryad URL. Every Dryad dataset
+// has a DOI, and it is how the API identifies them.
+func ParseIdentifier(identifier string) (string, error) {
+	// URLs may have the DOI escaped
+	if unescaped, err := url.PathUnescape(identifier); nil == err {
+		identifier = unescaped
+	}
+	match := dryadDOIPattern.FindString(identifier)
+	if "" == match {
+		return "", fmt.Errorf("%q is not a Dryad DOI or URL", identifier)
+	}
+	return "10.5061/dryad." + strings.ToLower(match[len("10.5061/dryad."):]), nil
+}
+
+// link turns an href from the API, which is usually relative to the server,
+// into a full URL.
+func (p *Provider) link(href string) (string, error) {
+	base := p.BaseURL
+	if "" == base {
+		base = DefaultBaseURL
+	}
+	baseURL, err := url.Parse(base)
+	if nil != err {
+		return "", fmt.Errorf("invalid base URL %s: %w", base, err)
+	}
+	ref, err := url.Parse(href)
+	if nil != err {
+		return "", fmt.Errorf("invalid link %s: %w", href, err)
+	}
+	return baseURL.ResolveReference(ref).String(), nil
+}
+
+func (p *Provider) get(ctx context.Context, href string, result interface{}) error {
+	target, err := p.link(href)
+	if nil != err {
+		return err
+	}
+	return utils.HTTPGetJSON(ctx, target, nil, result)
+}
+
+func (p *Provider) FetchDataset(ctx context.Context, doi string) (DryadDataset, error) {
+	var dataset DryadDataset
+	err := p.get(ctx, "/api/v2/datasets/"+url.QueryEscape("doi:"+doi), &dataset)
+	if nil != err {
+		return DryadDataset{}, err
+	}
+	return dataset, nil
+}
+
+func (p *Provider) FetchVersions(ctx context.Context, dataset DryadDataset) ([]DryadVersion, error) {
+	link, ok := dataset.Links["stash:versions"]
+	if !ok {
+		return nil, fmt.Errorf("dataset has no versions")
+	}
+	versions := make([]DryadVersion, 0)
+	for href := link.Href; "" != href; {
+		var page dryadVersionPage
+		err := p.get(ctx, href, &page)
+		if nil != err {
+			return nil, err
+		}
+		versions = append(versions, page.Embedded.Versions...)
+		href = page.Links["next"].Href
+	}
+	return versions, nil
+}
+
+func (p *Provider) FetchFiles(ctx context.Context, version DryadVersion) ([]DryadFile, error) {
+	link, ok := version.Links["stash:files"]
+	if !ok {
+		return nil, fmt.Errorf("version has no files")
+	}
+	files := make([]DryadFile, 0)
+	for href := link.Href; "" != href; {
+		var page dryadFilePage
+		err := p.get(ctx, href, &page)
+		if nil != err {
+			return nil, err
+		}
+		files = append(files, page.Embedded.Files...)
+		href = page.Links["next"].Href
+	}
+	return files, nil
+}
+
+// Only published versions can be downloaded, so by default we want the most
+// recent of those, which may not be the most recent version. Embargoed
+// versions are public in name only until the embargo ends.
+func selectVersion(versions []DryadVersion, number int) (DryadVersion, error) {
+	var selected *DryadVersion
+	for idx, version := range versions {
+		if 0 != number {
+			if number == version.VersionNumber {
+				return version, nil
+			}
+			continue
+		}
+		if ("" != version.VersionStatus) && ("published" != version.VersionStatus) {
+			continue
+		}
+		if (nil == selected) || (version.VersionNumber > selected.VersionNumber) {
+			selected = &versions[idx]
+		}
+	}
+	if 0 != number {
+		return DryadVersion{}, fmt.Errorf("dataset has no version %d", number)
+	}
+	if nil == selected {
+		return DryadVersion{}, fmt.Errorf("dataset has no published versions")
+	}
+	return *selected, nil
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	doi, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	dataset, err := p.FetchDataset(ctx, doi)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	versions, err := p.FetchVersions(ctx, dataset)
+	if nil != err {
+		return provider.Record{}, fmt.Errorf("failed to list versions: %w", err)
+	}
+	version, err := selectVersion(versions, p.version)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	record := provider.Record{
+		ID:      doi,
+		Title:   dataset.Title,
+		DOI:     doi,
+		Version: strconv.Itoa(version.VersionNumber),
+	}
+	for _, author := range dataset.Authors {
+		value := strings.TrimSpace(author.FirstName + " " + author.LastName)
+		if "" != author.Affiliation {
+			value = fmt.Sprintf("%s, %s", value, author.Affiliation)
+		}
+		record.Details = append(record.Details, provider.Detail{Name: "author", Value: value})
+	}
+	if "" != dataset.License {
+		record.Details = append(record.Details, provider.Detail{Name: "license", Value: dataset.License})
+	}
+	numbers := make([]string, len(versions))
+	for idx, v := range versions {
+		numbers[idx] = strconv.Itoa(v.VersionNumber)
+	}
+	record.Details = append(record.Details, provider.Detail{Name: "versions", Value: strings.Join(numbers, ", ")})
+
+	if p.zip {
+		download, ok := version.Links["stash:download"]
+		if !ok {
+			return provider.Record{}, fmt.Errorf("version %d can not be downloaded as a whole", version.VersionNumber)
+		}
+		downloadURL, err := p.link(download.Href)
+		if nil != err {
+			return provider.Record{}, err
+		}
+		name := fmt.Sprintf("%s_v%d.zip", strings.ReplaceAll(path.Base(doi), ".", "_"), version.VersionNumber)
+		record.Files = []provider.File{{Name: name, Size: version.StorageSize, URL: downloadURL}}
+		return record, nil
+	}
+
+	files, err := p.FetchFiles(ctx, version)
+	if nil != err {
+		return provider.Record{}, fmt.Errorf("failed to list files: %w", err)
+	}
+	record.Files = make([]provider.File, 0, len(files))
+	for _, file := range files {
+		downloadURL := ""
+		if download, ok := file.Links["stash:download"]; ok {
+			downloadURL, err = p.link(download.Href)
+			if nil != err {
+				return provider.Record{}, err
+			}
+		}
+		checksum := ""
+		if ("" != file.Digest) && ("" != file.DigestType) {
+			checksum = file.DigestType + ":" + file.Digest
+		}
+		record.Files = append(record.Files, provider.File{
+			Name:     file.Path,
+			Size:     file.Size,
+			URL:      downloadURL,
+			Checksum: checksum,
+		})
+	}
+	return record, nil
+}
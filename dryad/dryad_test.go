@@ -0,0 +1,206 @@
+package dryad
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	for _, identifier := range []string{
+		"10.5061/dryad.abc123",
+		"doi:10.5061/dryad.ABC123",
+		"https://doi.org/10.5061/dryad.abc123",
+		"https://datadryad.org/stash/dataset/doi:10.5061/dryad.abc123",
+		"https://datadryad.org/api/v2/datasets/doi%3A10.5061%2Fdryad.abc123",
+	} {
+		doi, err := ParseIdentifier(identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", identifier, err)
+		} else if "10.5061/dryad.abc123" != doi {
+			t.Errorf("%s: expected 10.5061/dryad.abc123, got %s", identifier, doi)
+		}
+	}
+	for _, identifier := range []string{"", "12345", "10.5281/zenodo.123"} {
+		if _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+var testFiles = map[string]string{
+	"1": "site,count\na,1\n",
+	"2": "readme\n",
+	"3": "site,count\na,2\n",
+}
+
+func digest(contents string, algorithm string) string {
+	if "md5" == algorithm {
+		sum := md5.Sum([]byte(contents))
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func fileJSON(id string, name string, algorithm string) string {
+	return fmt.Sprintf(`{"path": %q, "size": %d, "digest": %q, "digestType": %q, "_links": {"stash:download": {"href": "/api/v2/files/%s/download"}}}`,
+		name, len(testFiles[id]), digest(testFiles[id], algorithm), algorithm, id)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/datasets/doi:10.5061/dryad.abc123":
+			w.Write([]byte(`{
+				"identifier": "doi:10.5061/dryad.abc123", "title": "Counts",
+				"authors": [{"firstName": "Ada", "lastName": "Lovelace", "affiliation": "Analytical"}],
+				"license": "https://spdx.org/licenses/CC0-1.0.html",
+				"_links": {"stash:versions": {"href": "/api/v2/datasets/doi%3A10.5061%2Fdryad.abc123/versions"}}
+			}`))
+		case "/api/v2/datasets/doi:10.5061/dryad.abc123/versions":
+			w.Write([]byte(`{"_embedded": {"stash:versions": [
+				{"versionNumber": 1, "versionStatus": "published", "_links": {"stash:files": {"href": "/api/v2/versions/11/files"}, "stash:download": {"href": "/api/v2/versions/11/download"}}},
+				{"versionNumber": 2, "versionStatus": "published", "_links": {"stash:files": {"href": "/api/v2/versions/12/files"}, "stash:download": {"href": "/api/v2/versions/12/download"}}},
+				{"versionNumber": 3, "versionStatus": "in_progress", "_links": {"stash:files": {"href": "/api/v2/versions/13/files"}}}
+			]}}`))
+		case "/api/v2/versions/11/files":
+			w.Write([]byte(`{"_embedded": {"stash:files": [` + fileJSON("1", "counts.csv", "md5") + `]}}`))
+		case "/api/v2/versions/12/files":
+			// Paged
+			if "2" == r.URL.Query().Get("page") {
+				w.Write([]byte(`{"_embedded": {"stash:files": [` + fileJSON("2", "README.md", "sha-256") + `]}}`))
+			} else {
+				w.Write([]byte(`{"_links": {"next": {"href": "/api/v2/versions/12/files?page=2"}}, "_embedded": {"stash:files": [` + fileJSON("3", "counts.csv", "md5") + `]}}`))
+			}
+		case "/api/v2/versions/12/download":
+			var buffer bytes.Buffer
+			archive := zip.NewWriter(&buffer)
+			for name, id := range map[string]string{"counts.csv": "3", "README.md": "2"} {
+				out, _ := archive.Create(name)
+				out.Write([]byte(testFiles[id]))
+			}
+			archive.Close()
+			w.Write(buffer.Bytes())
+		default:
+			if strings.HasPrefix(r.URL.Path, "/api/v2/files/") {
+				id := strings.Split(r.URL.Path, "/")[4]
+				if contents, ok := testFiles[id]; ok {
+					w.Write([]byte(contents))
+					return
+				}
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSelectVersion(t *testing.T) {
+	versions := []DryadVersion{
+		{VersionNumber: 1, VersionStatus: "published"},
+		{VersionNumber: 2, VersionStatus: ""},
+		{VersionNumber: 3, VersionStatus: "embargoed"},
+		{VersionNumber: 4, VersionStatus: "in_progress"},
+	}
+	tests := []struct {
+		versions []DryadVersion
+		number   int
+		expected int
+	}{
+		// Versions without a status are taken to be published
+		{versions, 0, 2},
+		{versions[:1], 0, 1},
+		// Asking for a version gets it whatever its status
+		{versions, 4, 4},
+		{versions, 3, 3},
+	}
+	for _, test := range tests {
+		selected, err := selectVersion(test.versions, test.number)
+		if nil != err {
+			t.Errorf("%d of %d: unexpected error: %v", test.number, len(test.versions), err)
+		} else if test.expected != selected.VersionNumber {
+			t.Errorf("%d of %d: expected version %d, got %d", test.number, len(test.versions), test.expected, selected.VersionNumber)
+		}
+	}
+
+	if _, err := selectVersion(versions[2:], 0); nil == err {
+		t.Errorf("expected error with only embargoed and unpublished versions")
+	}
+	if _, err := selectVersion(versions, 5); nil == err {
+		t.Errorf("expected error for a missing version")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL}
+
+	record, err := p.Resolve(context.Background(), "doi:10.5061/dryad.abc123")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	// The latest published version, not the one in progress
+	if "2" != record.Version {
+		t.Errorf("expected version 2, got %s", record.Version)
+	}
+	if (2 != len(record.Files)) || ("counts.csv" != record.Files[0].Name) || ("README.md" != record.Files[1].Name) {
+		t.Fatalf("unexpected files %+v", record.Files)
+	}
+	if !strings.HasPrefix(record.Files[1].Checksum, "sha-256:") {
+		t.Errorf("unexpected checksum %s", record.Files[1].Checksum)
+	}
+
+	p.version = 1
+	record, err = p.Resolve(context.Background(), "10.5061/dryad.abc123")
+	if (nil != err) || ("1" != record.Version) || (1 != len(record.Files)) {
+		t.Errorf("expected version 1, got %+v: %v", record, err)
+	}
+
+	p.version = 7
+	_, err = p.Resolve(context.Background(), "10.5061/dryad.abc123")
+	if nil == err {
+		t.Errorf("expected error for missing version")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL}
+
+	output := t.TempDir()
+	err := provider.Run(context.Background(), p, []string{"-all", "-output", output, "10.5061/dryad.abc123"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	for name, id := range map[string]string{"counts.csv": "3", "README.md": "2"} {
+		contents, err := os.ReadFile(path.Join(output, name))
+		if (nil != err) || (testFiles[id] != string(contents)) {
+			t.Errorf("%s: unexpected contents %q: %v", name, contents, err)
+		}
+	}
+
+	// The whole version, unpacked
+	output = t.TempDir()
+	err = provider.Run(context.Background(), p, []string{"-zip", "-all", "-extract", "-output", output, "10.5061/dryad.abc123"})
+	if nil != err {
+		t.Fatalf("failed to download zip: %v", err)
+	}
+	contents, err := os.ReadFile(path.Join(output, "counts.csv"))
+	if (nil != err) || (testFiles["3"] != string(contents)) {
+		t.Errorf("unexpected extracted contents %q: %v", contents, err)
+	}
+}
@@ -0,0 +1,249 @@
+// Package figshare fetches articles from Figshare and the institutional
+// repositories built on it.
+package figshare
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultBaseURL = "https://api.figshare.com/v2/"
+
+type FigshareAuthor struct {
+	ID       int    `json:"id"`
+	FullName string `json:"full_name"`
+	ORCID    string `json:"orcid_id"`
+}
+
+type FigshareLicense struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type FigshareFile struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	DownloadURL  string `json:"download_url"`
+	SuppliedMD5  string `json:"supplied_md5"`
+	ComputedMD5  string `json:"computed_md5"`
+	IsLinkOnly   bool   `json:"is_link_only"`
+	MimeType     string `json:"mimetype"`
+	UploadStatus string `json:"status"`
+}
+
+type FigshareArticle struct {
+	ID            int              `json:"id"`
+	Title         string           `json:"title"`
+	DOI           string           `json:"doi"`
+	URL           string           `json:"url"`
+	Version       int              `json:"version"`
+	PublishedDate string           `json:"published_date"`
+	Description   string           `json:"description"`
+	DefinedType   string           `json:"defined_type_name"`
+	Authors       []FigshareAuthor `json:"authors"`
+	License       FigshareLicense  `json:"license"`
+	Files         []FigshareFile   `json:"files"`
+}
+
+type FigshareVersion struct {
+	Version int    `json:"version"`
+	URL     string `json:"url"`
+}
+
+// Provider fetches articles from figshare.com, or another Figshare
+// instance's API if BaseURL is set.
+type Provider struct {
+	BaseURL string
+
+	// Set by -version, overriding any version in the identifier.
+	version int
+}
+
+func (p *Provider) Name() string {
+	return "figshare"
+}
+
+func (p *Provider) Description() string {
+	return "Figshare articles, by ID, DOI or URL"
+}
+
+func (p *Provider) DOIPrefixes() []string {
+	prefixes := make([]string, len(figshareDOIs))
+	for idx, doi := range figshareDOIs {
+		prefixes[idx] = doi.prefix
+	}
+	return prefixes
+}
+
+func (p *Provider) Hosts() []string {
+	return []string{"figshare.com", ".figshare.com"}
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	// The same names as the zenodo command
+	flagset.StringVar(&options.ID, "figshare_id", "", "Figshare ID of article")
+	flagset.Var(&options.Files, "filename", "Specific item within article to download")
+	flagset.IntVar(&p.version, "version", 0, "Version of the article to fetch, defaults to the version in the identifier or else the latest")
+}
+
+// Figshare DOIs end in the article ID and optionally the version, e.g.
+// 10.6084/m9.figshare.1234567.v2. Institutional repositories mint DOIs with
+// their own prefixes, so only those we know of are taken, as plenty of
+// other DOIs end in a number too.
+var figshareDOIs = []struct {
+	prefix  string
+	pattern *regexp.Regexp
+}{
+	{"10.6084", regexp.MustCompile(`(?i)^10\.6084/m9\.figshare\.(\d+)(?:\.v(\d+))?$`)},
+	// Newcastle University
+	{"10.25405", regexp.MustCompile(`(?i)^10\.25405/data\.ncl\.(\d+)(?:\.v(\d+))?$`)},
+	// University of Sheffield
+	{"10.15131", regexp.MustCompile(`(?i)^10\.15131/shef\.data\.(\d+)(?:\.v(\d+))?$`)},
+	// Loughborough University
+	{"10.17028", regexp.MustCompile(`(?i)^10\.17028/rd\.lboro\.(\d+)(?:\.v(\d+))?$`)},
+	// Brunel University London
+	{"10.17633", regexp.MustCompile(`(?i)^10\.17633/rd\.brunel\.(\d+)(?:\.v(\d+))?$`)},
+}
+
+var numericPattern = regexp.MustCompile(`^\d+$`)
+
+// ParseIdentifier gets the article ID and version, which is zero if not
+// given, from an ID, DOI, or figshare.com URL.
+func ParseIdentifier(identifier string) (int, int, error) {
+	identifier = strings.TrimSpace(identifier)
+	if id, err := strconv.Atoi(identifier); nil == err {
+		return id, 0, nil
+	}
+
+	doi := provider.TrimDOI(identifier)
+	for _, known := range figshareDOIs {
+		if match := known.pattern.FindStringSubmatch(doi); nil != match {
+			id, _ := strconv.Atoi(match[1])
+			version, _ := strconv.Atoi(match[2])
+			return id, version, nil
+		}
+	}
+
+	// Article pages are /articles/TYPE/SLUG/ID, optionally followed by the
+	// version, on figshare.com or an institution's subdomain of it. Slugs
+	// can be numbers too, so only the fifth part is ever the version.
+	parsed, err := url.Parse(identifier)
+	if (nil == err) && isFigshareHost(parsed.Hostname()) {
+		parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		if (len(parts) > 2) && ("articles" == parts[0]) {
+			if (5 == len(parts)) && numericPattern.MatchString(parts[3]) && numericPattern.MatchString(parts[4]) {
+				id, _ := strconv.Atoi(parts[3])
+				version, _ := strconv.Atoi(parts[4])
+				return id, version, nil
+			}
+			last := len(parts) - 1
+			if numericPattern.MatchString(parts[last]) {
+				id, _ := strconv.Atoi(parts[last])
+				return id, 0, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("%q is not a Figshare article ID, DOI, or URL", identifier)
+}
+
+func isFigshareHost(host string) bool {
+	host = strings.ToLower(host)
+	return ("figshare.com" == host) || strings.HasSuffix(host, ".figshare.com")
+}
+
+func (p *Provider) endpoint(path string) string {
+	return provider.Endpoint(p.BaseURL, DefaultBaseURL, path)
+}
+
+// FetchArticle gets an article, at the given version or the latest if the
+// version is zero.
+func (p *Provider) FetchArticle(ctx context.Context, id int, version int) (FigshareArticle, error) {
+	path := fmt.Sprintf("articles/%d", id)
+	if 0 != version {
+		path = fmt.Sprintf("articles/%d/versions/%d", id, version)
+	}
+	var article FigshareArticle
+	err := utils.HTTPGetJSON(ctx, p.endpoint(path), nil, &article)
+	if nil != err {
+		return FigshareArticle{}, err
+	}
+	return article, nil
+}
+
+func (p *Provider) FetchVersions(ctx context.Context, id int) ([]FigshareVersion, error) {
+	var versions []FigshareVersion
+	err := utils.HTTPGetJSON(ctx, p.endpoint(fmt.Sprintf("articles/%d/versions", id)), nil, &versions)
+	if nil != err {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	id, version, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	if 0 != p.version {
+		version = p.version
+	}
+
+	article, err := p.FetchArticle(ctx, id, version)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	record := provider.Record{
+		ID:      strconv.Itoa(article.ID),
+		Title:   article.Title,
+		DOI:     article.DOI,
+		Version: strconv.Itoa(article.Version),
+		Files:   make([]provider.File, 0, len(article.Files)),
+	}
+	for _, author := range article.Authors {
+		record.Details = append(record.Details, provider.Detail{Name: "author", Value: author.FullName})
+	}
+	if "" != article.License.Name {
+		record.Details = append(record.Details, provider.Detail{Name: "license", Value: article.License.Name})
+	}
+	// Versions are a separate call, and most articles only have the one,
+	// so an article is still usable if they can't be listed.
+	if versions, err := p.FetchVersions(ctx, id); (nil == err) && (1 < len(versions)) {
+		numbers := make([]string, len(versions))
+		for idx, v := range versions {
+			numbers[idx] = strconv.Itoa(v.Version)
+		}
+		record.Details = append(record.Details, provider.Detail{Name: "versions", Value: strings.Join(numbers, ", ")})
+	}
+
+	for _, file := range article.Files {
+		// The MD5 the depositor supplied is the one to trust, but not
+		// everyone supplies one, and files that are only links to
+		// elsewhere have neither.
+		checksum := ""
+		if !file.IsLinkOnly {
+			if "" != file.SuppliedMD5 {
+				checksum = "md5:" + file.SuppliedMD5
+			} else if "" != file.ComputedMD5 {
+				checksum = "md5:" + file.ComputedMD5
+			}
+		}
+		record.Files = append(record.Files, provider.File{
+			ID:       strconv.Itoa(file.ID),
+			Name:     file.Name,
+			Size:     file.Size,
+			URL:      file.DownloadURL,
+			Checksum: checksum,
+		})
+	}
+	return record, nil
+}
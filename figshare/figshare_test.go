@@ -0,0 +1,159 @@
+package figshare
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	cases := []struct {
+		identifier string
+		id         int
+		version    int
+	}{
+		{"1234567", 1234567, 0},
+		{"10.6084/m9.figshare.1234567", 1234567, 0},
+		{"doi:10.6084/m9.figshare.1234567.v3", 1234567, 3},
+		{"https://doi.org/10.6084/m9.figshare.1234567.v3", 1234567, 3},
+		{"10.25405/data.ncl.1234567.v1", 1234567, 1},
+		{"10.15131/shef.data.1234567", 1234567, 0},
+		{"https://figshare.com/articles/dataset/Some_data/1234567", 1234567, 0},
+		{"https://figshare.com/articles/dataset/Some_data/1234567/2", 1234567, 2},
+		{"https://figshare.com/articles/Some_data/1234567", 1234567, 0},
+		{"https://rdr.ucl.ac.uk.figshare.com/articles/dataset/x/1234567/1", 1234567, 1},
+		{"https://figshare.com/articles/dataset/2018/1234567", 1234567, 0},
+		{"https://figshare.com/articles/dataset/2018/1234567/2", 1234567, 2},
+	}
+	for _, tc := range cases {
+		id, version, err := ParseIdentifier(tc.identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", tc.identifier, err)
+			continue
+		}
+		if (tc.id != id) || (tc.version != version) {
+			t.Errorf("%s: expected %d v%d, got %d v%d", tc.identifier, tc.id, tc.version, id, version)
+		}
+	}
+
+	for _, identifier := range []string{
+		"",
+		"not an id",
+		"https://example.com/articles/dataset/x/1",
+		"https://evilfigshare.com/articles/dataset/x/1234567",
+		"10.5281/zenodo.123",
+		"doi:10.1234/journal.pone.0123456",
+	} {
+		if _, _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+const (
+	dataV1 = "version,1\n"
+	dataV2 = "version,2\n"
+	notes  = "some notes\n"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	article := func(version int, data string) string {
+		dataMD5, notesMD5 := md5Hex(data), md5Hex(notes)
+		return fmt.Sprintf(`{
+			"id": 42, "title": "Test article", "doi": "10.6084/m9.figshare.42.v%d", "version": %d,
+			"authors": [{"full_name": "A. Author"}],
+			"license": {"name": "CC BY 4.0"},
+			"files": [
+				{"id": 1, "name": "data.csv", "size": %d, "download_url": "%s/files/data-v%d.csv", "supplied_md5": "%s", "computed_md5": "%s"},
+				{"id": 2, "name": "notes.txt", "size": %d, "download_url": "%s/files/notes.txt", "supplied_md5": "", "computed_md5": "%s"}
+			]
+		}`, version, version, len(data), server.URL, version, dataMD5, dataMD5, len(notes), server.URL, notesMD5)
+	}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/articles/42", "/v2/articles/42/versions/2":
+			w.Write([]byte(article(2, dataV2)))
+		case "/v2/articles/42/versions/1":
+			w.Write([]byte(article(1, dataV1)))
+		case "/v2/articles/42/versions":
+			w.Write([]byte(`[{"version": 1, "url": "x"}, {"version": 2, "url": "y"}]`))
+		case "/files/data-v1.csv":
+			w.Write([]byte(dataV1))
+		case "/files/data-v2.csv":
+			w.Write([]byte(dataV2))
+		case "/files/notes.txt":
+			// Corrupted in transit
+			w.Write([]byte(strings.ToUpper(notes)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL + "/v2/"}
+
+	record, err := p.Resolve(context.Background(), "10.6084/m9.figshare.42.v1")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if ("42" != record.ID) || ("1" != record.Version) || (2 != len(record.Files)) {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	if "md5:"+md5Hex(dataV1) != record.Files[0].Checksum {
+		t.Errorf("expected supplied MD5, got %s", record.Files[0].Checksum)
+	}
+	if "md5:"+md5Hex(notes) != record.Files[1].Checksum {
+		t.Errorf("expected computed MD5 when none supplied, got %s", record.Files[1].Checksum)
+	}
+	found := false
+	for _, detail := range record.Details {
+		found = found || (("versions" == detail.Name) && ("1, 2" == detail.Value))
+	}
+	if !found {
+		t.Errorf("expected versions in details, got %+v", record.Details)
+	}
+
+	latest, err := p.Resolve(context.Background(), "42")
+	if (nil != err) || ("2" != latest.Version) {
+		t.Errorf("expected latest version, got %+v: %v", latest, err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL + "/v2/"}
+	output := t.TempDir()
+
+	err := provider.Run(context.Background(), p, []string{"-figshare_id", "42", "-version", "1", "-filename", "*.csv", "-output", output})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	contents, err := os.ReadFile(path.Join(output, "data.csv"))
+	if (nil != err) || (dataV1 != string(contents)) {
+		t.Errorf("expected version 1 data, got %q: %v", contents, err)
+	}
+
+	err = provider.Run(context.Background(), p, []string{"-filename", "notes.txt", "-output", output, "42"})
+	if (nil == err) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func md5Hex(contents string) string {
+	sum := md5.Sum([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
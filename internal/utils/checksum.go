@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Repositories publish checksums as "algorithm:hex", but some just give
+// the hex, in which case we go by the length.
+func parseChecksum(checksum string) (string, string, error) {
+	algorithm, value, found := strings.Cut(strings.TrimSpace(checksum), ":")
+	if !found {
+		value = algorithm
+		switch len(value) {
+		case 32:
+			algorithm = "md5"
+		case 40:
+			algorithm = "sha1"
+		case 64:
+			algorithm = "sha256"
+		case 128:
+			algorithm = "sha512"
+		default:
+			return "", "", fmt.Errorf("can not tell checksum algorithm of %q", checksum)
+		}
+	}
+	algorithm = strings.ReplaceAll(strings.ToLower(algorithm), "-", "")
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", "", fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+	return algorithm, strings.ToLower(value), nil
+}
+
+// VerifyChecksum checks a file against a checksum written as
+// "algorithm:hex", e.g. "md5:d41d8cd98f00b204e9800998ecf8427e".
+func VerifyChecksum(filePath string, checksum string) error {
+	algorithm, expected, err := parseChecksum(checksum)
+	if nil != err {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if nil != err {
+		return err
+	}
+	defer file.Close()
+
+	actual, err := digest(algorithm, file)
+	if nil != err {
+		return fmt.Errorf("failed to read file for checksum: %w", err)
+	}
+	if actual != expected {
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", algorithm, expected, actual)
+	}
+	return nil
+}
+
+func digest(algorithm string, reader io.Reader) (string, error) {
+	hasher := checksumAlgorithms[algorithm]()
+	_, err := io.Copy(hasher, reader)
+	if nil != err {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -2,6 +2,9 @@ package utils
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,10 +15,51 @@ import (
 	"syscall"
 )
 
+// FormatSize renders a byte count in human readable units.
+func FormatSize(size int64) string {
+	units := []string{"b", "Kb", "Mb", "Gb", "Tb"}
+	unitindex := 0
+	count := float64(size)
+	for idx := 0; idx < (len(units) - 1); idx++ {
+		if 1024.0 > count {
+			break
+		}
+		count = count / 1024.0
+		unitindex += 1
+	}
+	return fmt.Sprintf("%.1f %s", count, units[unitindex])
+}
+
 func HTTPGet(url string, headers map[string]string) (*http.Response, error) {
-	client := &http.Client{}
+	return HTTPGetWithContext(context.Background(), url, headers)
+}
+
+// clientFor makes a client that only sends the given headers to the host
+// they were meant for. Go drops Authorization and cookies when a redirect
+// goes to another host, but not API keys in headers of their own, and
+// repositories often redirect downloads to storage elsewhere.
+func clientFor(headers map[string]string) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Host != via[0].URL.Host {
+				for key := range headers {
+					req.Header.Del(key)
+				}
+			}
+			return nil
+		},
+	}
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+func HTTPGetWithContext(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	return httpGet(ctx, clientFor(headers), url, headers)
+}
+
+func httpGet(ctx context.Context, client *http.Client, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if nil != err {
 		return nil, err
 	}
@@ -27,6 +71,64 @@ func HTTPGet(url string, headers map[string]string) (*http.Response, error) {
 	return client.Do(req)
 }
 
+// HTTPGetJSON fetches a URL and decodes the JSON response into result,
+// treating anything other than 200 as an error.
+func HTTPGetJSON(ctx context.Context, url string, headers map[string]string, result interface{}) error {
+	allHeaders := map[string]string{"Accept": "application/json"}
+	for key, value := range headers {
+		allHeaders[key] = value
+	}
+	resp, err := HTTPGetWithContext(ctx, url, allHeaders)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if nil != err {
+		return fmt.Errorf("failed to decode JSON from %s: %w", url, err)
+	}
+	return nil
+}
+
+// HTTPPostJSON sends body as JSON and decodes the JSON response into
+// result, treating anything other than 200 as an error.
+func HTTPPostJSON(ctx context.Context, url string, headers map[string]string, body interface{}, result interface{}) error {
+	encoded, err := json.Marshal(body)
+	if nil != err {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(encoded))
+	if nil != err {
+		return err
+	}
+	req.Header.Set("User-Agent", "Reclaimer/0.1")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := clientFor(headers).Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if nil != err {
+		return fmt.Errorf("failed to decode JSON from %s: %w", url, err)
+	}
+	return nil
+}
+
 func HTTPPost(url string, headers map[string]string, body string) (*http.Response, error) {
 	client := &http.Client{}
 
@@ -112,6 +214,33 @@ func MakeOutputPath(sourceName string, outputName string) (string, error) {
 }
 
 func DownloadFile(downloadURL string, targetFilename string, extract bool, destinationPath string) error {
+	return Download{
+		URL:         downloadURL,
+		Filename:    targetFilename,
+		Extract:     extract,
+		Destination: destinationPath,
+	}.Fetch(context.Background())
+}
+
+// Download describes a file to fetch, for when DownloadFile's arguments
+// aren't enough: some servers want credentials in the headers, and many
+// publish a checksum we can check the file against before it is unpacked
+// or moved into place.
+type Download struct {
+	URL         string
+	Filename    string
+	Headers     map[string]string
+	Checksum    string
+	Extract     bool
+	Destination string
+	// Only needed to use a particular client, which then has to take care
+	// of keeping Headers from other hosts itself.
+	HTTPClient *http.Client
+}
+
+// Fetch downloads the file, giving up if ctx is cancelled.
+func (d Download) Fetch(ctx context.Context) error {
+	downloadURL, targetFilename, extract, destinationPath := d.URL, d.Filename, d.Extract, d.Destination
 	if "" == downloadURL {
 		return fmt.Errorf("no download URL provided")
 	}
@@ -131,7 +260,11 @@ func DownloadFile(downloadURL string, targetFilename string, extract bool, desti
 		return fmt.Errorf("failed to create temp download file: %w", err)
 	}
 
-	resp, err := HTTPGet(downloadURL, nil)
+	client := d.HTTPClient
+	if nil == client {
+		client = clientFor(d.Headers)
+	}
+	resp, err := httpGet(ctx, client, downloadURL, d.Headers)
 	if nil != err {
 		out.Close()
 		return fmt.Errorf("download failed: %w", err)
@@ -149,6 +282,13 @@ func DownloadFile(downloadURL string, targetFilename string, extract bool, desti
 		return fmt.Errorf("failed to download file: %w", err)
 	}
 
+	if "" != d.Checksum {
+		err = VerifyChecksum(tempDownloadPath, d.Checksum)
+		if nil != err {
+			return fmt.Errorf("%s: %w", targetFilename, err)
+		}
+	}
+
 	if extract {
 		zipReader, err := zip.OpenReader(tempDownloadPath)
 		if nil != err {
@@ -7,6 +7,9 @@ package utils
 // dir, we need to handle this discrepency throughout these tests.
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -123,3 +126,85 @@ func TestMakeOutputDirDoesMakeDir(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatSize(t *testing.T) {
+	testcases := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0.0 b"},
+		{1023, "1023.0 b"},
+		{1024, "1.0 Kb"},
+		{1536 * 1024, "1.5 Mb"},
+		{5 * 1024 * 1024 * 1024 * 1024 * 1024, "5120.0 Tb"},
+	}
+	for _, testcase := range testcases {
+		result := FormatSize(testcase.size)
+		if result != testcase.expected {
+			t.Errorf("Expected %s for %d, got %s", testcase.expected, testcase.size, result)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "hello.txt")
+	err := os.WriteFile(filePath, []byte("hello\n"), 0o644)
+	if nil != err {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	valid := []string{
+		"md5:b1946ac92492d2347c6235b4d2611184",
+		"MD5:B1946AC92492D2347C6235B4D2611184",
+		"b1946ac92492d2347c6235b4d2611184",
+		"sha-256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		"f572d396fae9206628714fb2ce00f72e94f2258f",
+	}
+	for _, checksum := range valid {
+		err = VerifyChecksum(filePath, checksum)
+		if nil != err {
+			t.Errorf("%s: expected no error, got %v", checksum, err)
+		}
+	}
+
+	invalid := []string{
+		"md5:00000000000000000000000000000000",
+		"crc32:363a3020",
+		"abc",
+	}
+	for _, checksum := range invalid {
+		err = VerifyChecksum(filePath, checksum)
+		if nil == err {
+			t.Errorf("%s: expected error", checksum)
+		}
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello\n"))
+	}))
+	defer server.Close()
+
+	tempdir := t.TempDir()
+	err := os.Chdir(tempdir)
+	if nil != err {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	destination := path.Join(tempdir, "hello.txt")
+	err = Download{URL: server.URL, Filename: "hello.txt", Destination: destination}.Fetch(ctx)
+	if nil == err {
+		t.Fatalf("expected cancelled download to fail")
+	}
+	if _, err := os.Stat(destination); nil == err {
+		t.Errorf("expected nothing to be saved")
+	}
+
+	err = Download{URL: server.URL, Filename: "hello.txt", Destination: destination}.Fetch(context.Background())
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
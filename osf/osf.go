@@ -0,0 +1,270 @@
+// Package osf fetches files from Open Science Framework projects, both
+// from OSF's own storage and the storage providers linked to a project.
+package osf
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultBaseURL = "https://api.osf.io/v2/"
+
+// TokenEnv holds a personal access token to use if -token isn't given.
+// Public projects can be fetched without one.
+const TokenEnv = "OSF_TOKEN"
+
+// The API is JSON:API, so everything is wrapped in data, attributes and
+// links.
+type OSFLink struct {
+	Href string `json:"href"`
+}
+
+type OSFRelationship struct {
+	Links struct {
+		Related OSFLink `json:"related"`
+	} `json:"links"`
+}
+
+type OSFNodeAttributes struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+	Public      bool   `json:"public"`
+	DateCreated string `json:"date_created"`
+}
+
+type OSFNode struct {
+	ID            string                     `json:"id"`
+	Attributes    OSFNodeAttributes          `json:"attributes"`
+	Relationships map[string]OSFRelationship `json:"relationships"`
+}
+
+type OSFFileAttributes struct {
+	Kind             string `json:"kind"`
+	Name             string `json:"name"`
+	Path             string `json:"path"`
+	MaterializedPath string `json:"materialized_path"`
+	Provider         string `json:"provider"`
+	Size             int64  `json:"size"`
+	Extra            struct {
+		Hashes struct {
+			MD5    string `json:"md5"`
+			SHA256 string `json:"sha256"`
+		} `json:"hashes"`
+	} `json:"extra"`
+}
+
+// Both files and folders, including the root folder of each storage
+// provider.
+type OSFFile struct {
+	ID            string                     `json:"id"`
+	Attributes    OSFFileAttributes          `json:"attributes"`
+	Relationships map[string]OSFRelationship `json:"relationships"`
+	Links         map[string]interface{}     `json:"links"`
+}
+
+func (f OSFFile) isFolder() bool {
+	return "folder" == f.Attributes.Kind
+}
+
+func (f OSFFile) contents() string {
+	return f.Relationships["files"].Links.Related.Href
+}
+
+func (f OSFFile) download() string {
+	if link, ok := f.Links["download"].(string); ok {
+		return link
+	}
+	return ""
+}
+
+type osfNodeResponse struct {
+	Data OSFNode `json:"data"`
+}
+
+type osfFilesResponse struct {
+	Data  []OSFFile `json:"data"`
+	Links struct {
+		Next *string `json:"next"`
+	} `json:"links"`
+}
+
+// Provider fetches files from OSF projects.
+type Provider struct {
+	BaseURL string
+	// For private projects. Defaults to $OSF_TOKEN.
+	Token string
+}
+
+func (p *Provider) Name() string {
+	return "osf"
+}
+
+func (p *Provider) Description() string {
+	return "Open Science Framework projects, by ID, DOI or URL"
+}
+
+func (p *Provider) DOIPrefixes() []string {
+	return []string{"10.17605"}
+}
+
+func (p *Provider) Hosts() []string {
+	return []string{"osf.io"}
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	flagset.Var(&options.Files, "filename", "Specific item or directory within project to download, as storage provider then path, e.g. osfstorage/data")
+	flagset.StringVar(&p.Token, "token", p.Token, fmt.Sprintf("Personal access token, needed for private projects. Otherwise taken from $%s.", TokenEnv))
+}
+
+var (
+	guidPattern   = regexp.MustCompile(`^[a-z0-9]{5,}$`)
+	osfDOIPattern = regexp.MustCompile(`(?i)^10\.17605/OSF\.IO/([a-z0-9]{5,})$`)
+)
+
+// ParseIdentifier gets the project's ID from the ID itself, its DOI, or
+// its URL.
+func ParseIdentifier(identifier string) (string, error) {
+	identifier = strings.TrimSpace(identifier)
+	if guidPattern.MatchString(identifier) {
+		return identifier, nil
+	}
+
+	doi := provider.TrimDOI(identifier)
+	if match := osfDOIPattern.FindStringSubmatch(doi); nil != match {
+		return strings.ToLower(match[1]), nil
+	}
+
+	parsed, err := url.Parse(identifier)
+	if (nil == err) && ("osf.io" == strings.TrimPrefix(parsed.Hostname(), "www.")) {
+		parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		if guidPattern.MatchString(parts[0]) {
+			return parts[0], nil
+		}
+	}
+	return "", fmt.Errorf("%q is not an OSF project ID, DOI, or URL", identifier)
+}
+
+func (p *Provider) headers() map[string]string {
+	token := p.Token
+	if "" == token {
+		token = os.Getenv(TokenEnv)
+	}
+	if "" == token {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func (p *Provider) endpoint(path string) string {
+	return provider.Endpoint(p.BaseURL, DefaultBaseURL, path)
+}
+
+func (p *Provider) FetchNode(ctx context.Context, id string) (OSFNode, error) {
+	var response osfNodeResponse
+	err := utils.HTTPGetJSON(ctx, p.endpoint(fmt.Sprintf("nodes/%s/", url.PathEscape(id))), p.headers(), &response)
+	if nil != err {
+		return OSFNode{}, err
+	}
+	return response.Data, nil
+}
+
+// listFolder returns everything directly in a folder, following the pages.
+func (p *Provider) listFolder(ctx context.Context, href string) ([]OSFFile, error) {
+	files := make([]OSFFile, 0)
+	for "" != href {
+		var response osfFilesResponse
+		err := utils.HTTPGetJSON(ctx, href, p.headers(), &response)
+		if nil != err {
+			return nil, err
+		}
+		files = append(files, response.Data...)
+		href = ""
+		if nil != response.Links.Next {
+			href = *response.Links.Next
+		}
+	}
+	return files, nil
+}
+
+// walk lists all the files under a folder, with the storage provider's name
+// and their path within it.
+func (p *Provider) walk(ctx context.Context, storage string, href string) ([]provider.File, error) {
+	entries, err := p.listFolder(ctx, href)
+	if nil != err {
+		return nil, err
+	}
+	files := make([]provider.File, 0, len(entries))
+	for _, entry := range entries {
+		if entry.isFolder() {
+			contents, err := p.walk(ctx, storage, entry.contents())
+			if nil != err {
+				return nil, fmt.Errorf("failed to list %s: %w", entry.Attributes.MaterializedPath, err)
+			}
+			files = append(files, contents...)
+			continue
+		}
+
+		checksum := ""
+		if hashes := entry.Attributes.Extra.Hashes; "" != hashes.SHA256 {
+			checksum = "sha256:" + hashes.SHA256
+		} else if "" != hashes.MD5 {
+			checksum = "md5:" + hashes.MD5
+		}
+		files = append(files, provider.File{
+			ID:       entry.ID,
+			Name:     storage + "/" + strings.TrimPrefix(entry.Attributes.MaterializedPath, "/"),
+			Size:     entry.Attributes.Size,
+			URL:      entry.download(),
+			Checksum: checksum,
+			Headers:  p.headers(),
+		})
+	}
+	return files, nil
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	id, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	node, err := p.FetchNode(ctx, id)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	record := provider.Record{
+		ID:    node.ID,
+		Title: node.Attributes.Title,
+	}
+	if "" != node.Attributes.Category {
+		record.Details = append(record.Details, provider.Detail{Name: "category", Value: node.Attributes.Category})
+	}
+
+	// Each storage provider is a folder at the top
+	storages, err := p.listFolder(ctx, p.endpoint(fmt.Sprintf("nodes/%s/files/", url.PathEscape(node.ID))))
+	if nil != err {
+		return provider.Record{}, fmt.Errorf("failed to list storage: %w", err)
+	}
+	for _, storage := range storages {
+		name := storage.Attributes.Provider
+		if "" == name {
+			name = storage.Attributes.Name
+		}
+		record.Details = append(record.Details, provider.Detail{Name: "storage", Value: name})
+		files, err := p.walk(ctx, name, storage.contents())
+		if nil != err {
+			return provider.Record{}, fmt.Errorf("failed to list %s: %w", name, err)
+		}
+		record.Files = append(record.Files, files...)
+	}
+	return record, nil
+}
@@ -0,0 +1,163 @@
+package osf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	for _, identifier := range []string{
+		"abc12",
+		"10.17605/OSF.IO/ABC12",
+		"doi:10.17605/OSF.IO/ABC12",
+		"https://doi.org/10.17605/OSF.IO/ABC12",
+		"http://doi.org/10.17605/OSF.IO/ABC12",
+		"https://osf.io/abc12/",
+		"https://osf.io/abc12/files/osfstorage",
+	} {
+		id, err := ParseIdentifier(identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", identifier, err)
+		} else if "abc12" != id {
+			t.Errorf("%s: expected abc12, got %s", identifier, id)
+		}
+	}
+	for _, identifier := range []string{"", "ab", "https://example.com/abc12/"} {
+		if _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+var testFiles = map[string]string{
+	"a":    "a,b\n1,2\n",
+	"b":    "deep\n",
+	"r":    "read me\n",
+	"code": "print('hi')\n",
+}
+
+const testToken = "personal-token"
+
+func newTestServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	folder := func(storage string, materialized string, href string) string {
+		return fmt.Sprintf(`{"id": "%s%s", "attributes": {"kind": "folder", "name": %q, "provider": %q, "materialized_path": %q},
+			"relationships": {"files": {"links": {"related": {"href": "%s%s"}}}}}`,
+			storage, materialized, path.Base(materialized), storage, materialized, server.URL, href)
+	}
+	file := func(id string, materialized string, hashed bool) string {
+		sha := ""
+		if hashed {
+			sha = sha256Hex(testFiles[id])
+		}
+		return fmt.Sprintf(`{"id": %q, "attributes": {"kind": "file", "name": %q, "materialized_path": %q, "size": %d, "extra": {"hashes": {"sha256": %q}}},
+			"links": {"download": "%s/download/%s"}}`,
+			id, path.Base(materialized), materialized, len(testFiles[id]), sha, server.URL, id)
+	}
+	list := func(next string, entries ...string) string {
+		nextJSON := "null"
+		if "" != next {
+			nextJSON = fmt.Sprintf(`"%s%s"`, server.URL, next)
+		}
+		return fmt.Sprintf(`{"data": [%s], "links": {"next": %s}}`, strings.Join(entries, ", "), nextJSON)
+	}
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The project is private
+		if "Bearer "+testToken != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/nodes/abc12/":
+			w.Write([]byte(`{"data": {"id": "abc12", "attributes": {"title": "Shared inputs", "category": "project"}}}`))
+		case "/v2/nodes/abc12/files/":
+			w.Write([]byte(list("", folder("osfstorage", "/", "/v2/nodes/abc12/files/osfstorage/"), folder("github", "/", "/v2/nodes/abc12/files/github/"))))
+		case "/v2/nodes/abc12/files/osfstorage/":
+			if "2" == r.URL.Query().Get("page") {
+				w.Write([]byte(list("", file("r", "/readme.txt", true))))
+			} else {
+				w.Write([]byte(list("/v2/nodes/abc12/files/osfstorage/?page=2", folder("osfstorage", "/data/", "/v2/nodes/abc12/files/osfstorage/data/"))))
+			}
+		case "/v2/nodes/abc12/files/osfstorage/data/":
+			w.Write([]byte(list("", file("a", "/data/a.csv", true), folder("osfstorage", "/data/deeper/", "/v2/nodes/abc12/files/osfstorage/deeper/"))))
+		case "/v2/nodes/abc12/files/osfstorage/deeper/":
+			w.Write([]byte(list("", file("b", "/data/deeper/b.txt", true))))
+		case "/v2/nodes/abc12/files/github/":
+			w.Write([]byte(list("", file("code", "/src/code.py", false))))
+		default:
+			id := strings.TrimPrefix(r.URL.Path, "/download/")
+			if contents, ok := testFiles[id]; ok {
+				w.Write([]byte(contents))
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv(TokenEnv, testToken)
+	p := &Provider{BaseURL: server.URL + "/v2/"}
+
+	record, err := p.Resolve(context.Background(), "https://osf.io/abc12/")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	names := make([]string, len(record.Files))
+	for idx, file := range record.Files {
+		names[idx] = file.Name
+	}
+	expected := "[osfstorage/data/a.csv osfstorage/data/deeper/b.txt osfstorage/readme.txt github/src/code.py]"
+	if expected != fmt.Sprint(names) {
+		t.Errorf("expected files %s, got %v", expected, names)
+	}
+	if ("" == record.Files[0].Checksum) || ("" != record.Files[3].Checksum) {
+		t.Errorf("unexpected checksums %+v", record.Files)
+	}
+
+	t.Setenv(TokenEnv, "")
+	_, err = p.Resolve(context.Background(), "abc12")
+	if (nil == err) || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected private project to need a token, got %v", err)
+	}
+}
+
+func TestRecursiveDownload(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv(TokenEnv, "")
+	p := &Provider{BaseURL: server.URL + "/v2/"}
+	output := t.TempDir()
+
+	err := provider.Run(context.Background(), p, []string{"-token", testToken, "-filename", "osfstorage/data", "-output", output, "abc12"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	for name, id := range map[string]string{"osfstorage/data/a.csv": "a", "osfstorage/data/deeper/b.txt": "b"} {
+		contents, err := os.ReadFile(path.Join(output, name))
+		if (nil != err) || (testFiles[id] != string(contents)) {
+			t.Errorf("%s: unexpected contents %q: %v", name, contents, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(output, "osfstorage/readme.txt")); nil == err {
+		t.Errorf("expected files outside the directory not to be downloaded")
+	}
+}
+
+func sha256Hex(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
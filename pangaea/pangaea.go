@@ -0,0 +1,316 @@
+// Package pangaea fetches datasets from PANGAEA, which are mostly tab
+// separated data tables, often with links to further files.
+package pangaea
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultBaseURL = "https://doi.pangaea.de/"
+
+const doiPrefix = "10.1594/PANGAEA."
+
+// The schema.org description PANGAEA gives of a dataset. Several fields
+// can be either a single value or a list, or a string or an object, so are
+// decoded as needed.
+type PangaeaDataset struct {
+	Identifier    string                `json:"identifier"`
+	URL           string                `json:"url"`
+	Name          string                `json:"name"`
+	Description   string                `json:"description"`
+	DatePublished string                `json:"datePublished"`
+	Creator       json.RawMessage       `json:"creator"`
+	License       json.RawMessage       `json:"license"`
+	Citation      json.RawMessage       `json:"citation"`
+	Distribution  []PangaeaDistribution `json:"distribution"`
+}
+
+type PangaeaDistribution struct {
+	EncodingFormat string `json:"encodingFormat"`
+	ContentURL     string `json:"contentUrl"`
+}
+
+type pangaeaThing struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Decode a value that is a thing, a list of things, a string, or a list of
+// strings, into their names.
+func names(raw json.RawMessage) []string {
+	if 0 == len(raw) {
+		return nil
+	}
+	var many []json.RawMessage
+	if nil != json.Unmarshal(raw, &many) {
+		many = []json.RawMessage{raw}
+	}
+	result := make([]string, 0, len(many))
+	for _, one := range many {
+		var text string
+		if nil == json.Unmarshal(one, &text) {
+			result = append(result, text)
+			continue
+		}
+		var thing pangaeaThing
+		if (nil == json.Unmarshal(one, &thing)) && ("" != thing.Name) {
+			result = append(result, thing.Name)
+		} else if "" != thing.URL {
+			result = append(result, thing.URL)
+		}
+	}
+	return result
+}
+
+func (d PangaeaDataset) Creators() []string {
+	return names(d.Creator)
+}
+
+func (d PangaeaDataset) Licenses() []string {
+	return names(d.License)
+}
+
+// Provider fetches datasets from PANGAEA.
+type Provider struct {
+	BaseURL string
+
+	linked  bool
+	sidecar bool
+}
+
+func (p *Provider) Name() string {
+	return "pangaea"
+}
+
+func (p *Provider) Description() string {
+	return "PANGAEA datasets, by DOI or URL"
+}
+
+// Other repositories, such as IEDA, also have DOIs under 10.1594.
+func (p *Provider) DOIPrefixes() []string {
+	return []string{doiPrefix}
+}
+
+func (p *Provider) Hosts() []string {
+	return []string{"pangaea.de", ".pangaea.de"}
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	flagset.Var(&options.Files, "filename", "Specific item within dataset to download")
+	flagset.BoolVar(&p.linked, "linked", false, "Also list the files linked to from the data table, which means downloading the table to find them")
+	flagset.BoolVar(&p.sidecar, "sidecar", false, "Move the metadata header of downloaded data tables into a separate _metadata.txt file")
+}
+
+var (
+	numberPattern     = regexp.MustCompile(`^\d+$`)
+	pangaeaDOIPattern = regexp.MustCompile(`(?i)(?:^|\b10\.1594/)PANGAEA\.(\d+)`)
+)
+
+// ParseIdentifier gets the dataset number from a PANGAEA DOI or URL, or
+// the number itself.
+func ParseIdentifier(identifier string) (string, error) {
+	identifier = strings.TrimSpace(identifier)
+	if numberPattern.MatchString(identifier) {
+		return identifier, nil
+	}
+	if unescaped, err := url.QueryUnescape(identifier); nil == err {
+		identifier = unescaped
+	}
+	if parsed, err := url.Parse(identifier); (nil == err) && parsed.IsAbs() && ("doi" != parsed.Scheme) {
+		host := parsed.Hostname()
+		if ("doi.org" != host) && ("dx.doi.org" != host) && !strings.HasSuffix(host, "pangaea.de") {
+			return "", fmt.Errorf("%q is not a PANGAEA URL", identifier)
+		}
+	}
+	if match := pangaeaDOIPattern.FindStringSubmatch(identifier); nil != match {
+		return match[1], nil
+	}
+	return "", fmt.Errorf("%q is not a PANGAEA DOI or URL", identifier)
+}
+
+func (p *Provider) datasetURL(number string, format string) string {
+	return provider.Endpoint(p.BaseURL, DefaultBaseURL, doiPrefix+number+"?format="+format)
+}
+
+func (p *Provider) FetchMetadata(ctx context.Context, number string) (PangaeaDataset, error) {
+	var dataset PangaeaDataset
+	err := utils.HTTPGetJSON(ctx, p.datasetURL(number, "metadata_jsonld"), nil, &dataset)
+	if nil != err {
+		return PangaeaDataset{}, err
+	}
+	return dataset, nil
+}
+
+func distributionName(number string, distribution PangaeaDistribution) string {
+	switch distribution.EncodingFormat {
+	case "text/tab-separated-values":
+		return fmt.Sprintf("PANGAEA_%s.tab", number)
+	case "application/zip":
+		return fmt.Sprintf("PANGAEA_%s.zip", number)
+	}
+	if parsed, err := url.Parse(distribution.ContentURL); nil == err {
+		if base := path.Base(parsed.Path); ("" != base) && ("/" != base) && ("." != base) {
+			return base
+		}
+	}
+	return fmt.Sprintf("PANGAEA_%s", number)
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	number, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	dataset, err := p.FetchMetadata(ctx, number)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	record := provider.Record{
+		ID:    number,
+		Title: dataset.Name,
+		DOI:   doiPrefix + number,
+	}
+	for _, creator := range dataset.Creators() {
+		record.Details = append(record.Details, provider.Detail{Name: "creator", Value: creator})
+	}
+	if "" != dataset.DatePublished {
+		record.Details = append(record.Details, provider.Detail{Name: "published", Value: dataset.DatePublished})
+	}
+	for _, license := range dataset.Licenses() {
+		record.Details = append(record.Details, provider.Detail{Name: "license", Value: license})
+	}
+	for _, citation := range names(dataset.Citation) {
+		record.Details = append(record.Details, provider.Detail{Name: "related", Value: citation})
+	}
+
+	var table string
+	for _, distribution := range dataset.Distribution {
+		if "" == distribution.ContentURL {
+			continue
+		}
+		record.Files = append(record.Files, provider.File{
+			Name: distributionName(number, distribution),
+			URL:  distribution.ContentURL,
+		})
+		if "text/tab-separated-values" == distribution.EncodingFormat {
+			table = distribution.ContentURL
+		}
+	}
+
+	if p.linked && ("" != table) {
+		linked, err := p.linkedFiles(ctx, table)
+		if nil != err {
+			return provider.Record{}, fmt.Errorf("failed to find linked files: %w", err)
+		}
+		record.Files = append(record.Files, linked...)
+	}
+	return record, nil
+}
+
+// splitTable separates the /* ... */ metadata header PANGAEA puts at the
+// top of its data tables from the table itself.
+func splitTable(contents []byte) ([]byte, []byte) {
+	if !bytes.HasPrefix(contents, []byte("/*")) {
+		return nil, contents
+	}
+	end := bytes.Index(contents, []byte("*/"))
+	if -1 == end {
+		return nil, contents
+	}
+	header := contents[:end+2]
+	table := bytes.TrimLeft(contents[end+2:], "\r\n")
+	return header, table
+}
+
+// Binary files that go with a dataset, such as images or model output, are
+// listed in the data table as URLs.
+func (p *Provider) linkedFiles(ctx context.Context, tableURL string) ([]provider.File, error) {
+	resp, err := utils.HTTPGetWithContext(ctx, tableURL, nil)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
+	}
+	var buffer bytes.Buffer
+	_, err = buffer.ReadFrom(resp.Body)
+	if nil != err {
+		return nil, err
+	}
+	_, table := splitTable(buffer.Bytes())
+
+	files := make([]provider.File, 0)
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(table))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			// Column names
+			continue
+		}
+		for _, cell := range strings.Split(scanner.Text(), "\t") {
+			cell = strings.TrimSpace(cell)
+			if !strings.HasPrefix(cell, "http://") && !strings.HasPrefix(cell, "https://") {
+				continue
+			}
+			parsed, err := url.Parse(cell)
+			if nil != err {
+				continue
+			}
+			base := path.Base(parsed.Path)
+			if seen[cell] || ("files" == path.Join("files", base)) {
+				continue
+			}
+			seen[cell] = true
+
+			// Different files can share a name, such as an image and its
+			// thumbnail kept in different directories
+			name := path.Join("files", base)
+			ext := path.Ext(base)
+			for count := 2; names[name]; count++ {
+				name = path.Join("files", fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), count, ext))
+			}
+			names[name] = true
+			files = append(files, provider.File{Name: name, URL: cell})
+		}
+	}
+	return files, scanner.Err()
+}
+
+// Process moves the header of data tables into a sidecar file if asked to.
+func (p *Provider) Process(file provider.File, localPath string) error {
+	if !p.sidecar || ".tab" != path.Ext(localPath) {
+		return nil
+	}
+	contents, err := os.ReadFile(localPath)
+	if nil != err {
+		return err
+	}
+	header, table := splitTable(contents)
+	if nil == header {
+		return nil
+	}
+	sidecarPath := strings.TrimSuffix(localPath, ".tab") + "_metadata.txt"
+	err = os.WriteFile(sidecarPath, append(header, '\n'), 0o644)
+	if nil != err {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return os.WriteFile(localPath, table, 0o644)
+}
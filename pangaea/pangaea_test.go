@@ -0,0 +1,132 @@
+package pangaea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	for _, identifier := range []string{
+		"912345",
+		"PANGAEA.912345",
+		"10.1594/PANGAEA.912345",
+		"doi:10.1594/pangaea.912345",
+		"https://doi.org/10.1594/PANGAEA.912345",
+		"https://doi.pangaea.de/10.1594/PANGAEA.912345?format=html#download",
+		"https://doi.pangaea.de/10.1594%2FPANGAEA.912345",
+	} {
+		number, err := ParseIdentifier(identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", identifier, err)
+		} else if "912345" != number {
+			t.Errorf("%s: expected 912345, got %s", identifier, number)
+		}
+	}
+	for _, identifier := range []string{"", "10.5281/zenodo.1", "https://example.com/10.1594/PANGAEA.912345"} {
+		if _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+const (
+	tableHeader = "/* DATA DESCRIPTION:\nCitation:\tSmith, J (2020): Cores\n*/"
+	tableBody   = "Depth [m]\tImage\n0.5\t%[1]s/images/core1.jpg\n1.0\t%[1]s/images/core2.jpg\n1.5\t%[1]s/images/core1.jpg\n2.0\t%[1]s/thumbnails/core1.jpg\n"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/10.1594/PANGAEA.912345":
+			switch r.URL.Query().Get("format") {
+			case "metadata_jsonld":
+				fmt.Fprintf(w, `{
+					"@context": "http://schema.org/", "@type": "Dataset",
+					"identifier": "https://doi.org/10.1594/PANGAEA.912345",
+					"name": "Core images",
+					"datePublished": "2020-02-02",
+					"creator": [{"@type": "Person", "name": "Smith, Jo"}, {"@type": "Person", "name": "Jones, Al"}],
+					"license": {"@type": "CreativeWork", "name": "CC-BY-4.0", "url": "https://creativecommons.org/licenses/by/4.0/"},
+					"distribution": [{"@type": "DataDownload", "encodingFormat": "text/tab-separated-values", "contentUrl": "%s/10.1594/PANGAEA.912345?format=textfile"}]
+				}`, server.URL)
+			case "textfile":
+				w.Write([]byte(tableHeader + "\n" + fmt.Sprintf(tableBody, server.URL)))
+			default:
+				http.NotFound(w, r)
+			}
+		case "/images/core1.jpg", "/images/core2.jpg", "/thumbnails/core1.jpg":
+			w.Write([]byte("jpeg " + r.URL.Path))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL}
+
+	record, err := p.Resolve(context.Background(), "10.1594/PANGAEA.912345")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if ("Core images" != record.Title) || ("10.1594/PANGAEA.912345" != record.DOI) {
+		t.Errorf("unexpected record %+v", record)
+	}
+	expected := "[{creator Smith, Jo} {creator Jones, Al} {published 2020-02-02} {license CC-BY-4.0}]"
+	if expected != fmt.Sprint(record.Details) {
+		t.Errorf("expected details %s, got %v", expected, record.Details)
+	}
+	if (1 != len(record.Files)) || ("PANGAEA_912345.tab" != record.Files[0].Name) {
+		t.Errorf("unexpected files %+v", record.Files)
+	}
+
+	p.linked = true
+	record, err = p.Resolve(context.Background(), "10.1594/PANGAEA.912345")
+	if nil != err {
+		t.Fatalf("failed to resolve with linked files: %v", err)
+	}
+	names := make([]string, len(record.Files))
+	for idx, file := range record.Files {
+		names[idx] = file.Name
+	}
+	if "[PANGAEA_912345.tab files/core1.jpg files/core2.jpg files/core1-2.jpg]" != fmt.Sprint(names) {
+		t.Errorf("unexpected linked files %v", names)
+	} else if server.URL+"/thumbnails/core1.jpg" != record.Files[3].URL {
+		t.Errorf("expected the clashing name to be for the thumbnail, got %s", record.Files[3].URL)
+	}
+}
+
+func TestDownloadWithSidecar(t *testing.T) {
+	server := newTestServer(t)
+	p := &Provider{BaseURL: server.URL}
+	output := t.TempDir()
+
+	err := provider.Run(context.Background(), p, []string{"-linked", "-sidecar", "-all", "-output", output, "PANGAEA.912345"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	table, err := os.ReadFile(path.Join(output, "PANGAEA_912345.tab"))
+	if (nil != err) || (fmt.Sprintf(tableBody, server.URL) != string(table)) {
+		t.Errorf("expected table without header, got %q: %v", table, err)
+	}
+	header, err := os.ReadFile(path.Join(output, "PANGAEA_912345_metadata.txt"))
+	if (nil != err) || (tableHeader+"\n" != string(header)) {
+		t.Errorf("expected header in sidecar, got %q: %v", header, err)
+	}
+	image, err := os.ReadFile(path.Join(output, "files", "core2.jpg"))
+	if (nil != err) || ("jpeg /images/core2.jpg" != string(image)) {
+		t.Errorf("unexpected linked file %q: %v", image, err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package provider is the common shape of the data sources reclaimer can
+// fetch from. A provider only has to turn an identifier into a record with
+// a list of files; selecting files, deciding where they go, downloading in
+// parallel and checking them is then done the same way for all sources.
+package provider
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Record is a published dataset, deposit or similar, as resolved from
+// whatever identifier the user gave us.
+type Record struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	DOI     string `json:"doi,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Anything else the provider thinks is worth showing, such as creators
+	// or licence, in the order it should be shown.
+	Details []Detail `json:"details,omitempty"`
+	Files   []File   `json:"files"`
+}
+
+type Detail struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type File struct {
+	// Unique within the record, used by async providers to request it.
+	ID string `json:"id,omitempty"`
+	// The path of the file within the record, which may include
+	// directories, and is used for selection and as the output path.
+	Name string `json:"name"`
+	Size int64  `json:"size,omitempty"`
+	URL  string `json:"url,omitempty"`
+	// As "algorithm:hex", e.g. "md5:...", if the provider publishes one.
+	Checksum string `json:"checksum,omitempty"`
+	// Sent when downloading, for sources that need credentials.
+	Headers map[string]string `json:"-"`
+	// Set if the file must be requested and waited for before it can be
+	// downloaded, in which case the provider must be an AsyncProvider.
+	Async bool `json:"async,omitempty"`
+}
+
+// Provider is what every data source implements.
+type Provider interface {
+	// The subcommand name, e.g. "zenodo".
+	Name() string
+	// One line, for the list of subcommands.
+	Description() string
+	// Add any flags specific to this provider, such as a server URL or an
+	// access token. Providers can also add aliases for the common options.
+	AddFlags(flagset *flag.FlagSet, options *Options)
+	// Resolve looks up an identifier, which may be an ID, DOI or URL as
+	// appropriate for the source.
+	Resolve(ctx context.Context, identifier string) (Record, error)
+}
+
+// AsyncProvider is implemented by sources like CLMS where files have to be
+// asked for and are prepared in the background.
+type AsyncProvider interface {
+	Provider
+	// Request asks for a file to be prepared, returning an ID to poll.
+	Request(ctx context.Context, record Record, file File) (string, error)
+	// Poll reports whether the request is done, and if so returns the file
+	// ready to download.
+	Poll(ctx context.Context, taskID string) (File, bool, error)
+}
+
+// Hoster is implemented by providers for repositories that mint DOIs, so
+// that a DOI can be passed to the provider for the repository hosting it.
+type Hoster interface {
+	// The DOI prefixes the repository uses, e.g. "10.5281". Where other
+	// repositories share the prefix, give more of the DOI, e.g.
+	// "10.1594/PANGAEA.".
+	DOIPrefixes() []string
+	// The hosts of the pages DOIs resolve to. A leading dot matches any
+	// subdomain.
+	Hosts() []string
+}
+
+var doiResolvers = []string{"doi:", "https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/"}
+
+// TrimDOI takes off the "doi:" or resolver URL a DOI may be written with.
+// Anything else is returned as is, so the result still needs checking.
+func TrimDOI(identifier string) string {
+	doi := strings.TrimSpace(identifier)
+	for _, prefix := range doiResolvers {
+		if strings.HasPrefix(strings.ToLower(doi), prefix) {
+			return doi[len(prefix):]
+		}
+	}
+	return doi
+}
+
+// Endpoint joins path onto a provider's base URL, or onto its default if
+// the base URL isn't set.
+func Endpoint(baseURL string, defaultBaseURL string, path string) string {
+	if "" == baseURL {
+		baseURL = defaultBaseURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return baseURL + path
+}
+
+// Processor is implemented by providers that need to do something to a
+// file once it has been downloaded, such as split off a header. It isn't
+// used for files that are extracted.
+type Processor interface {
+	Process(file File, localPath string) error
+}
+
+// Finisher is implemented by providers that need to do something once all
+// the selected files are downloaded, such as write an index of them. It is
+// given where each file was saved, which is empty for files that were
+// extracted.
+type Finisher interface {
+	Finish(record Record, files []File, localPaths []string, options Options) error
+}
+
+// Commander is implemented by providers that have their own command line,
+// rather than the common one that Run provides.
+type Commander interface {
+	Command(ctx context.Context, args []string) error
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Provider)
+)
+
+// Register makes a provider available by name. It panics if the name is
+// already taken, as that is a programming error.
+func Register(provider Provider) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	name := provider.Name()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("provider %s registered twice", name))
+	}
+	registry[name] = provider
+}
+
+func Lookup(name string) (Provider, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	provider, ok := registry[name]
+	return provider, ok
+}
+
+// Providers returns all the registered providers, sorted by name.
+func Providers() []Provider {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	providers := make([]Provider, 0, len(registry))
+	for _, provider := range registry {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name() < providers[j].Name()
+	})
+	return providers
+}
@@ -0,0 +1,296 @@
+package provider
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testFiles = map[string]string{
+	"/readme.txt":       "read me\n",
+	"/data/a.csv":       "a,b\n1,2\n",
+	"/data/b.csv":       "c,d\n3,4\n",
+	"/prepared/out.txt": "prepared\n",
+}
+
+// A provider whose one record lists the test files, one of which has to be
+// requested first.
+type fakeProvider struct {
+	server   *httptest.Server
+	requests atomic.Int32
+	polls    atomic.Int32
+}
+
+func (f *fakeProvider) Name() string                                     { return "fake" }
+func (f *fakeProvider) Description() string                              { return "for testing" }
+func (f *fakeProvider) AddFlags(flagset *flag.FlagSet, options *Options) {}
+
+func (f *fakeProvider) Resolve(ctx context.Context, identifier string) (Record, error) {
+	if "rec1" != identifier {
+		return Record{}, fmt.Errorf("no record %s", identifier)
+	}
+	record := Record{ID: identifier, Title: "Test record"}
+	for _, name := range []string{"readme.txt", "data/a.csv", "data/b.csv"} {
+		record.Files = append(record.Files, File{
+			Name:     name,
+			URL:      f.server.URL + "/" + name,
+			Checksum: "md5:" + md5Hex(testFiles["/"+name]),
+		})
+	}
+	record.Files = append(record.Files, File{ID: "out", Name: "out.txt", Async: true})
+	return record, nil
+}
+
+func (f *fakeProvider) Request(ctx context.Context, record Record, file File) (string, error) {
+	f.requests.Add(1)
+	return "task-" + file.ID, nil
+}
+
+func (f *fakeProvider) Poll(ctx context.Context, taskID string) (File, bool, error) {
+	if f.polls.Add(1) < 2 {
+		return File{}, false, nil
+	}
+	return File{URL: f.server.URL + "/prepared/out.txt"}, true, nil
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, ok := testFiles[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(contents))
+	}))
+	t.Cleanup(server.Close)
+	return &fakeProvider{server: server}
+}
+
+func TestSelect(t *testing.T) {
+	files := []File{{Name: "readme.txt"}, {Name: "data/a.csv"}, {Name: "data/b.csv"}}
+
+	cases := []struct {
+		patterns []string
+		expected []string
+	}{
+		{[]string{"readme.txt"}, []string{"readme.txt"}},
+		{[]string{"data/*.csv"}, []string{"data/a.csv", "data/b.csv"}},
+		// Directories select everything in them
+		{[]string{"data"}, []string{"data/a.csv", "data/b.csv"}},
+		{[]string{"d*/"}, []string{"data/a.csv", "data/b.csv"}},
+		// Record order, and no duplicates
+		{[]string{"data/b.csv", "*.txt", "data/*"}, []string{"readme.txt", "data/a.csv", "data/b.csv"}},
+	}
+	for _, tc := range cases {
+		selected, err := Select(files, tc.patterns, false)
+		if nil != err {
+			t.Fatalf("%v: unexpected error: %v", tc.patterns, err)
+		}
+		names := make([]string, len(selected))
+		for idx, file := range selected {
+			names[idx] = file.Name
+		}
+		if strings.Join(names, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("%v: expected %v, got %v", tc.patterns, tc.expected, names)
+		}
+	}
+
+	_, err := Select(files, []string{"missing.txt"}, false)
+	if nil == err {
+		t.Errorf("expected error for pattern that matches nothing")
+	}
+
+	all, err := Select(files, nil, true)
+	if (nil != err) || (3 != len(all)) {
+		t.Errorf("expected all files, got %v, %v", all, err)
+	}
+}
+
+func TestFileListFlag(t *testing.T) {
+	var files fileList
+	flagset := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagset.Var(&files, "files", "")
+	err := flagset.Parse([]string{"-files", "a.txt, b.txt", "-files", "c/*"})
+	if nil != err {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if "a.txt,b.txt,c/*" != files.String() {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+func TestFetchSeveralFiles(t *testing.T) {
+	fake := newFakeProvider(t)
+	output := t.TempDir()
+
+	err := Run(context.Background(), fake, []string{"-all", "-output", output, "-poll-interval", "1ms", "rec1"})
+	if nil != err {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+
+	for name, expected := range map[string]string{
+		"readme.txt": testFiles["/readme.txt"],
+		"data/a.csv": testFiles["/data/a.csv"],
+		"data/b.csv": testFiles["/data/b.csv"],
+		"out.txt":    testFiles["/prepared/out.txt"],
+	} {
+		contents, err := os.ReadFile(path.Join(output, name))
+		if nil != err {
+			t.Errorf("missing %s: %v", name, err)
+			continue
+		}
+		if expected != string(contents) {
+			t.Errorf("%s: expected %q, got %q", name, expected, contents)
+		}
+	}
+	if 1 != fake.requests.Load() {
+		t.Errorf("expected one request, got %d", fake.requests.Load())
+	}
+}
+
+func TestFetchSingleFileToOutputName(t *testing.T) {
+	fake := newFakeProvider(t)
+	output := path.Join(t.TempDir(), "renamed.csv")
+
+	err := Run(context.Background(), fake, []string{"-files", "data/a.csv", "-output", output, "rec1"})
+	if nil != err {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	contents, err := os.ReadFile(output)
+	if nil != err {
+		t.Fatalf("missing output: %v", err)
+	}
+	if testFiles["/data/a.csv"] != string(contents) {
+		t.Errorf("unexpected contents %q", contents)
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	fake := newFakeProvider(t)
+	output := t.TempDir()
+	record, err := fake.Resolve(context.Background(), "rec1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	files := record.Files[:2]
+	files[1].Checksum = "md5:" + md5Hex("something else")
+
+	err = Fetch(context.Background(), fake, record, files, Options{Output: output, Parallel: 2})
+	if (nil == err) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+	// The other file should still have been fetched, but not the bad one
+	if _, err := os.Stat(path.Join(output, "readme.txt")); nil != err {
+		t.Errorf("expected good file to be fetched: %v", err)
+	}
+	if _, err := os.Stat(path.Join(output, "data/a.csv")); nil == err {
+		t.Errorf("expected bad file not to be saved")
+	}
+}
+
+func TestFetchLimitsParallelism(t *testing.T) {
+	var lock sync.Mutex
+	active, peak := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		active--
+		lock.Unlock()
+		w.Write([]byte("x"))
+	}))
+	defer server.Close()
+
+	files := make([]File, 6)
+	for idx := range files {
+		files[idx] = File{Name: fmt.Sprintf("f%d", idx), URL: fmt.Sprintf("%s/f%d", server.URL, idx)}
+	}
+	err := Fetch(context.Background(), newFakeProvider(t), Record{}, files, Options{Output: t.TempDir(), Parallel: 2})
+	if nil != err {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 downloads at once, saw %d", peak)
+	}
+}
+
+func TestTrimDOI(t *testing.T) {
+	for _, identifier := range []string{
+		"10.1234/abc.5",
+		" doi:10.1234/abc.5",
+		"DOI:10.1234/abc.5",
+		"https://doi.org/10.1234/abc.5",
+		"http://doi.org/10.1234/abc.5",
+		"https://dx.doi.org/10.1234/abc.5",
+		"http://dx.doi.org/10.1234/abc.5",
+	} {
+		if doi := TrimDOI(identifier); "10.1234/abc.5" != doi {
+			t.Errorf("%q: expected 10.1234/abc.5, got %s", identifier, doi)
+		}
+	}
+	if doi := TrimDOI("https://example.com/10.1234/abc.5"); "https://example.com/10.1234/abc.5" != doi {
+		t.Errorf("expected other URLs to be left alone, got %s", doi)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		base     string
+		expected string
+	}{
+		{"", "https://example.com/api/records/1"},
+		{"http://localhost:8080", "http://localhost:8080/records/1"},
+		{"http://localhost:8080/", "http://localhost:8080/records/1"},
+	}
+	for _, test := range tests {
+		if endpoint := Endpoint(test.base, "https://example.com/api/", "records/1"); test.expected != endpoint {
+			t.Errorf("%q: expected %s, got %s", test.base, test.expected, endpoint)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	fake := &fakeProvider{}
+	Register(fake)
+	defer func() {
+		registryLock.Lock()
+		delete(registry, fake.Name())
+		registryLock.Unlock()
+	}()
+
+	found, ok := Lookup("fake")
+	if !ok || (found != fake) {
+		t.Errorf("expected to find registered provider")
+	}
+	if _, ok := Lookup("missing"); ok {
+		t.Errorf("found provider that wasn't registered")
+	}
+
+	defer func() {
+		if nil == recover() {
+			t.Errorf("expected registering the same name twice to panic")
+		}
+	}()
+	Register(&fakeProvider{})
+}
+
+func md5Hex(contents string) string {
+	sum := md5.Sum([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
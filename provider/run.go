@@ -0,0 +1,318 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"quantify.earth/reclaimer/internal/utils"
+)
+
+// fileList is a flag that can be given more than once, each time with one
+// or more comma separated names or glob patterns.
+type fileList []string
+
+func (f *fileList) String() string {
+	if nil == f {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if "" != name {
+			*f = append(*f, name)
+		}
+	}
+	return nil
+}
+
+// Options are the settings common to all providers.
+type Options struct {
+	ID       string
+	Files    fileList
+	All      bool
+	Extract  bool
+	Output   string
+	Parallel int
+	JSON     bool
+	// How often to check on files from an AsyncProvider.
+	PollInterval time.Duration
+}
+
+func (o *Options) addFlags(flagset *flag.FlagSet) {
+	flagset.StringVar(&o.ID, "id", "", "Identifier of the record: an ID, DOI, or URL. Can also be given as the first argument.")
+	flagset.Var(&o.Files, "files", "Comma separated names or glob patterns of files to download. Can be repeated.")
+	flagset.BoolVar(&o.All, "all", false, "Download all the files in the record")
+	flagset.BoolVar(&o.Extract, "extract", false, "If item is compressed extract automatically")
+	flagset.StringVar(&o.Output, "output", "", "Destination name (filename for single item, directory name if multiple)")
+	flagset.IntVar(&o.Parallel, "parallel", 4, "Number of files to download at once")
+	flagset.BoolVar(&o.JSON, "json", false, "Print the record as JSON rather than text")
+	flagset.DurationVar(&o.PollInterval, "poll-interval", 30*time.Second, "How often to check on files that have to be prepared by the server")
+}
+
+// Run is the command line for providers that don't implement Commander.
+// With no files selected it describes the record, otherwise it downloads
+// the selected files.
+func Run(ctx context.Context, p Provider, args []string) error {
+	flagset := flag.NewFlagSet(p.Name(), flag.ContinueOnError)
+	var options Options
+	options.addFlags(flagset)
+	p.AddFlags(flagset, &options)
+	err := flagset.Parse(args)
+	if nil != err {
+		return err
+	}
+
+	if "" == options.ID {
+		if 0 == flagset.NArg() {
+			flagset.Usage()
+			return fmt.Errorf("an identifier is required")
+		}
+		options.ID = flagset.Arg(0)
+	}
+
+	record, err := p.Resolve(ctx, options.ID)
+	if nil != err {
+		return fmt.Errorf("failed to look up %s record: %w", p.Name(), err)
+	}
+
+	if !options.All && (0 == len(options.Files)) {
+		if options.JSON {
+			return printJSON(record)
+		}
+		printRecord(record)
+		return nil
+	}
+
+	files, err := Select(record.Files, options.Files, options.All)
+	if nil != err {
+		return err
+	}
+	return Fetch(ctx, p, record, files, options)
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func printRecord(record Record) {
+	fmt.Printf("title: %s\n", record.Title)
+	fmt.Printf("id: %s\n", record.ID)
+	if "" != record.DOI {
+		fmt.Printf("doi: %s\n", record.DOI)
+	}
+	if "" != record.Version {
+		fmt.Printf("version: %s\n", record.Version)
+	}
+	for _, detail := range record.Details {
+		fmt.Printf("%s: %s\n", detail.Name, detail.Value)
+	}
+	fmt.Printf("files:\n")
+	for _, file := range record.Files {
+		if file.Size > 0 {
+			fmt.Printf("\t%s (%s)\n", file.Name, utils.FormatSize(file.Size))
+		} else {
+			fmt.Printf("\t%s\n", file.Name)
+		}
+	}
+}
+
+// A pattern matches a file if it matches its name, or one of the
+// directories it is in, so that whole directories can be picked.
+func matches(pattern string, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	for candidate := name; ("." != candidate) && ("/" != candidate) && ("" != candidate); candidate = path.Dir(candidate) {
+		if ok, _ := path.Match(pattern, candidate); ok || (pattern == candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select picks the files whose names match any of the patterns, in the
+// order they appear in the record. A pattern that matches nothing is an
+// error, as it is most likely a typo.
+func Select(files []File, patterns []string, all bool) ([]File, error) {
+	if all {
+		if 0 == len(files) {
+			return nil, fmt.Errorf("record has no files")
+		}
+		return files, nil
+	}
+
+	selected := make([]File, 0, len(patterns))
+	chosen := make(map[int]bool)
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if nil != err {
+			return nil, fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+		}
+		matched := false
+		for idx, file := range files {
+			if !matches(pattern, file.Name) {
+				continue
+			}
+			matched = true
+			if !chosen[idx] {
+				chosen[idx] = true
+				selected = append(selected, file)
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no file in record matches %q", pattern)
+		}
+	}
+
+	// Keep the record's order regardless of the order of the patterns
+	ordered := make([]File, 0, len(selected))
+	for idx, file := range files {
+		if chosen[idx] {
+			ordered = append(ordered, file)
+		}
+	}
+	return ordered, nil
+}
+
+// Fetch downloads the files, several at a time. A single file is saved as
+// -output says, as it always has been, but several files are saved under
+// -output as a directory, keeping any directories in their names. All the
+// files are attempted even if some fail, and a Finisher is only called if
+// they all succeed.
+func Fetch(ctx context.Context, p Provider, record Record, files []File, options Options) error {
+	parallel := options.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(files))
+	localPaths := make([]string, len(files))
+	slots := make(chan struct{}, parallel)
+	for idx, file := range files {
+		wg.Add(1)
+		go func(idx int, file File) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				errs[idx] = fmt.Errorf("%s: %w", file.Name, ctx.Err())
+				return
+			}
+			defer func() { <-slots }()
+
+			localPath, err := fetchFile(ctx, p, record, file, 1 < len(files), options)
+			if nil != err {
+				errs[idx] = fmt.Errorf("%s: %w", file.Name, err)
+			}
+			localPaths[idx] = localPath
+		}(idx, file)
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if nil != err {
+		return err
+	}
+
+	finisher, ok := p.(Finisher)
+	if !ok {
+		return nil
+	}
+	return finisher.Finish(record, files, localPaths, options)
+}
+
+// fetchFile returns where the file was saved, unless it was extracted.
+func fetchFile(ctx context.Context, p Provider, record Record, file File, several bool, options Options) (string, error) {
+	if file.Async {
+		async, ok := p.(AsyncProvider)
+		if !ok {
+			return "", fmt.Errorf("file must be requested, which %s does not support", p.Name())
+		}
+		var err error
+		file, err = await(ctx, async, record, file, options.PollInterval)
+		if nil != err {
+			return "", err
+		}
+	}
+	if "" == file.URL {
+		return "", fmt.Errorf("no download URL for file")
+	}
+
+	destination := options.Output
+	if several {
+		if "" == destination {
+			cwd, err := os.Getwd()
+			if nil != err {
+				return "", fmt.Errorf("failed to find current dir: %w", err)
+			}
+			destination = cwd
+		}
+		destination = path.Join(destination, path.Dir(path.Clean("/"+file.Name)))
+		err := os.MkdirAll(destination, os.ModePerm)
+		if nil != err {
+			return "", fmt.Errorf("failed to make output dir: %w", err)
+		}
+	}
+
+	err := utils.Download{
+		URL:         file.URL,
+		Filename:    path.Base(file.Name),
+		Headers:     file.Headers,
+		Checksum:    file.Checksum,
+		Extract:     options.Extract,
+		Destination: destination,
+	}.Fetch(ctx)
+	if nil != err {
+		return "", err
+	}
+	if options.Extract {
+		return "", nil
+	}
+
+	// This is where Download will have put it
+	localPath, err := utils.MakeOutputPath(path.Base(file.Name), destination)
+	if nil != err {
+		return "", err
+	}
+	if processor, ok := p.(Processor); ok {
+		err = processor.Process(file, localPath)
+	}
+	return localPath, err
+}
+
+func await(ctx context.Context, p AsyncProvider, record Record, file File, interval time.Duration) (File, error) {
+	taskID, err := p.Request(ctx, record, file)
+	if nil != err {
+		return File{}, fmt.Errorf("failed to request file: %w", err)
+	}
+	for {
+		ready, done, err := p.Poll(ctx, taskID)
+		if nil != err {
+			return File{}, fmt.Errorf("failed to check on request %s: %w", taskID, err)
+		}
+		if done {
+			if "" == ready.Name {
+				ready.Name = file.Name
+			}
+			return ready, nil
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return File{}, fmt.Errorf("stopped waiting for request %s: %w", taskID, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
@@ -1,20 +1,42 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 
 	"quantify.earth/reclaimer/clms"
+	"quantify.earth/reclaimer/dataverse"
+	"quantify.earth/reclaimer/doi"
+	"quantify.earth/reclaimer/dryad"
+	"quantify.earth/reclaimer/figshare"
+	"quantify.earth/reclaimer/osf"
+	"quantify.earth/reclaimer/pangaea"
+	"quantify.earth/reclaimer/provider"
+	"quantify.earth/reclaimer/stac"
 	"quantify.earth/reclaimer/zenodo"
 )
 
-type subcommand func([]string)
+func init() {
+	provider.Register(&zenodo.Provider{})
+	provider.Register(&clms.Provider{})
+	provider.Register(&dataverse.Provider{})
+	provider.Register(&dryad.Provider{})
+	provider.Register(&figshare.Provider{})
+	provider.Register(&osf.Provider{})
+	provider.Register(&pangaea.Provider{})
+	provider.Register(&stac.Provider{})
+	provider.Register(&doi.Dispatcher{})
+}
 
-var subcommands = map[string]subcommand{
-	"zenodo": zenodo.ZenodoMain,
-	"clms":   clms.CLMSMain,
+func listProviders() {
+	for _, p := range provider.Providers() {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", p.Name(), p.Description())
+	}
 }
 
 func main() {
@@ -27,21 +49,33 @@ func main() {
 			panic(err)
 		}
 		fmt.Fprintf(os.Stderr, "Usage: %s [subcommand] [subcommand args]\n", path.Base(execPath))
-		for cmd := range subcommands {
-			fmt.Fprintf(os.Stderr, "\t%s\n", cmd)
-		}
+		listProviders()
 		os.Exit(1)
 	}
 
 	cmd, args := args[0], args[1:]
 
-	if subcmd, ok := subcommands[cmd]; ok {
-		subcmd(args)
-	} else {
+	p, ok := provider.Lookup(cmd)
+	if !ok {
 		fmt.Fprintf(os.Stderr, "Unrecognised subcommand. Options are:\n")
-		for cmd := range subcommands {
-			fmt.Fprintf(os.Stderr, "\t%s\n", cmd)
-		}
+		listProviders()
+		os.Exit(1)
+	}
+
+	// Let an interrupt stop a long wait cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	var err error
+	if commander, ok := p.(provider.Commander); ok {
+		err = commander.Command(ctx, args)
+	} else {
+		err = provider.Run(ctx, p, args)
+	}
+	stop()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 		os.Exit(1)
 	}
 }
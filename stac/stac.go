@@ -0,0 +1,737 @@
+// Package stac searches SpatioTemporal Asset Catalogs, either STAC APIs or
+// static catalogs, and downloads the assets of the items found.
+package stac
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const Version = "1.0.0"
+
+type STACLink struct {
+	Rel    string `json:"rel"`
+	Href   string `json:"href"`
+	Type   string `json:"type,omitempty"`
+	Method string `json:"method,omitempty"`
+	// For next links of POST searches, the body to send, either as is or
+	// merged into the previous one.
+	Body  map[string]interface{} `json:"body,omitempty"`
+	Merge bool                   `json:"merge,omitempty"`
+}
+
+type STACAsset struct {
+	Href  string   `json:"href"`
+	Title string   `json:"title"`
+	Type  string   `json:"type"`
+	Roles []string `json:"roles"`
+	// From the file extension, which not every catalog uses.
+	Size     int64  `json:"file:size"`
+	Checksum string `json:"file:checksum"`
+}
+
+// STACObject is a catalog, collection or item, which are all read the same
+// way as the identifier may be any of them.
+type STACObject struct {
+	Type        string                 `json:"type"`
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Collection  string                 `json:"collection"`
+	BBox        []float64              `json:"bbox"`
+	Properties  map[string]interface{} `json:"properties"`
+	Assets      map[string]STACAsset   `json:"assets"`
+	Links       []STACLink             `json:"links"`
+}
+
+func (o STACObject) link(rel string) (STACLink, bool) {
+	for _, link := range o.Links {
+		if rel == link.Rel {
+			return link, true
+		}
+	}
+	return STACLink{}, false
+}
+
+// searchLink prefers searching with POST, as a filter can be long, but
+// not every API supports it.
+func (o STACObject) searchLink() (STACLink, bool) {
+	found, ok := STACLink{}, false
+	for _, link := range o.Links {
+		if "search" != link.Rel {
+			continue
+		}
+		if "POST" == link.Method {
+			return link, true
+		}
+		if !ok {
+			found, ok = link, true
+		}
+	}
+	return found, ok
+}
+
+type stacItemCollection struct {
+	Features []json.RawMessage `json:"features"`
+	Links    []STACLink        `json:"links"`
+}
+
+// An item as found, along with where it came from, so that relative links
+// can be resolved, and the original, so that it can be written out again
+// with nothing lost.
+type stacItem struct {
+	STACObject
+	url string
+	raw map[string]interface{}
+}
+
+func newItem(raw json.RawMessage, itemURL string) (stacItem, error) {
+	item := stacItem{url: itemURL}
+	err := json.Unmarshal(raw, &item.STACObject)
+	if nil != err {
+		return stacItem{}, fmt.Errorf("failed to decode item: %w", err)
+	}
+	err = json.Unmarshal(raw, &item.raw)
+	if nil != err {
+		return stacItem{}, fmt.Errorf("failed to decode item: %w", err)
+	}
+	// The ID names the item's directory and file, so it mustn't lead
+	// anywhere else
+	if ("" == item.ID) || ("." == item.ID) || (".." == item.ID) || strings.ContainsAny(item.ID, `/\`) {
+		return stacItem{}, fmt.Errorf("item %q from %s has an ID that can't be used as a file name", item.ID, itemURL)
+	}
+	// Items from a search say where they live
+	if self, ok := item.link("self"); ok {
+		if resolved, err := resolve(itemURL, self.Href); nil == err {
+			item.url = resolved
+		}
+	}
+	return item, nil
+}
+
+// Each file is an asset of one of the items.
+type source struct {
+	item *stacItem
+	key  string
+}
+
+// Provider searches a STAC API, or walks a static catalog, given the URL of
+// its root, a collection, or a single item.
+type Provider struct {
+	collections []string
+	bbox        []float64
+	datetime    string
+	start, end  time.Time
+	filter      string
+	filterLang  string
+	maxItems    int
+	assets      []string
+
+	// Set by Resolve, for Finish to write the local catalog.
+	root    string
+	sources map[string]source
+}
+
+func (p *Provider) Name() string {
+	return "stac"
+}
+
+func (p *Provider) Description() string {
+	return "STAC APIs and static catalogs, searched by collection, area and time"
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	flagset.Func("collections", "Comma separated IDs of collections to search", func(value string) error {
+		p.collections = append(p.collections, splitList(value)...)
+		return nil
+	})
+	flagset.Func("bbox", "Area to search, as west,south,east,north in degrees", func(value string) error {
+		bbox, err := parseBBox(value)
+		p.bbox = bbox
+		return err
+	})
+	flagset.Func("datetime", "Time or interval to search, e.g. 2023-06-01T00:00:00Z or 2023-01-01/2023-12-31, with .. for an open end", func(value string) error {
+		start, end, err := parseInterval(value)
+		p.datetime, p.start, p.end = formatInterval(start, end), start, end
+		return err
+	})
+	flagset.StringVar(&p.filter, "filter", "", "CQL2 filter on item properties, as text or JSON. Needs a STAC API.")
+	flagset.StringVar(&p.filterLang, "filter-lang", "", "Language of -filter, cql2-text or cql2-json, by default worked out from the filter")
+	flagset.IntVar(&p.maxItems, "max-items", 100, "Most items to list, or 0 for all that match")
+	flagset.Func("assets", "Comma separated asset keys to download from every item found, e.g. B04,B08", func(value string) error {
+		p.assets = append(p.assets, splitList(value)...)
+		options.All = true
+		return nil
+	})
+}
+
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if "" != part {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+func parseBBox(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if 4 != len(parts) {
+		return nil, fmt.Errorf("bbox should be west,south,east,north, got %q", value)
+	}
+	bbox := make([]float64, len(parts))
+	for idx, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if nil != err {
+			return nil, fmt.Errorf("invalid bbox %q: %w", value, err)
+		}
+		bbox[idx] = number
+	}
+	if (bbox[1] > bbox[3]) || (bbox[0] < -180) || (bbox[2] > 180) || (bbox[1] < -90) || (bbox[3] > 90) {
+		return nil, fmt.Errorf("bbox %q is out of range", value)
+	}
+	return bbox, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); nil == err {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseInterval reads a STAC datetime, returning zero times for open ends.
+// An end that is a day rather than a time covers the whole day.
+func parseInterval(value string) (time.Time, time.Time, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) > 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid datetime %q", value)
+	}
+	times := make([]time.Time, 2)
+	for idx, part := range parts {
+		if ("" == part) || (".." == part) {
+			continue
+		}
+		t, err := parseTime(part)
+		if nil != err {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid datetime %q: %w", value, err)
+		}
+		times[idx] = t
+	}
+	last := parts[len(parts)-1]
+	if 1 == len(parts) {
+		times[1] = times[0]
+	}
+	if !strings.Contains(last, "T") && !times[1].IsZero() {
+		times[1] = times[1].Add(24*time.Hour - time.Nanosecond)
+	}
+	if !times[0].IsZero() && !times[1].IsZero() && times[1].Before(times[0]) {
+		return time.Time{}, time.Time{}, fmt.Errorf("datetime %q ends before it starts", value)
+	}
+	return times[0], times[1], nil
+}
+
+// formatInterval gives the interval as APIs want it, which is always full
+// times, whereas people are more likely to give days.
+func formatInterval(start time.Time, end time.Time) string {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ".."
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return format(start) + "/" + format(end)
+}
+
+func resolve(base string, href string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if nil != err {
+		return "", fmt.Errorf("invalid URL %s: %w", base, err)
+	}
+	ref, err := url.Parse(href)
+	if nil != err {
+		return "", fmt.Errorf("invalid link %s: %w", href, err)
+	}
+	return baseURL.ResolveReference(ref).String(), nil
+}
+
+func fetchObject(ctx context.Context, objectURL string) (STACObject, json.RawMessage, error) {
+	var raw json.RawMessage
+	err := utils.HTTPGetJSON(ctx, objectURL, nil, &raw)
+	if nil != err {
+		return STACObject{}, nil, err
+	}
+	var object STACObject
+	err = json.Unmarshal(raw, &object)
+	if nil != err {
+		return STACObject{}, nil, fmt.Errorf("failed to decode %s: %w", objectURL, err)
+	}
+	return object, raw, nil
+}
+
+func (p *Provider) full(items []stacItem) bool {
+	return (0 < p.maxItems) && (p.maxItems <= len(items))
+}
+
+// The search body, which is also turned into query parameters for APIs
+// that only search with GET.
+func (p *Provider) searchParameters() (map[string]interface{}, error) {
+	parameters := make(map[string]interface{})
+	if 0 < len(p.collections) {
+		parameters["collections"] = p.collections
+	}
+	if nil != p.bbox {
+		parameters["bbox"] = p.bbox
+	}
+	if "" != p.datetime {
+		parameters["datetime"] = p.datetime
+	}
+	if 0 < p.maxItems {
+		parameters["limit"] = p.maxItems
+	}
+	if "" != p.filter {
+		lang := p.filterLang
+		if "" == lang {
+			lang = "cql2-text"
+			if strings.HasPrefix(strings.TrimSpace(p.filter), "{") {
+				lang = "cql2-json"
+			}
+		}
+		switch lang {
+		case "cql2-text":
+			parameters["filter"] = p.filter
+		case "cql2-json":
+			var filter interface{}
+			err := json.Unmarshal([]byte(p.filter), &filter)
+			if nil != err {
+				return nil, fmt.Errorf("invalid CQL2 JSON filter: %w", err)
+			}
+			parameters["filter"] = filter
+		default:
+			return nil, fmt.Errorf("unknown filter language %q, expected cql2-text or cql2-json", lang)
+		}
+		parameters["filter-lang"] = lang
+	}
+	return parameters, nil
+}
+
+func queryString(parameters map[string]interface{}) (string, error) {
+	query := url.Values{}
+	for key, value := range parameters {
+		switch v := value.(type) {
+		case string:
+			query.Set(key, v)
+		case []string:
+			query.Set(key, strings.Join(v, ","))
+		case []float64:
+			numbers := make([]string, len(v))
+			for idx, number := range v {
+				numbers[idx] = strconv.FormatFloat(number, 'f', -1, 64)
+			}
+			query.Set(key, strings.Join(numbers, ","))
+		default:
+			encoded, err := json.Marshal(v)
+			if nil != err {
+				return "", err
+			}
+			query.Set(key, string(encoded))
+		}
+	}
+	return query.Encode(), nil
+}
+
+// search uses the API's item search, following the pages of results.
+func (p *Provider) search(ctx context.Context, link STACLink, rootURL string) ([]stacItem, error) {
+	parameters, err := p.searchParameters()
+	if nil != err {
+		return nil, err
+	}
+	searchURL, err := resolve(rootURL, link.Href)
+	if nil != err {
+		return nil, err
+	}
+	method := link.Method
+	if "" == method {
+		method = "GET"
+	}
+	if "GET" == method {
+		query, err := queryString(parameters)
+		if nil != err {
+			return nil, err
+		}
+		searchURL += "?" + query
+	}
+
+	items := make([]stacItem, 0)
+	for "" != searchURL {
+		var page stacItemCollection
+		if "POST" == method {
+			err = utils.HTTPPostJSON(ctx, searchURL, nil, parameters, &page)
+		} else {
+			err = utils.HTTPGetJSON(ctx, searchURL, nil, &page)
+		}
+		if nil != err {
+			return nil, fmt.Errorf("search failed: %w", err)
+		}
+		for _, feature := range page.Features {
+			if p.full(items) {
+				return items, nil
+			}
+			item, err := newItem(feature, searchURL)
+			if nil != err {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		next, ok := STACObject{Links: page.Links}.link("next")
+		if !ok || p.full(items) || (0 == len(page.Features)) {
+			break
+		}
+		searchURL, err = resolve(searchURL, next.Href)
+		if nil != err {
+			return nil, err
+		}
+		method = next.Method
+		if "" == method {
+			method = "GET"
+		}
+		if "POST" == method {
+			if !next.Merge {
+				parameters = make(map[string]interface{})
+			}
+			for key, value := range next.Body {
+				parameters[key] = value
+			}
+		}
+	}
+	return items, nil
+}
+
+func (p *Provider) wantsCollection(collection string) bool {
+	if 0 == len(p.collections) {
+		return true
+	}
+	for _, candidate := range p.collections {
+		if candidate == collection {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) matches(item STACObject, collection string) bool {
+	if "" != item.Collection {
+		collection = item.Collection
+	}
+	if !p.wantsCollection(collection) {
+		return false
+	}
+	if (nil != p.bbox) && (4 <= len(item.BBox)) {
+		// 3D bounding boxes have the heights in the middle
+		west, south, east, north := item.BBox[0], item.BBox[1], item.BBox[len(item.BBox)/2], item.BBox[len(item.BBox)/2+1]
+		if (west > p.bbox[2]) || (east < p.bbox[0]) || (south > p.bbox[3]) || (north < p.bbox[1]) {
+			return false
+		}
+	}
+	if "" != p.datetime {
+		start, end := itemTimes(item)
+		if !p.end.IsZero() && !start.IsZero() && start.After(p.end) {
+			return false
+		}
+		if !p.start.IsZero() && !end.IsZero() && end.Before(p.start) {
+			return false
+		}
+	}
+	return true
+}
+
+func itemTimes(item STACObject) (time.Time, time.Time) {
+	property := func(name string) time.Time {
+		value, _ := item.Properties[name].(string)
+		t, _ := time.Parse(time.RFC3339, value)
+		return t
+	}
+	if t := property("datetime"); !t.IsZero() {
+		return t, t
+	}
+	return property("start_datetime"), property("end_datetime")
+}
+
+// walk goes through a static catalog, checking each item against the
+// search itself as there is no API to do it.
+func (p *Provider) walk(ctx context.Context, object STACObject, objectURL string, collection string, visited map[string]bool, items []stacItem) ([]stacItem, error) {
+	if "Collection" == object.Type {
+		collection = object.ID
+		if !p.wantsCollection(collection) {
+			return items, nil
+		}
+	}
+	for _, link := range object.Links {
+		if p.full(items) {
+			break
+		}
+		if ("item" != link.Rel) && ("child" != link.Rel) {
+			continue
+		}
+		linkURL, err := resolve(objectURL, link.Href)
+		if nil != err {
+			return nil, err
+		}
+		if visited[linkURL] {
+			continue
+		}
+		visited[linkURL] = true
+
+		child, raw, err := fetchObject(ctx, linkURL)
+		if nil != err {
+			return nil, fmt.Errorf("failed to fetch %s: %w", linkURL, err)
+		}
+		if "Feature" != child.Type {
+			items, err = p.walk(ctx, child, linkURL, collection, visited, items)
+			if nil != err {
+				return nil, err
+			}
+			continue
+		}
+		if !p.matches(child, collection) {
+			continue
+		}
+		item, err := newItem(raw, linkURL)
+		if nil != err {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// multihashes are what the file extension uses for checksums.
+var multihashAlgorithms = map[byte]string{
+	0xd5: "md5",
+	0x11: "sha1",
+	0x12: "sha256",
+	0x13: "sha512",
+}
+
+func parseMultihash(multihash string) string {
+	decoded, err := hex.DecodeString(multihash)
+	if (nil != err) || (len(decoded) < 3) {
+		return ""
+	}
+	algorithm, ok := multihashAlgorithms[decoded[0]]
+	if !ok || (int(decoded[1]) != len(decoded)-2) {
+		return ""
+	}
+	return algorithm + ":" + hex.EncodeToString(decoded[2:])
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	root, raw, err := fetchObject(ctx, identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	var items []stacItem
+	if "Feature" == root.Type {
+		item, err := newItem(raw, identifier)
+		if nil != err {
+			return provider.Record{}, err
+		}
+		items = []stacItem{item}
+	} else if link, ok := root.searchLink(); ok {
+		// A collection in an API searches within itself
+		if ("Collection" == root.Type) && (0 == len(p.collections)) {
+			p.collections = []string{root.ID}
+		}
+		items, err = p.search(ctx, link, identifier)
+		if nil != err {
+			return provider.Record{}, err
+		}
+	} else {
+		if "" != p.filter {
+			return provider.Record{}, fmt.Errorf("filtering with CQL2 needs a STAC API, and %s is a static catalog", identifier)
+		}
+		items, err = p.walk(ctx, root, identifier, "", map[string]bool{identifier: true}, nil)
+		if nil != err {
+			return provider.Record{}, err
+		}
+	}
+
+	record := provider.Record{
+		ID:    identifier,
+		Title: root.Title,
+	}
+	if "" == record.Title {
+		record.Title = root.ID
+	}
+	p.root = identifier
+	p.sources = make(map[string]source)
+	// Which of the asset keys asked for have been found
+	wanted := make(map[string]bool)
+	for _, key := range p.assets {
+		wanted[key] = false
+	}
+	filtering := 0 < len(wanted)
+
+	for idx := range items {
+		item := &items[idx]
+		keys := make([]string, 0, len(item.Assets))
+		for key := range item.Assets {
+			if _, ok := wanted[key]; ok || !filtering {
+				keys = append(keys, key)
+				wanted[key] = true
+			}
+		}
+		sort.Strings(keys)
+		start, _ := itemTimes(item.STACObject)
+		summary := item.ID
+		if !start.IsZero() {
+			summary = fmt.Sprintf("%s (%s)", item.ID, start.Format(time.RFC3339))
+		}
+		record.Details = append(record.Details, provider.Detail{Name: "item", Value: fmt.Sprintf("%s: %s", summary, strings.Join(keys, ", "))})
+
+		names := make(map[string]bool)
+		for _, key := range keys {
+			asset := item.Assets[key]
+			assetURL, err := resolve(item.url, asset.Href)
+			if nil != err {
+				return provider.Record{}, err
+			}
+			// Assets are usually named after their key already, but if not
+			// they may all have the same name
+			name := ""
+			if parsed, err := url.Parse(assetURL); nil == err {
+				name = path.Base(parsed.Path)
+			}
+			if ("" == name) || ("/" == name) || ("." == name) || names[name] {
+				name = key + path.Ext(name)
+			}
+			names[name] = true
+
+			file := provider.File{
+				ID:       item.ID + "/" + key,
+				Name:     item.ID + "/" + name,
+				Size:     asset.Size,
+				URL:      assetURL,
+				Checksum: parseMultihash(asset.Checksum),
+			}
+			p.sources[file.ID] = source{item: item, key: key}
+			record.Files = append(record.Files, file)
+		}
+	}
+	for key, found := range wanted {
+		if !found {
+			return provider.Record{}, fmt.Errorf("no item found has an asset %q", key)
+		}
+	}
+	return record, nil
+}
+
+// Finish writes a catalog of the items downloaded, with each item's assets
+// pointing at the downloaded files, so that the data can be used with STAC
+// tools as it was before.
+func (p *Provider) Finish(record provider.Record, files []provider.File, localPaths []string, options provider.Options) error {
+	dir := options.Output
+	if "" == dir {
+		cwd, err := os.Getwd()
+		if nil != err {
+			return fmt.Errorf("failed to find current dir: %w", err)
+		}
+		dir = cwd
+	}
+	if info, err := os.Stat(dir); (nil != err) || !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	downloaded := make(map[*stacItem]map[string]string)
+	order := make([]*stacItem, 0)
+	for idx, file := range files {
+		src, ok := p.sources[file.ID]
+		if !ok || ("" == localPaths[idx]) {
+			continue
+		}
+		if _, ok := downloaded[src.item]; !ok {
+			downloaded[src.item] = make(map[string]string)
+			order = append(order, src.item)
+		}
+		downloaded[src.item][src.key] = localPaths[idx]
+	}
+	if 0 == len(order) {
+		return nil
+	}
+
+	catalog := map[string]interface{}{
+		"type":         "Catalog",
+		"stac_version": Version,
+		"id":           "reclaimer",
+		"description":  fmt.Sprintf("Assets downloaded from %s", p.root),
+	}
+	links := []STACLink{{Rel: "root", Href: "./catalog.json", Type: "application/json"}}
+	for _, item := range order {
+		itemDir := filepath.Join(dir, item.ID)
+		err := os.MkdirAll(itemDir, os.ModePerm)
+		if nil != err {
+			return fmt.Errorf("failed to make item dir: %w", err)
+		}
+
+		assets, _ := item.raw["assets"].(map[string]interface{})
+		for key, value := range assets {
+			asset, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			href, _ := asset["href"].(string)
+			if localPath, ok := downloaded[item][key]; ok {
+				relative, err := filepath.Rel(itemDir, localPath)
+				if nil != err {
+					return fmt.Errorf("failed to find %s from catalog: %w", localPath, err)
+				}
+				asset["href"] = "./" + filepath.ToSlash(relative)
+			} else if resolved, err := resolve(item.url, href); nil == err {
+				// Not downloaded, so keep pointing at the original
+				asset["href"] = resolved
+			}
+		}
+		item.raw["links"] = []STACLink{
+			{Rel: "root", Href: "../catalog.json", Type: "application/json"},
+			{Rel: "parent", Href: "../catalog.json", Type: "application/json"},
+			{Rel: "via", Href: item.url, Type: "application/geo+json"},
+		}
+		err = writeJSON(filepath.Join(itemDir, item.ID+".json"), item.raw)
+		if nil != err {
+			return err
+		}
+		links = append(links, STACLink{Rel: "item", Href: fmt.Sprintf("./%s/%s.json", item.ID, item.ID), Type: "application/geo+json"})
+	}
+	catalog["links"] = links
+	return writeJSON(filepath.Join(dir, "catalog.json"), catalog)
+}
+
+func writeJSON(filename string, value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if nil != err {
+		return fmt.Errorf("failed to encode %s: %w", filename, err)
+	}
+	err = os.WriteFile(filename, append(encoded, '\n'), 0644)
+	if nil != err {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package stac
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quantify.earth/reclaimer/provider"
+)
+
+// The fixture is served as a static catalog under /static/, and a minimal
+// search API under /api/ answers with the same items, remembering what it
+// was asked.
+type testServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	searches []map[string]interface{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	server := &testServer{}
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("testdata/catalog"))))
+	mux.Handle("/hostile/", http.StripPrefix("/hostile/", http.FileServer(http.Dir("testdata/hostile"))))
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"type": "Catalog", "id": "api", "title": "Test API", "links": [
+			{"rel": "search", "href": "/api/search", "method": "GET"},
+			{"rel": "search", "href": "/api/search", "method": "POST"}]}`)
+	})
+	mux.HandleFunc("/get-api/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"type": "Catalog", "id": "api", "links": [{"rel": "search", "href": "/api/search"}]}`)
+	})
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		if "POST" == r.Method {
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if nil != err {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		} else {
+			for key := range r.URL.Query() {
+				body[key] = r.URL.Query().Get(key)
+			}
+		}
+		server.lock.Lock()
+		server.searches = append(server.searches, body)
+		server.lock.Unlock()
+
+		// Two pages, the second asked for by merging a token into the search
+		if "page2" == body["token"] {
+			fmt.Fprintf(w, `{"type": "FeatureCollection", "features": [%s], "links": []}`, server.item(t, "item-b"))
+			return
+		}
+		fmt.Fprintf(w, `{"type": "FeatureCollection", "features": [%s], "links": [
+			{"rel": "next", "href": "/api/search", "method": "POST", "body": {"token": "page2"}, "merge": true}]}`, server.item(t, "item-a"))
+	})
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// item is as an API would return it, with a self link to where it lives.
+func (s *testServer) item(t *testing.T, id string) string {
+	filename := path.Join("sentinel", id, id+".json")
+	raw, err := os.ReadFile(path.Join("testdata/catalog", filename))
+	if nil != err {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var item map[string]interface{}
+	err = json.Unmarshal(raw, &item)
+	if nil != err {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	item["links"] = []interface{}{map[string]string{"rel": "self", "href": s.URL + "/static/" + filename}}
+	encoded, _ := json.Marshal(item)
+	return string(encoded)
+}
+
+func fileNames(record provider.Record) string {
+	names := make([]string, len(record.Files))
+	for idx, file := range record.Files {
+		names[idx] = file.Name
+	}
+	return fmt.Sprint(names)
+}
+
+func parseFlags(t *testing.T, p *Provider, args ...string) provider.Options {
+	flagset := flag.NewFlagSet("stac", flag.ContinueOnError)
+	var options provider.Options
+	p.AddFlags(flagset, &options)
+	err := flagset.Parse(args)
+	if nil != err {
+		t.Fatalf("failed to parse %v: %v", args, err)
+	}
+	return options
+}
+
+func TestParseInterval(t *testing.T) {
+	day := func(value string) time.Time {
+		result, _ := time.Parse(time.RFC3339, value)
+		return result
+	}
+	tests := []struct {
+		value string
+		start time.Time
+		end   time.Time
+	}{
+		{"2023-06-01T10:00:00Z", day("2023-06-01T10:00:00Z"), day("2023-06-01T10:00:00Z")},
+		{"2023-06-01", day("2023-06-01T00:00:00Z"), day("2023-06-02T00:00:00Z").Add(-time.Nanosecond)},
+		{"2023-01-01/2023-06-30", day("2023-01-01T00:00:00Z"), day("2023-07-01T00:00:00Z").Add(-time.Nanosecond)},
+		{"../2023-06-30T12:00:00Z", time.Time{}, day("2023-06-30T12:00:00Z")},
+		{"2023-01-01T00:00:00Z/", day("2023-01-01T00:00:00Z"), time.Time{}},
+	}
+	for _, test := range tests {
+		start, end, err := parseInterval(test.value)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Errorf("%s: expected %v to %v, got %v to %v", test.value, test.start, test.end, start, end)
+		}
+	}
+	for _, value := range []string{"yesterday", "2023-06-30/2023-01-01", "2023/01/01"} {
+		if _, _, err := parseInterval(value); nil == err {
+			t.Errorf("%q: expected error", value)
+		}
+	}
+}
+
+func TestParseMultihash(t *testing.T) {
+	tests := map[string]string{
+		"1220" + strings.Repeat("ab", 32): "sha256:" + strings.Repeat("ab", 32),
+		"d510" + strings.Repeat("01", 16): "md5:" + strings.Repeat("01", 16),
+		"1220abcd":                        "",
+		"9910abcd":                        "",
+		"not hex":                         "",
+	}
+	for multihash, expected := range tests {
+		if checksum := parseMultihash(multihash); expected != checksum {
+			t.Errorf("%s: expected %q, got %q", multihash, expected, checksum)
+		}
+	}
+}
+
+func TestResolveStatic(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "[item-a/B04.tif item-a/B08.tif item-a/thumb.png item-b/B04.tif item-b/B08.tif item-c/red.tif]"},
+		{[]string{"-collections", "sentinel"}, "[item-a/B04.tif item-a/B08.tif item-a/thumb.png item-b/B04.tif item-b/B08.tif]"},
+		{[]string{"-bbox", "0.5,50.5,2,52"}, "[item-a/B04.tif item-a/B08.tif item-a/thumb.png item-c/red.tif]"},
+		{[]string{"-datetime", "2023-06-02/.."}, "[item-b/B04.tif item-b/B08.tif item-c/red.tif]"},
+		{[]string{"-datetime", "2023-06-01"}, "[item-a/B04.tif item-a/B08.tif item-a/thumb.png]"},
+		{[]string{"-assets", "B04"}, "[item-a/B04.tif item-b/B04.tif]"},
+		{[]string{"-max-items", "1"}, "[item-a/B04.tif item-a/B08.tif item-a/thumb.png]"},
+	}
+	for _, test := range tests {
+		p := &Provider{}
+		parseFlags(t, p, test.args...)
+		record, err := p.Resolve(context.Background(), server.URL+"/static/catalog.json")
+		if nil != err {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+			continue
+		}
+		if names := fileNames(record); test.expected != names {
+			t.Errorf("%v: expected %s, got %s", test.args, test.expected, names)
+		}
+	}
+
+	// Straight to an item
+	p := &Provider{}
+	record, err := p.Resolve(context.Background(), server.URL+"/static/landsat/item-c/item-c.json")
+	if (nil != err) || ("[item-c/red.tif]" != fileNames(record)) {
+		t.Errorf("expected item's assets, got %s: %v", fileNames(record), err)
+	}
+
+	for _, args := range [][]string{
+		{"-filter", "eo:cloud_cover < 10"},
+		{"-assets", "B99"},
+	} {
+		p := &Provider{}
+		parseFlags(t, p, args...)
+		if _, err := p.Resolve(context.Background(), server.URL+"/static/catalog.json"); nil == err {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestResolveSearch(t *testing.T) {
+	server := newTestServer(t)
+
+	p := &Provider{}
+	parseFlags(t, p, "-collections", "sentinel", "-bbox", "-10,40,20,60", "-datetime", "2023-01-01/2023-12-31", "-filter", "eo:cloud_cover < 50", "-max-items", "10")
+	record, err := p.Resolve(context.Background(), server.URL+"/api/")
+	if nil != err {
+		t.Fatalf("failed to search: %v", err)
+	}
+	expected := "[item-a/B04.tif item-a/B08.tif item-a/thumb.png item-b/B04.tif item-b/B08.tif]"
+	if names := fileNames(record); expected != names {
+		t.Errorf("expected %s, got %s", expected, names)
+	}
+	// Relative to the item's self link
+	if server.URL+"/static/sentinel/item-a/B04.tif" != record.Files[0].URL {
+		t.Errorf("unexpected asset URL %s", record.Files[0].URL)
+	}
+
+	if 2 != len(server.searches) {
+		t.Fatalf("expected two pages, got %d searches", len(server.searches))
+	}
+	var first strings.Builder
+	encoder := json.NewEncoder(&first)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(server.searches[0])
+	if nil != err {
+		t.Fatalf("failed to encode search: %v", err)
+	}
+	expected = `{"bbox":[-10,40,20,60],"collections":["sentinel"],"datetime":"2023-01-01T00:00:00Z/2023-12-31T23:59:59.999999999Z","filter":"eo:cloud_cover < 50","filter-lang":"cql2-text","limit":10}`
+	if expected != strings.TrimSpace(first.String()) {
+		t.Errorf("expected search %s, got %s", expected, first.String())
+	}
+	if ("page2" != server.searches[1]["token"]) || (nil == server.searches[1]["collections"]) {
+		t.Errorf("expected the next page's body to be merged into the search, got %v", server.searches[1])
+	}
+
+	// JSON filters are sent as JSON
+	p = &Provider{}
+	parseFlags(t, p, "-filter", `{"op": "<", "args": [{"property": "eo:cloud_cover"}, 10]}`, "-max-items", "1")
+	_, err = p.Resolve(context.Background(), server.URL+"/api/")
+	if nil != err {
+		t.Fatalf("failed to search: %v", err)
+	}
+	last := server.searches[len(server.searches)-1]
+	if _, ok := last["filter"].(map[string]interface{}); !ok || ("cql2-json" != last["filter-lang"]) {
+		t.Errorf("expected a CQL2 JSON filter, got %v", last)
+	}
+
+	// And as parameters to APIs that only search with GET
+	p = &Provider{}
+	parseFlags(t, p, "-collections", "sentinel,landsat", "-bbox", "-10,40,20,60", "-max-items", "1")
+	_, err = p.Resolve(context.Background(), server.URL+"/get-api/")
+	if nil != err {
+		t.Fatalf("failed to search: %v", err)
+	}
+	last = server.searches[len(server.searches)-1]
+	if ("sentinel,landsat" != last["collections"]) || ("-10,40,20,60" != last["bbox"]) || ("1" != last["limit"]) {
+		t.Errorf("unexpected search parameters %v", last)
+	}
+}
+
+func TestDownloadWritesCatalog(t *testing.T) {
+	server := newTestServer(t)
+	output := t.TempDir()
+
+	err := provider.Run(context.Background(), &Provider{}, []string{"-collections", "sentinel", "-assets", "B04,B08", "-output", output, server.URL + "/static/catalog.json"})
+	if nil != err {
+		t.Fatalf("failed to download: %v", err)
+	}
+	for _, name := range []string{"item-a/B04.tif", "item-a/B08.tif", "item-b/B04.tif", "item-b/B08.tif"} {
+		contents, err := os.ReadFile(path.Join(output, name))
+		expected := fmt.Sprintf("%s %s\n", path.Dir(name), strings.TrimSuffix(path.Base(name), ".tif"))
+		if (nil != err) || (expected != string(contents)) {
+			t.Errorf("%s: unexpected contents %q: %v", name, contents, err)
+		}
+	}
+
+	var catalog STACObject
+	raw, err := os.ReadFile(path.Join(output, "catalog.json"))
+	if nil == err {
+		err = json.Unmarshal(raw, &catalog)
+	}
+	if nil != err {
+		t.Fatalf("failed to read catalog: %v", err)
+	}
+	items := make([]string, 0)
+	for _, link := range catalog.Links {
+		if "item" == link.Rel {
+			items = append(items, link.Href)
+		}
+	}
+	if "[./item-a/item-a.json ./item-b/item-b.json]" != fmt.Sprint(items) {
+		t.Errorf("unexpected catalog items %v", items)
+	}
+
+	var item STACObject
+	raw, err = os.ReadFile(path.Join(output, "item-a/item-a.json"))
+	if nil == err {
+		err = json.Unmarshal(raw, &item)
+	}
+	if nil != err {
+		t.Fatalf("failed to read item: %v", err)
+	}
+	if "./B04.tif" != item.Assets["B04"].Href {
+		t.Errorf("expected downloaded asset to be local, got %s", item.Assets["B04"].Href)
+	}
+	if server.URL+"/static/sentinel/item-a/thumb.png" != item.Assets["thumbnail"].Href {
+		t.Errorf("expected other assets to point at the original, got %s", item.Assets["thumbnail"].Href)
+	}
+	if ("" == item.Assets["B04"].Checksum) || (5.0 != item.Properties["eo:cloud_cover"]) {
+		t.Errorf("expected the rest of the item to be kept, got %+v", item)
+	}
+	if parent, ok := item.link("parent"); !ok || ("../catalog.json" != parent.Href) {
+		t.Errorf("expected item to link to the local catalog, got %+v", item.Links)
+	}
+}
+
+func TestHostileItemID(t *testing.T) {
+	server := newTestServer(t)
+	output := path.Join(t.TempDir(), "a", "b")
+
+	err := provider.Run(context.Background(), &Provider{}, []string{"-all", "-output", output, server.URL + "/hostile/item.json"})
+	if (nil == err) || !strings.Contains(err.Error(), "file name") {
+		t.Errorf("expected item ID to be rejected, got %v", err)
+	}
+	for _, name := range []string{"escaped.json", "escaped/escaped.json", "escaped/B04.tif"} {
+		if _, err := os.Stat(path.Join(output, "../..", name)); nil == err {
+			t.Errorf("%s was written outside the output", name)
+		}
+	}
+}
+
+func TestChecksumChecked(t *testing.T) {
+	server := newTestServer(t)
+
+	p := &Provider{}
+	parseFlags(t, p, "-assets", "B04")
+	record, err := p.Resolve(context.Background(), server.URL+"/static/sentinel/item-a/item-a.json")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if !strings.HasPrefix(record.Files[0].Checksum, "sha256:") {
+		t.Fatalf("expected a checksum, got %q", record.Files[0].Checksum)
+	}
+	record.Files[0].Checksum = "sha256:" + strings.Repeat("0", 64)
+	err = provider.Fetch(context.Background(), p, record, record.Files, provider.Options{Output: t.TempDir(), Parallel: 1})
+	if nil == err {
+		t.Errorf("expected checksum mismatch")
+	}
+}
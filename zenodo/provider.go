@@ -0,0 +1,140 @@
+package zenodo
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
+)
+
+const DefaultBaseURL = "https://zenodo.org/api/"
+
+// Provider fetches records from Zenodo, or from another InvenioRDM
+// instance if BaseURL is set.
+type Provider struct {
+	BaseURL string
+}
+
+func (p *Provider) Name() string {
+	return "zenodo"
+}
+
+func (p *Provider) Description() string {
+	return "Zenodo records, by ID, DOI or URL"
+}
+
+func (p *Provider) DOIPrefixes() []string {
+	return []string{"10.5281"}
+}
+
+func (p *Provider) Hosts() []string {
+	return []string{"zenodo.org"}
+}
+
+func (p *Provider) AddFlags(flagset *flag.FlagSet, options *provider.Options) {
+	// The names this command has always had
+	flagset.StringVar(&options.ID, "zenodo_id", "", "Zenodo ID of resource")
+	flagset.Var(&options.Files, "filename", "Specific item within resource to download")
+}
+
+var (
+	zenodoDOIPattern = regexp.MustCompile(`^10\.5281/zenodo\.(\d+)$`)
+	zenodoURLPattern = regexp.MustCompile(`^https?://(?:www\.|sandbox\.)?zenodo\.org/(?:records?|deposit)/(\d+)`)
+)
+
+// ParseIdentifier gets the record ID from any of the ways people refer to
+// a Zenodo record: the ID itself, its DOI, or the URL of its page.
+func ParseIdentifier(identifier string) (string, error) {
+	identifier = strings.TrimSpace(identifier)
+	if _, err := strconv.ParseUint(identifier, 10, 64); nil == err {
+		return identifier, nil
+	}
+
+	doi := provider.TrimDOI(identifier)
+	if match := zenodoDOIPattern.FindStringSubmatch(strings.ToLower(doi)); nil != match {
+		return match[1], nil
+	}
+	if match := zenodoURLPattern.FindStringSubmatch(identifier); nil != match {
+		return match[1], nil
+	}
+	return "", fmt.Errorf("%q is not a Zenodo record ID, DOI, or URL", identifier)
+}
+
+func (p *Provider) recordURL(zenodoID string) string {
+	return provider.Endpoint(p.BaseURL, DefaultBaseURL, "records/"+url.PathEscape(zenodoID))
+}
+
+func (p *Provider) FetchRecord(ctx context.Context, zenodoID string) (ZenodoRecord, error) {
+	resp, err := utils.HTTPGetWithContext(ctx, p.recordURL(zenodoID), nil)
+	if nil != err {
+		return ZenodoRecord{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ZenodoRecord{}, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if nil != err {
+		return ZenodoRecord{}, err
+	}
+
+	var record ZenodoRecord
+	err = json.Unmarshal(raw, &record)
+	if err != nil {
+		return ZenodoRecord{}, fmt.Errorf("failed to decode JSON: %w\n%s", err, string(raw))
+	}
+	return record, nil
+}
+
+func (p *Provider) Resolve(ctx context.Context, identifier string) (provider.Record, error) {
+	zenodoID, err := ParseIdentifier(identifier)
+	if nil != err {
+		return provider.Record{}, err
+	}
+	record, err := p.FetchRecord(ctx, zenodoID)
+	if nil != err {
+		return provider.Record{}, err
+	}
+
+	result := provider.Record{
+		ID:      strconv.Itoa(record.ID),
+		Title:   record.Title,
+		DOI:     record.DOI,
+		Version: record.Version,
+		Files:   make([]provider.File, 0, len(record.Files)),
+	}
+	if "" == result.Title {
+		result.Title = record.Metadata.Title
+	}
+	for _, creator := range record.Metadata.Creators {
+		value := creator.Name
+		if "" != creator.Affiliation {
+			value = fmt.Sprintf("%s, %s", creator.Name, creator.Affiliation)
+		}
+		result.Details = append(result.Details, provider.Detail{Name: "creator", Value: value})
+	}
+	if id, ok := record.Metadata.License["id"]; ok {
+		result.Details = append(result.Details, provider.Detail{Name: "license", Value: id})
+	}
+	for _, file := range record.Files {
+		result.Files = append(result.Files, provider.File{
+			ID:       file.ID,
+			Name:     file.Key,
+			Size:     file.Size,
+			URL:      file.Links["self"],
+			Checksum: file.Checksum,
+		})
+	}
+	return result, nil
+}
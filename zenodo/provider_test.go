@@ -0,0 +1,70 @@
+package zenodo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	for _, identifier := range []string{
+		"1234567",
+		"10.5281/zenodo.1234567",
+		"doi:10.5281/zenodo.1234567",
+		"https://doi.org/10.5281/zenodo.1234567",
+		"https://dx.doi.org/10.5281/zenodo.1234567",
+		"https://zenodo.org/records/1234567",
+		"https://zenodo.org/record/1234567#files",
+	} {
+		id, err := ParseIdentifier(identifier)
+		if nil != err {
+			t.Errorf("%s: unexpected error: %v", identifier, err)
+		} else if "1234567" != id {
+			t.Errorf("%s: expected 1234567, got %s", identifier, id)
+		}
+	}
+
+	for _, identifier := range []string{"", "10.1000/xyz", "https://example.com/records/1"} {
+		if _, err := ParseIdentifier(identifier); nil == err {
+			t.Errorf("%q: expected error", identifier)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/api/records/42" != r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{
+			"id": 42,
+			"doi": "10.5281/zenodo.42",
+			"title": "Answers",
+			"metadata": {"creators": [{"name": "Adams, D", "affiliation": "Magrathea"}]},
+			"files": [{"id": "f1", "key": "answer.txt", "size": 3, "checksum": "md5:abc", "links": {"self": "https://example.com/answer.txt"}}]
+		}`))
+	}))
+	defer server.Close()
+
+	p := &Provider{BaseURL: server.URL + "/api/"}
+	record, err := p.Resolve(context.Background(), "10.5281/zenodo.42")
+	if nil != err {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if ("42" != record.ID) || ("Answers" != record.Title) || ("10.5281/zenodo.42" != record.DOI) {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if (1 != len(record.Files)) || ("answer.txt" != record.Files[0].Name) || ("md5:abc" != record.Files[0].Checksum) {
+		t.Errorf("unexpected files %+v", record.Files)
+	}
+	if (1 != len(record.Details)) || ("Adams, D, Magrathea" != record.Details[0].Value) {
+		t.Errorf("unexpected details %+v", record.Details)
+	}
+
+	_, err = p.Resolve(context.Background(), "43")
+	if nil == err {
+		t.Errorf("expected error for missing record")
+	}
+}
@@ -1,16 +1,15 @@
 package zenodo
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"time"
 
 	"quantify.earth/reclaimer/internal/utils"
+	"quantify.earth/reclaimer/provider"
 )
 
 type ZenodoCreator struct {
@@ -56,29 +55,9 @@ type ZenodoRecord struct {
 	Submitted  bool                   `json:"submitted"`
 }
 
+// FetchRecord looks up a record on zenodo.org.
 func FetchRecord(zenodoID string) (ZenodoRecord, error) {
-	url := fmt.Sprintf("https://zenodo.org/api/records/%s", zenodoID)
-	resp, err := utils.HTTPGet(url, nil)
-	if nil != err {
-		return ZenodoRecord{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return ZenodoRecord{}, fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, resp.Status)
-	}
-
-	raw, err := io.ReadAll(resp.Body)
-	if nil != err {
-		return ZenodoRecord{}, err
-	}
-
-	var record ZenodoRecord
-	err = json.Unmarshal(raw, &record)
-	if err != nil {
-		return ZenodoRecord{}, fmt.Errorf("failed to decode JSON: %w\n%s", err, string(raw))
-	}
-	return record, nil
+	return (&Provider{}).FetchRecord(context.Background(), zenodoID)
 }
 
 func FetchData(zenodoID string, filename string, extract bool, output string) error {
@@ -108,72 +87,17 @@ func FetchData(zenodoID string, filename string, extract bool, output string) er
 	return utils.DownloadFile(downloadURL, targetFilename, extract, output)
 }
 
-func inspect(zenodoID string) error {
-	record, err := FetchRecord(zenodoID)
-	if nil != err {
-		return err
-	}
-
-	fmt.Printf("title: %s\n", record.Title)
-	fmt.Printf("creators:\n")
-	for _, creator := range record.Metadata.Creators {
-		fmt.Printf("\t%s, %s\n", creator.Name, creator.Affiliation)
-	}
-	if len(record.Metadata.License) > 0 {
-		fmt.Printf("license:\n")
-		for key, value := range record.Metadata.License {
-			fmt.Printf("\t%s: %s\n", key, value)
-		}
-	}
-	fmt.Printf("files:\n")
-	for _, file := range record.Files {
-		units := []string{"b", "Kb", "Mb", "Gb", "Tb"}
-		unitindex := 0
-		count := float64(file.Size)
-		for idx := 0; idx < (len(units) - 1); idx++ {
-			if 1024.0 > count {
-				break
-			}
-			count = count / 1024.0
-			unitindex += 1
-		}
-
-		fmt.Printf("\t%s (%.1f %s)\n", file.Key, count, units[unitindex])
-	}
-
-	return nil
-}
-
+// ZenodoMain runs the zenodo subcommand.
+//
+// Deprecated: reclaimer now finds the subcommand through the provider
+// registry, and this is kept for anything still calling it directly.
 func ZenodoMain(args []string) {
-	flag := flag.NewFlagSet("zenodo", flag.ExitOnError)
-	var (
-		zenodoID = flag.String("zenodo_id", "", "Zenodo ID of resource")
-		filename = flag.String("filename", "", "Specific item within resource to download. If ommitted download first item.")
-		extract  = flag.Bool("extract", false, "If item is compressed extract automatically")
-		output   = flag.String("output", "", "Destination name (filename for single item, directory name if multiple)")
-	)
-	flag.Parse(args)
-
-	if (nil == zenodoID) || (nil == filename) || (nil == extract) || (nil == output) {
-		// stop the static analyser being upset
-		panic("Flags didn't work")
-	}
-
-	// Input sanitisation
-	if "" == *zenodoID {
-		fmt.Fprintf(os.Stderr, "Zenodo ID is requred\n")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	var err error
-	if "" == *filename {
-		err = inspect(*zenodoID)
-	} else {
-		err = FetchData(*zenodoID, *filename, *extract, *output)
-	}
+	// Let an interrupt stop a download cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := provider.Run(ctx, &Provider{}, args)
+	stop()
 	if nil != err {
-		fmt.Fprintf(os.Stderr, "ERROR: %v", err)
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 		os.Exit(1)
 	}
 }